@@ -0,0 +1,90 @@
+package xlb
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// accessList is the static allow and deny lists of the pool, host is denied if it is
+// within any deny range or if allow ranges are provided and host is not within any of them
+type accessList struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// newAccessList parses the CIDR ranges, single IP is the range of the one host
+func newAccessList(allow, deny []string) (*accessList, error) {
+	al := &accessList{}
+	var err error
+	if al.allow, err = parseCIDRs(allow); err != nil {
+		return nil, fmt.Errorf("invalid allow list, error: %w", err)
+	}
+	if al.deny, err = parseCIDRs(deny); err != nil {
+		return nil, fmt.Errorf("invalid deny list, error: %w", err)
+	}
+	return al, nil
+}
+
+func parseCIDRs(ranges []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(ranges))
+	for _, r := range ranges {
+		r = strings.TrimSpace(r)
+		if !strings.Contains(r, "/") {
+			ip := net.ParseIP(r)
+			if ip == nil {
+				return nil, fmt.Errorf("cannot parse %q as IP or CIDR", r)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(r)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse %q as IP or CIDR", r)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// denies reports if the host is not allowed to reach the pool
+func (al *accessList) denies(host string) bool {
+	if al == nil || len(al.allow) == 0 && len(al.deny) == 0 {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return true
+	}
+	for _, ipNet := range al.deny {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	if len(al.allow) == 0 {
+		return false
+	}
+	for _, ipNet := range al.allow {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// deniedByAll reports if every pool denies the host, no pools deny nothing
+func deniedByAll(lists []*accessList, host string) bool {
+	if len(lists) == 0 {
+		return false
+	}
+	for _, al := range lists {
+		if !al.denies(host) {
+			return false
+		}
+	}
+	return true
+}
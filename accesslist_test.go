@@ -0,0 +1,30 @@
+package xlb
+
+import "testing"
+
+// TestAccessList
+// Will test that deny ranges take precedence over allow ranges
+func TestAccessList(t *testing.T) {
+	al, err := newAccessList([]string{"10.0.0.0/8", "2001:db8::/32"}, []string{"10.1.0.0/16", "10.0.0.7"})
+	if err != nil {
+		t.Fatalf("cannot parse access lists, error: %+v", err)
+	}
+	cases := map[string]bool{
+		"10.0.0.1":    false,
+		"10.0.0.7":    true,
+		"10.1.2.3":    true,
+		"192.168.0.1": true,
+		"2001:db8::1": false,
+	}
+	for host, denied := range cases {
+		if al.denies(host) != denied {
+			t.Errorf("host %s should be denied: %v", host, denied)
+		}
+	}
+	if deniedByAll([]*accessList{al, nil}, "192.168.0.1") {
+		t.Errorf("host allowed by any pool should not be denied")
+	}
+	if _, err = newAccessList([]string{"10.0.0.0/33"}, nil); err == nil {
+		t.Errorf("invalid range should not be parsed")
+	}
+}
@@ -0,0 +1,322 @@
+package xlb
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/xdire/xlb/tlsutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const adminMaxBodyBytes = 1 << 20
+
+// AdminOptions configures the admin server inspecting and controlling the balancer at
+// runtime, the server requires the client certificate issued by its own CA
+type AdminOptions struct {
+	// Address of the admin listener, admin server is not served if empty
+	Address string
+	// String server certificate of the admin server
+	Certificate string
+	// String server key of the admin server
+	PrivateKey string
+	// String CA certificate issuing the certificates of the admin clients
+	CACert string
+	// Identities (CN or SAN) of the admin clients allowed, any client of the CA if empty
+	Identities []string
+}
+
+// validate checks the credentials of the admin server if it is configured
+func (o AdminOptions) validate() error {
+	if o.Address == "" {
+		return nil
+	}
+	_, err := o.tlsConfig()
+	return err
+}
+
+func (o AdminOptions) tlsConfig() (*tls.Config, error) {
+	pki, err := tlsutil.FromPKI(o.Certificate, o.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid admin pki data")
+	}
+	caCertPool := x509.NewCertPool()
+	if !caCertPool.AppendCertsFromPEM([]byte(o.CACert)) {
+		return nil, fmt.Errorf("invalid admin ca data")
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{pki.Certificate},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    caCertPool,
+		MinVersion:   tls.VersionTLS13,
+	}, nil
+}
+
+// allows checks the identity of the admin client certificate
+func (o AdminOptions) allows(crt *x509.Certificate) bool {
+	if len(o.Identities) == 0 {
+		return true
+	}
+	names := append(certificateAltNames(crt), crt.Subject.CommonName)
+	for _, identity := range o.Identities {
+		for _, name := range names {
+			if name == identity {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// openAdmin binds the admin listener if the admin address is configured
+func (lb *LoadBalancer) openAdmin() (net.Listener, error) {
+	if lb.admin.Address == "" {
+		return nil, nil
+	}
+	config, err := lb.admin.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	listener, err := tls.Listen("tcp", lb.admin.Address, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for admin on %s, error: %w", lb.admin.Address, err)
+	}
+	return listener, nil
+}
+
+// serveAdmin serves the admin API on the listener until ctx ends
+func (lb *LoadBalancer) serveAdmin(ctx context.Context, listener net.Listener) {
+	handler := lb.AdminHandler()
+	lb.serving.Add(1)
+	go func() {
+		defer lb.serving.Done()
+		if err := serveHTTP(ctx, listener, lb.authorizeAdmin(handler)); err != nil {
+			lb.logger.Err(err).Msg("admin server failed")
+		}
+	}()
+}
+
+// authorizeAdmin rejects the clients which identity is not allowed by the admin options
+func (lb *LoadBalancer) authorizeAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 || !lb.admin.allows(r.TLS.PeerCertificates[0]) {
+			writeAdminError(w, http.StatusForbidden, fmt.Errorf("client identity is not allowed"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AdminHandler provides the handler of the admin API, handler does not authenticate
+// the clients and is expected to be mounted behind the authentication. Endpoints:
+//
+//	GET    /pools                                  status of the pools and their routes
+//	POST   /pools                                  add the pool described by PoolSpec
+//	PUT    /pools/{pool}                           add or update the pool described by PoolSpec
+//	DELETE /pools/{pool}                           remove the pool
+//	POST   /pools/{pool}/routes/{route}/enable     put the route back to the traffic
+//	POST   /pools/{pool}/routes/{route}/disable    take the route out of the traffic
+//	POST   /pools/{pool}/routes/{route}/drain      disable the route and wait for its sessions, ?timeout=30s
+//	GET    /blocklist                              entries of the blocklist
+//	DELETE /blocklist                              clear the blocklist
+//	DELETE /blocklist/{address}                    unblock the address or the prefix
+//	GET    /sessions                               live sessions of all the pools
+//	DELETE /sessions/{pool}/{id}                   kill the session
+//
+// Path segments are escaped as URL path segments
+func (lb *LoadBalancer) AdminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		segments, err := pathSegments(r.URL)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+		if len(segments) == 0 {
+			writeAdminError(w, http.StatusNotFound, fmt.Errorf("not found"))
+			return
+		}
+		switch segments[0] {
+		case "pools":
+			lb.adminPools(w, r, segments[1:])
+		case "blocklist":
+			lb.adminBlocklist(w, r, segments[1:])
+		case "sessions":
+			lb.adminSessions(w, r, segments[1:])
+		default:
+			writeAdminError(w, http.StatusNotFound, fmt.Errorf("not found"))
+		}
+	})
+}
+
+func (lb *LoadBalancer) adminPools(w http.ResponseWriter, r *http.Request, segments []string) {
+	switch {
+	case len(segments) == 0 && r.Method == http.MethodGet:
+		writeAdminJSON(w, http.StatusOK, lb.Pools())
+	case len(segments) == 0 && r.Method == http.MethodPost:
+		pool, err := readPoolSpec(r, "")
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err = lb.AddServicePool(pool); err != nil {
+			writeAdminError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		writeAdminJSON(w, http.StatusCreated, map[string]string{"identity": pool.Identity()})
+	case len(segments) == 1 && r.Method == http.MethodPut:
+		pool, err := readPoolSpec(r, segments[0])
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err = lb.UpdatePool(pool); err != nil {
+			writeAdminError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]string{"identity": pool.Identity()})
+	case len(segments) == 1 && r.Method == http.MethodDelete:
+		if err := lb.RemoveServicePool(segments[0]); err != nil {
+			writeAdminError(w, adminErrorStatus(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(segments) == 4 && segments[1] == "routes" && r.Method == http.MethodPost:
+		lb.adminRoute(w, r, segments[0], segments[2], segments[3])
+	case len(segments) <= 1 || len(segments) == 4 && segments[1] == "routes":
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	default:
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("not found"))
+	}
+}
+
+func (lb *LoadBalancer) adminRoute(w http.ResponseWriter, r *http.Request, identity, address, action string) {
+	var err error
+	switch action {
+	case "enable", "disable":
+		err = lb.SetRouteActive(identity, address, action == "enable")
+	case "drain":
+		timeout := defaultDrainTimeout
+		if value := r.URL.Query().Get("timeout"); value != "" {
+			if timeout, err = time.ParseDuration(value); err != nil || timeout <= 0 {
+				writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid timeout %q", value))
+				return
+			}
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		var report DrainReport
+		if report, err = lb.DrainRoute(ctx, identity, address); err == nil {
+			writeAdminJSON(w, http.StatusOK, report)
+			return
+		}
+	default:
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("unknown route action %s", action))
+		return
+	}
+	if err != nil {
+		writeAdminError(w, adminErrorStatus(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (lb *LoadBalancer) adminBlocklist(w http.ResponseWriter, r *http.Request, segments []string) {
+	switch {
+	case len(segments) == 0 && r.Method == http.MethodGet:
+		writeAdminJSON(w, http.StatusOK, lb.Blocklist())
+	case len(segments) == 0 && r.Method == http.MethodDelete:
+		writeAdminJSON(w, http.StatusOK, map[string]int{"removed": lb.ClearBlocklist()})
+	case len(segments) == 1 && r.Method == http.MethodDelete:
+		if !lb.Unblock(segments[0]) {
+			writeAdminError(w, http.StatusNotFound, fmt.Errorf("address %s is not in the blocklist", segments[0]))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(segments) <= 1:
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	default:
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("not found"))
+	}
+}
+
+func (lb *LoadBalancer) adminSessions(w http.ResponseWriter, r *http.Request, segments []string) {
+	switch {
+	case len(segments) == 0 && r.Method == http.MethodGet:
+		writeAdminJSON(w, http.StatusOK, lb.Sessions())
+	case len(segments) == 2 && r.Method == http.MethodDelete:
+		id, err := strconv.ParseUint(segments[1], 10, 64)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid session id %q", segments[1]))
+			return
+		}
+		if !lb.KillSession(segments[0], id) {
+			writeAdminError(w, http.StatusNotFound, fmt.Errorf("session %d of pool %s is not forwarded", id, segments[0]))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(segments) == 0 || len(segments) == 2:
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	default:
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("not found"))
+	}
+}
+
+// readPoolSpec decodes the pool of the request, identity of the path takes
+// precedence over the missing identity of the spec
+func readPoolSpec(r *http.Request, identity string) (ServicePool, error) {
+	spec := PoolSpec{}
+	decoder := json.NewDecoder(http.MaxBytesReader(nil, r.Body, adminMaxBodyBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&spec); err != nil {
+		return ServicePool{}, fmt.Errorf("invalid pool spec, error: %w", err)
+	}
+	if identity != "" {
+		if spec.Identity == "" {
+			spec.Identity = identity
+		}
+		if spec.Identity != identity {
+			return ServicePool{}, fmt.Errorf("pool spec identity %s does not match %s", spec.Identity, identity)
+		}
+	}
+	return spec.ServicePool()
+}
+
+// pathSegments splits the escaped path for the segments to be able to contain slashes
+func pathSegments(u *url.URL) ([]string, error) {
+	segments := make([]string, 0, 4)
+	for _, segment := range strings.Split(strings.Trim(u.EscapedPath(), "/"), "/") {
+		if segment == "" {
+			continue
+		}
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path segment %q", segment)
+		}
+		segments = append(segments, unescaped)
+	}
+	return segments, nil
+}
+
+func adminErrorStatus(err error) int {
+	if errors.Is(err, ErrPoolNotFound) || errors.Is(err, ErrRouteNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusUnprocessableEntity
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	writeAdminJSON(w, status, map[string]string{"error": err.Error()})
+}
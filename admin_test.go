@@ -0,0 +1,238 @@
+package xlb
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"github.com/rs/zerolog"
+	"github.com/xdire/xlb/tlsutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestAdminHandler
+// Will test that admin endpoints inspect and change the pools and the blocklist
+func TestAdminHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lb, err := NewLoadBalancer(ctx, []ServicePool{{
+		SvcIdentity: "test",
+		SvcPort:     9130,
+		SvcRoutes: []ServicePoolRoute{
+			{ServicePath: "localhost:9131", ServiceActive: true},
+			{ServicePath: "localhost:9132", ServiceActive: true},
+		},
+	}}, Options{})
+	if err != nil {
+		t.Fatalf("cannot configure load balancer, error: %+v", err)
+	}
+	handler := lb.AdminHandler()
+	call := func(method, path, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return recorder
+	}
+
+	resp := call(http.MethodPost, "/pools/test/routes/localhost:9132/disable", "")
+	if resp.Code != http.StatusNoContent {
+		t.Fatalf("route should be disabled, status: %d %s", resp.Code, resp.Body)
+	}
+	if call(http.MethodPost, "/pools/test/routes/localhost:1/disable", "").Code != http.StatusNotFound {
+		t.Errorf("unknown route should not be found")
+	}
+
+	resp = call(http.MethodGet, "/pools", "")
+	statuses := make([]PoolStatus, 0)
+	if err = json.NewDecoder(resp.Body).Decode(&statuses); err != nil {
+		t.Fatalf("cannot decode pools, error: %+v", err)
+	}
+	if len(statuses) != 1 || len(statuses[0].Routes) != 2 || !statuses[0].Routes[0].Active || statuses[0].Routes[1].Active {
+		t.Errorf("unexpected pools %+v", statuses)
+	}
+
+	spec := `{"port": 9133, "routes": [{"address": "localhost:9134"}], "route_timeout": "2s"}`
+	if resp = call(http.MethodPut, "/pools/other", spec); resp.Code != http.StatusOK {
+		t.Fatalf("pool should be added, status: %d %s", resp.Code, resp.Body)
+	}
+	if pool := lb.poolMap["other"]; pool.Port() != 9133 || pool.RouteTimeout() != time.Second*2 || !pool.Routes()[0].Active() {
+		t.Errorf("unexpected pool %+v", pool)
+	}
+	if call(http.MethodPut, "/pools/other", `{"identity": "test"}`).Code != http.StatusBadRequest {
+		t.Errorf("pool spec of the other identity should be rejected")
+	}
+	if call(http.MethodDelete, "/pools/other", "").Code != http.StatusNoContent {
+		t.Errorf("pool should be removed")
+	}
+	if call(http.MethodDelete, "/pools/other", "").Code != http.StatusNotFound {
+		t.Errorf("removed pool should not be found")
+	}
+
+	lb.ipLRU.Put("10.0.0.1", time.Now().Add(time.Minute), 5)
+	lb.ipLRU.Put("10.0.0.2", time.Now().Add(time.Minute), 5)
+	entries := make([]CacheEntry, 0)
+	if err = json.NewDecoder(call(http.MethodGet, "/blocklist", "").Body).Decode(&entries); err != nil || len(entries) != 2 {
+		t.Errorf("blocklist should have 2 entries, got: %+v", entries)
+	}
+	if call(http.MethodDelete, "/blocklist/10.0.0.1", "").Code != http.StatusNoContent {
+		t.Errorf("address should be unblocked")
+	}
+	if _, ok := lb.ipLRU.Get("10.0.0.1"); ok {
+		t.Errorf("unblocked address should be removed from the blocklist")
+	}
+	call(http.MethodDelete, "/blocklist", "")
+	if lb.ipLRU.Len() != 0 {
+		t.Errorf("blocklist should be cleared")
+	}
+
+	if call(http.MethodDelete, "/sessions/test/1", "").Code != http.StatusNotFound {
+		t.Errorf("session which is not forwarded should not be found")
+	}
+	if call(http.MethodGet, "/unknown", "").Code != http.StatusNotFound {
+		t.Errorf("unknown endpoint should not be found")
+	}
+}
+
+// TestAdminServerMutualTLS
+// Will test that admin server accepts only the allowed clients of its CA
+func TestAdminServerMutualTLS(t *testing.T) {
+	err := tlsutil.CreateLocalTLSData("operator")
+	defer func() {
+		_, err := tlsutil.WipeLocalTLSData("./")
+		if err != nil {
+			t.Error("cannot clean pre-arranged test files")
+		}
+	}()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := os.ReadFile("server.crt")
+	key, _ := os.ReadFile("server.key")
+	ca, _ := os.ReadFile("ca.crt")
+	clientCert, err := tls.LoadX509KeyPair("client.crt", "client.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca)
+
+	get := func(address string, certs []tls.Certificate) (int, error) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: certs},
+			DisableKeepAlives: true,
+		}}
+		resp, err := client.Get("https://" + address + "/pools")
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	for identities, expected := range map[string]int{"operator": http.StatusOK, "someone-else": http.StatusForbidden} {
+		ctx, cancel := context.WithCancel(context.Background())
+		lb := &LoadBalancer{
+			poolMap:      map[string]ServicePool{},
+			forwarderMap: map[string]*Forwarder{},
+			logger:       zerolog.Nop(),
+			admin: AdminOptions{
+				Address:     "localhost:0",
+				Certificate: string(cert),
+				PrivateKey:  string(key),
+				CACert:      string(ca),
+				Identities:  []string{identities},
+			},
+		}
+		listener, err := lb.openAdmin()
+		if err != nil {
+			t.Fatalf("cannot open admin listener, error: %+v", err)
+		}
+		lb.serveAdmin(ctx, listener)
+		_, port, _ := net.SplitHostPort(listener.Addr().String())
+		address := "localhost:" + port
+
+		if status, err := get(address, []tls.Certificate{clientCert}); err != nil || status != expected {
+			t.Errorf("client allowed by %s should get status %d, got: %d %v", identities, expected, status, err)
+		}
+		if _, err = get(address, nil); err == nil {
+			t.Errorf("client without certificate should not be served")
+		}
+		cancel()
+		lb.serving.Wait()
+	}
+}
+
+// TestLoadBalancerDrainRoute
+// Will test that the route drained by the admin is given the drain timeout of the
+// call rather than the drain window of the pool, and lingering sessions are reported killed
+func TestLoadBalancerDrainRoute(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err := tlsutil.CreateLocalTLSData("test")
+	defer func() {
+		_, err := tlsutil.WipeLocalTLSData("./")
+		if err != nil {
+			t.Error("cannot clean pre-arranged test files")
+		}
+	}()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := os.ReadFile("server.crt")
+	key, _ := os.ReadFile("server.key")
+	ca, _ := os.ReadFile("ca.crt")
+
+	address, stop := startEchoServer(t)
+	defer stop()
+	lb, err := NewLoadBalancer(ctx, []ServicePool{{
+		SvcIdentity:     "test",
+		SvcPort:         9135,
+		SvcRoutes:       []ServicePoolRoute{{ServicePath: address, ServiceActive: true}},
+		Certificate:     string(cert),
+		CertKey:         string(key),
+		CACert:          string(ca),
+		SvcDrainTimeout: time.Millisecond * 100,
+	}}, Options{})
+	if err != nil {
+		t.Fatalf("cannot configure load balancer, error: %+v", err)
+	}
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- lb.Listen()
+	}()
+	<-time.After(time.Millisecond * 500)
+	fwd, ok := lb.forwarder("test")
+	if !ok {
+		t.Fatalf("pool should be served")
+	}
+
+	completing, _ := attachSession(t, fwd)
+	lingering, _ := attachSession(t, fwd)
+	defer lingering.Close()
+	go func() {
+		// Completes after the drain window of the pool
+		<-time.After(time.Millisecond * 300)
+		completing.Close()
+	}()
+
+	drainCtx, drainCancel := context.WithTimeout(ctx, time.Millisecond*600)
+	defer drainCancel()
+	report, err := lb.DrainRoute(drainCtx, "test", address)
+	if err != nil {
+		t.Fatalf("cannot drain route, error: %+v", err)
+	}
+	if report.Drained != 1 || report.Killed != 1 {
+		t.Errorf("expected 1 drained and 1 killed session, got: %+v", report)
+	}
+
+	cancel()
+	if err = <-listenErr; err != nil {
+		t.Errorf("listen returned error: %+v", err)
+	}
+}
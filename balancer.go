@@ -2,16 +2,11 @@ package xlb
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/rs/zerolog"
-	"github.com/xdire/xlb/tlsutil"
-	"net"
 	"os"
-	"strings"
 	"sync"
 	"time"
 )
@@ -20,12 +15,17 @@ const (
 	defaultRequestPerSecondRate = 1000
 	defaultIPLRUCapacity        = 1000
 	defaultIPLRUBlockThreshold  = 10
+	maxRouteWeight              = 1000000
+	defaultHandshakeTimeout     = time.Second * 10
 )
 
+// ErrPoolNotFound is returned for the operations on the pool the balancer does not have
+var ErrPoolNotFound = errors.New("pool does not exist")
+
 // ServicePool structure that describes the unit of services
 // where traffic can be routed using mTLS verification
 type ServicePool struct {
-	// How each ServicePool identified, CN match
+	// How each ServicePool identified, CN match (or SAN if CN does not match)
 	SvcIdentity string
 	// to listen for incoming traffic
 	SvcPort int
@@ -33,6 +33,23 @@ type ServicePool struct {
 	SvcRateQuotaTimes int
 	// Unit of time for rate
 	SvcRateQuotaDuration time.Duration
+	// Rate limiting algorithm, one of RateLimiter* constants (token-bucket default)
+	SvcRateLimiter string
+	// Rate limit of every client certificate of the pool, disabled by default
+	SvcClientRateLimit KeyedRateLimit
+	// Rate limit of every source IP of the pool, disabled by default
+	SvcIPRateLimit KeyedRateLimit
+	// Sessions open at once for the pool and for every client, unlimited by default, hot-updatable
+	SvcConnectionLimit ConnectionLimit
+	// Bytes per second forwarded for the pool and for every client, unlimited by default, hot-updatable
+	SvcBandwidth Bandwidth
+	// Blocking of the addresses failing the handshake or the identity matching, settings
+	// not set are inherited from the BlockPolicy of the balancer
+	SvcBlockPolicy BlockPolicy
+	// Client addresses allowed to reach the pool as IPs or CIDR ranges, any address allowed if empty
+	SvcAllowCIDRs []string
+	// Client addresses denied to reach the pool as IPs or CIDR ranges, deny takes precedence over allow
+	SvcDenyCIDRs []string
 	// Where to route this pool
 	SvcRoutes []ServicePoolRoute
 	// String server certificate as it was read from file
@@ -41,12 +58,37 @@ type ServicePool struct {
 	CertKey string
 	// String CA certificate as it was read from file
 	CACert string
+	// Server names (SNI) this pool is served for, pools without server names
+	// are served for any ClientHello not matching other pools on the same port
+	SvcServerNames []string
 	// General timeout to call the upstream service
 	SvcRouteTimeout time.Duration
-	// How many times server need to be revalidated before get healthy again
+	// How many times server need to be revalidated before get healthy again, hot-updatable
 	SvcHealthCheckValidations int
-	// How often Health check scheduler should check up on the server (1000ms or greater for optimal performance)
+	// How often Health check scheduler should check up on the unhealthy server at most, rechecks start
+	// sooner and back off exponentially up to this interval (1000ms or greater for optimal performance),
+	// hot-updatable
 	SvcHealthCheckRescheduleMs int
+	// How often every active route is probed while healthy, 0 disables active health checks, hot-updatable
+	SvcHealthCheckIntervalMs int
+	// How many consecutive failed probes mark the route unhealthy (3 default), hot-updatable
+	SvcHealthCheckFailures int
+	// Probe checking the health of the routes (TCPProbe default), one of HTTPProbe,
+	// GRPCProbe, TLSProbe or ProbeFunc for custom checks, hot-updatable
+	SvcHealthProbe HealthProbe
+	// Failover to the other routes when dialing the route fails, hot-updatable
+	SvcRetryPolicy RetryPolicy
+	// Passive ejection of the routes failing live sessions, disabled by default, hot-updatable
+	SvcOutlierDetection OutlierDetection
+	// How long sessions of removed routes or removed pool are allowed to complete before force-close (30s default)
+	SvcDrainTimeout time.Duration
+	// Balancing strategy name, one of Strategy* constants (least-connections default)
+	SvcStrategy string
+	// Session property the consistent-hash strategy is keyed by, one of HashKey* constants (remote-ip default)
+	SvcHashKey string
+	// Factory for the custom balancing strategy, takes precedence over SvcStrategy,
+	// custom strategy is recreated on every pool update
+	SvcStrategyFactory func() Strategy
 }
 
 func (t ServicePool) GetCertificate() string { return t.Certificate }
@@ -57,34 +99,82 @@ func (t ServicePool) GetCACertificate() string { return t.CACert }
 
 func (t ServicePool) Identity() string { return t.SvcIdentity }
 
+func (t ServicePool) ServerNames() []string { return t.SvcServerNames }
+
 func (t ServicePool) Port() int { return t.SvcPort }
 
 func (t ServicePool) RateQuota() (int, time.Duration) {
 	return t.SvcRateQuotaTimes, t.SvcRateQuotaDuration
 }
 
+func (t ServicePool) RateLimiterName() string { return t.SvcRateLimiter }
+
+func (t ServicePool) ClientRateLimit() KeyedRateLimit { return t.SvcClientRateLimit }
+
+func (t ServicePool) IPRateLimit() KeyedRateLimit { return t.SvcIPRateLimit }
+
+func (t ServicePool) ConnectionLimit() ConnectionLimit { return t.SvcConnectionLimit }
+
+func (t ServicePool) Bandwidth() Bandwidth { return t.SvcBandwidth }
+
 func (t ServicePool) Routes() []ServicePoolRoute { return t.SvcRoutes }
 
-func (t ServicePool) UnauthorizedAttempts() int {
-	//TODO implement me
-	panic("implement me")
-}
+func (t ServicePool) BlockPolicy() BlockPolicy { return t.SvcBlockPolicy }
+
+func (t ServicePool) AllowCIDRs() []string { return t.SvcAllowCIDRs }
+
+func (t ServicePool) DenyCIDRs() []string { return t.SvcDenyCIDRs }
+
+// UnauthorizedAttempts the address can make before it is blocked for the pool,
+// 0 means the threshold is inherited from the balancer
+func (t ServicePool) UnauthorizedAttempts() int { return t.SvcBlockPolicy.Threshold }
 
 func (t ServicePool) HealthCheckValidations() int { return t.SvcHealthCheckValidations }
 
 func (t ServicePool) HealthCheckRescheduleMs() int { return t.SvcHealthCheckRescheduleMs }
 
+func (t ServicePool) HealthCheckIntervalMs() int { return t.SvcHealthCheckIntervalMs }
+
+func (t ServicePool) HealthCheckFailures() int { return t.SvcHealthCheckFailures }
+
+func (t ServicePool) HealthProbe() HealthProbe { return t.SvcHealthProbe }
+
+func (t ServicePool) OutlierDetection() OutlierDetection { return t.SvcOutlierDetection }
+
+func (t ServicePool) RetryPolicy() RetryPolicy { return t.SvcRetryPolicy }
+
 func (t ServicePool) RouteTimeout() time.Duration { return t.SvcRouteTimeout }
 
+func (t ServicePool) DrainTimeout() time.Duration { return t.SvcDrainTimeout }
+
+func (t ServicePool) StrategyName() string { return t.SvcStrategy }
+
+func (t ServicePool) StrategyFactory() func() Strategy { return t.SvcStrategyFactory }
+
+func (t ServicePool) HashKey() string { return t.SvcHashKey }
+
 type ServicePoolRoute struct {
 	ServicePath   string
 	ServiceActive bool
+	// Relative share of traffic for weighted strategies (1 default), hot-updatable
+	ServiceWeight int
+	// Sessions open at once for the route, 0 is unlimited, hot-updatable
+	ServiceMaxConnections int
 }
 
 func (t ServicePoolRoute) Path() string { return t.ServicePath }
 
 func (t ServicePoolRoute) Active() bool { return t.ServiceActive }
 
+func (t ServicePoolRoute) Weight() int {
+	if t.ServiceWeight <= 0 {
+		return 1
+	}
+	return t.ServiceWeight
+}
+
+func (t ServicePoolRoute) MaxConnections() int { return t.ServiceMaxConnections }
+
 type Options struct {
 	// Provide the reference for the logger instance
 	Logger *zerolog.Logger
@@ -92,6 +182,19 @@ type Options struct {
 	LogLevel string
 	// Capacity of IP LRU cache to manage unauthorized requests limits
 	IpBlockListCapacity int
+	// Blocking of the addresses failing the handshake or the identity matching for all the pools
+	BlockPolicy BlockPolicy
+	// Store keeping the blocklist between the restarts, SharedBlocklistStore shares it with other balancers
+	BlocklistStore BlocklistStore
+	// How often entries of the other balancers are loaded from SharedBlocklistStore (10s default)
+	BlocklistSyncInterval time.Duration
+	// Address of the HTTP listener serving the metrics at /metrics in Prometheus text format,
+	// metrics are not served if empty
+	MetricsAddress string
+	// Admin server inspecting and controlling the balancer at runtime, protected by its own mTLS
+	Admin AdminOptions
+	// How long the client is given to complete the TLS handshake (10s default)
+	HandshakeTimeout time.Duration
 }
 
 // LoadBalancer provides capability to accept the traffic and route it
@@ -99,19 +202,37 @@ type Options struct {
 type LoadBalancer struct {
 	id           string
 	runCtx       context.Context
-	killCtx      context.CancelFunc
 	logger       zerolog.Logger
 	poolMap      map[string]ServicePool
 	forwarderMap map[string]*Forwarder
 	mutex        sync.Mutex
 	ipLRU        *LRUCache
+	blockPolicy  BlockPolicy
+	// Store of the blocklist, blockPublish queues entries for the shared store
+	blockStore        BlocklistStore
+	blockSyncInterval time.Duration
+	blockPublish      chan CacheEntry
+	// Bus of the security and routing events
+	events *EventBus
+	// Counters of the balancer, served at metricsAddress while listening
+	metrics        *Metrics
+	metricsAddress string
+	admin          AdminOptions
+	// How long the client is given to complete the TLS handshake
+	handshakeTimeout time.Duration
+	// State of the running listeners, listenCtx is nil while balancer is not listening,
+	// listenCancel ends the running Listen
+	listenCtx    context.Context
+	listenCancel context.CancelFunc
+	listenErr    chan error
+	listeners    map[int]*portListener
+	serving      sync.WaitGroup
 }
 
 // NewLoadBalancer creates new instance of the load balancer
-// using array of pool configuration. For each pool it is
-// assumed that it has unique port, otherwise Listen will
-// fail with the error
-// TODO: Add checkup in constructor for enforce unique port per pool configuration
+// using array of pool configuration. Pools can share the same
+// port, in that case the pool for the session will be selected
+// by the server name and the identity of the client certificate
 func NewLoadBalancer(ctx context.Context, cfgPool []ServicePool, opt Options) (*LoadBalancer, error) {
 	id, err := uuid.NewRandom()
 	if err != nil {
@@ -129,10 +250,27 @@ func NewLoadBalancer(ctx context.Context, cfgPool []ServicePool, opt Options) (*
 		logger = *opt.Logger
 	}
 
+	if opt.IpBlockListCapacity < 0 {
+		return nil, fmt.Errorf("invalid ip block list capacity %d", opt.IpBlockListCapacity)
+	}
+	if err := opt.BlockPolicy.validate(); err != nil {
+		return nil, fmt.Errorf("invalid block policy, error: %w", err)
+	}
+	if err := opt.Admin.validate(); err != nil {
+		return nil, fmt.Errorf("invalid admin options, error: %w", err)
+	}
+	if opt.HandshakeTimeout < 0 {
+		return nil, fmt.Errorf("invalid handshake timeout %s", opt.HandshakeTimeout)
+	}
+	handshakeTimeout := opt.HandshakeTimeout
+	if handshakeTimeout == 0 {
+		handshakeTimeout = defaultHandshakeTimeout
+	}
+
 	poolMap := make(map[string]ServicePool)
 	for _, pool := range cfgPool {
-		if len(pool.Identity()) == 0 {
-			return nil, fmt.Errorf("pool missing identity")
+		if err := validateServicePool(pool); err != nil {
+			return nil, err
 		}
 		poolMap[pool.Identity()] = pool
 	}
@@ -142,313 +280,450 @@ func NewLoadBalancer(ctx context.Context, cfgPool []ServicePool, opt Options) (*
 		ipLRUCap = defaultIPLRUCapacity
 	}
 
-	derCtx, cancelFunc := context.WithCancel(ctx)
+	syncInterval := opt.BlocklistSyncInterval
+	if syncInterval <= 0 {
+		syncInterval = defaultBlocklistSyncInterval
+	}
+	var blockPublish chan CacheEntry
+	if _, shared := opt.BlocklistStore.(SharedBlocklistStore); shared {
+		blockPublish = make(chan CacheEntry, blocklistPublishQueue)
+	}
+
 	return &LoadBalancer{
 		id:           id.String(),
-		runCtx:       derCtx,
-		killCtx:      cancelFunc,
+		runCtx:       ctx,
 		logger:       logger,
 		forwarderMap: map[string]*Forwarder{},
+		listeners:    map[int]*portListener{},
 		poolMap:      poolMap,
-		ipLRU:        NewLRUCache(defaultIPLRUCapacity),
+		ipLRU:        NewLRUCache(ipLRUCap),
+		blockPolicy:  opt.BlockPolicy,
+
+		blockStore:        opt.BlocklistStore,
+		blockSyncInterval: syncInterval,
+		blockPublish:      blockPublish,
+		events:            NewEventBus(),
+		metrics:           NewMetrics(),
+		metricsAddress:    opt.MetricsAddress,
+		admin:             opt.Admin,
+		handshakeTimeout:  handshakeTimeout,
 	}, nil
 }
 
 // UpdatePool will update pool using pool.Identity() method, this will
 // trigger hot-swap operation on running forwarder for pool and should
-// replace targets behind the load balancer without the restart
+// replace targets behind the load balancer without the restart. If the
+// port of the pool changed, pool will be moved to the listener of the new
+// port, pool which did not exist before will be added
 func (lb *LoadBalancer) UpdatePool(pool ServicePool) error {
-	if len(pool.Identity()) == 0 {
-		return fmt.Errorf("pool missing identity")
+	if err := validateServicePool(pool); err != nil {
+		return err
 	}
 	lb.mutex.Lock()
 	defer lb.mutex.Unlock()
-	lb.poolMap[pool.Identity()] = pool
-	if fwd, exists := lb.forwarderMap[pool.Identity()]; exists {
-		fwd.UpdateServicePool(pool)
+	current, exists := lb.poolMap[pool.Identity()]
+	if !exists {
+		return lb.addPool(pool)
 	}
-	return nil
+	return lb.updatePool(current, pool)
 }
 
-// Listen will try to launch balancer on all the required ports, strategy is all or nothing
-func (lb *LoadBalancer) Listen() error {
+// forwarder provides the forwarder of the pool while balancer is listening
+func (lb *LoadBalancer) forwarder(identity string) (*Forwarder, bool) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	fwd, exists := lb.forwarderMap[identity]
+	return fwd, exists
+}
 
-	// Do this step to ensure that we will fail on misconfiguration if more than
-	// one service pool mapping presented to this load balance for mTLS
-	// TODO: TLS Allows manual verification for the handshake by that we can launch multiple pools on the same port
-	// TODO: for the first version we will limit 1 pool per port for simplicity
-	mapping, err := collectListenTargets(lb.poolMap)
-	if err != nil {
+// Events provides the bus of the security and routing events of the balancer
+func (lb *LoadBalancer) Events() *EventBus { return lb.events }
+
+// AddServicePool adds the pool to the balancer, if balancer is listening the pool
+// will be served right away, sharing the listener if its port is already served
+// or spawning the new listener otherwise. Pool which exists will be updated
+func (lb *LoadBalancer) AddServicePool(pool ServicePool) error {
+	if err := validateServicePool(pool); err != nil {
 		return err
 	}
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	if current, exists := lb.poolMap[pool.Identity()]; exists {
+		return lb.updatePool(current, pool)
+	}
+	return lb.addPool(pool)
+}
 
-	type schedule struct {
-		port int
-		tls  *tls.Config
-		pool ServicePool
+// RemoveServicePool stops routing the pool traffic, sessions already forwarded are
+// given the pool drain window to complete. If no more pools are served on the port,
+// the port will be closed
+func (lb *LoadBalancer) RemoveServicePool(identity string) error {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	pool, exists := lb.poolMap[identity]
+	if !exists {
+		return fmt.Errorf("pool %s, error: %w", identity, ErrPoolNotFound)
 	}
-	scheduleListeners := make([]schedule, len(mapping))
-	i := 0
-	// Build schedule list not to have thread failures at this stage
-	for port, identity := range mapping {
+	delete(lb.poolMap, identity)
+	lb.unservePool(pool)
+	// Series of the served pool are dropped once its sessions are drained
+	if lb.listenCtx == nil {
+		lb.metrics.removePool(identity)
+	}
+	lb.events.Emit(Event{Type: EventPoolUpdated, Pool: identity, Port: pool.Port(), Reason: "removed"})
+	return nil
+}
 
-		pki, err := tlsutil.FromPKI(identity.GetCertificate(), identity.GetPrivateKey())
-		if err != nil {
-			return fmt.Errorf("invalid service pool pki data")
-		}
+// Next methods are expecting lb.mutex to be held by the caller
 
-		caCert := identity.GetCACertificate()
-		caCertPool := x509.NewCertPool()
-		if !caCertPool.AppendCertsFromPEM([]byte(caCert)) {
-			return fmt.Errorf("invalid service pool ca data")
-		}
+func (lb *LoadBalancer) addPool(pool ServicePool) error {
+	if err := lb.servePool(pool); err != nil {
+		return err
+	}
+	lb.poolMap[pool.Identity()] = pool
+	lb.events.Emit(Event{Type: EventPoolUpdated, Pool: pool.Identity(), Port: pool.Port(), Reason: "added"})
+	return nil
+}
 
-		config := &tls.Config{
-			Certificates:     []tls.Certificate{pki.Certificate},
-			ClientAuth:       tls.RequireAndVerifyClientCert,
-			ClientCAs:        caCertPool,
-			MinVersion:       tls.VersionTLS13,
-			MaxVersion:       tls.VersionTLS13,
-			CurvePreferences: []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
+func (lb *LoadBalancer) updatePool(current, pool ServicePool) error {
+	if lb.listenCtx == nil {
+		lb.poolMap[pool.Identity()] = pool
+		lb.events.Emit(Event{Type: EventPoolUpdated, Pool: pool.Identity(), Port: pool.Port(), Reason: "updated"})
+		return nil
+	}
+	if current.Port() != pool.Port() {
+		// Move the pool, sessions forwarded from the old port are drained
+		lb.unservePool(current)
+		if err := lb.servePool(pool); err != nil {
+			delete(lb.poolMap, pool.Identity())
+			return fmt.Errorf("pool %s removed, cannot move to port %d, error: %w", pool.Identity(), pool.Port(), err)
 		}
+		lb.poolMap[pool.Identity()] = pool
+		lb.events.Emit(Event{Type: EventPoolUpdated, Pool: pool.Identity(), Port: pool.Port(), Reason: "moved"})
+		return nil
+	}
+	if pl, exists := lb.listeners[pool.Port()]; exists {
+		if err := pl.updatePool(pool); err != nil {
+			return err
+		}
+	}
+	lb.poolMap[pool.Identity()] = pool
+	lb.events.Emit(Event{Type: EventPoolUpdated, Pool: pool.Identity(), Port: pool.Port(), Reason: "updated"})
+	return nil
+}
 
-		scheduleListeners[i] = schedule{port, config, identity}
-		i++
+// servePool dispatches the pool on the listener for its port, creating and
+// starting the listener if port is not served yet
+func (lb *LoadBalancer) servePool(pool ServicePool) error {
+	if lb.listenCtx == nil {
+		return nil
+	}
+	if pl, exists := lb.listeners[pool.Port()]; exists {
+		binding, err := newPoolBinding(pool, lb)
+		if err != nil {
+			return err
+		}
+		pl.addPool(binding)
+		lb.forwarderMap[pool.Identity()] = binding.forwarder
+		return nil
+	}
+	pl, err := newPortListener(lb, pool.Port(), []ServicePool{pool})
+	if err != nil {
+		return err
 	}
+	if err = pl.open(); err != nil {
+		return err
+	}
+	lb.listeners[pool.Port()] = pl
+	lb.forwarderMap[pool.Identity()] = pl.pools[pool.Identity()].forwarder
+	lb.startListener(pl)
+	return nil
+}
 
-	// Schedule listeners one by one and fail if any of them fail
-	derCtx, derCancel := context.WithCancel(lb.runCtx)
-	errChan := make(chan error, len(scheduleListeners))
-	defer close(errChan)
-
-	wg := sync.WaitGroup{}
-	for _, params := range scheduleListeners {
-		wg.Add(1)
-		go func(ctx context.Context, cancelAll context.CancelFunc, errChan chan error, toSchedule schedule) {
-
-			// Don't forget to close all contexts
-			defer derCancel()
-			// Try to listen
-			listen, err := tls.Listen("tcp", fmt.Sprintf("localhost:%d", toSchedule.port), toSchedule.tls)
-			if err != nil {
-				errChan <- fmt.Errorf("failed to listen on port")
-				wg.Done()
-				return
+// unservePool removes the pool from the listener for its port, closing the
+// listener if no more pools left to serve
+func (lb *LoadBalancer) unservePool(pool ServicePool) {
+	pl, exists := lb.listeners[pool.Port()]
+	if !exists {
+		return
+	}
+	binding, left := pl.removePool(pool.Identity())
+	if binding != nil {
+		delete(lb.forwarderMap, pool.Identity())
+		binding.forwarder.Close()
+		go func(identity string, fwd *Forwarder) {
+			ctx, cancel := context.WithTimeout(context.Background(), fwd.DrainTimeout())
+			defer cancel()
+			report := fwd.Drain(ctx)
+			lb.logger.Info().Msgf("pool %s drained, sessions drained: %d killed: %d", identity, report.Drained, report.Killed)
+			// Pool moved to the other port or added back keeps its series
+			lb.mutex.Lock()
+			if _, exists := lb.poolMap[identity]; !exists {
+				lb.metrics.removePool(identity)
 			}
+			lb.mutex.Unlock()
+		}(pool.Identity(), binding.forwarder)
+	}
+	if left == 0 {
+		pl.close()
+		delete(lb.listeners, pool.Port())
+	}
+}
 
-			// Spawn the coroutine to watch for the context break
-			go func(l net.Listener) {
-				// Here all required procedures were established for the listener thread
-				wg.Done()
-				// Await for context break
-				<-ctx.Done()
-				err := listen.Close()
-				lb.logger.Info().Msgf("closing listener at port %d", toSchedule.port)
-				if err != nil {
-					lb.logger.Err(err).Msgf("error closing listener at port %d", toSchedule.port)
-				}
-			}(listen)
-
-			lb.logger.Info().Msgf("listening at port %d", toSchedule.port)
+func (lb *LoadBalancer) startListener(pl *portListener) {
+	lb.serving.Add(1)
+	go func(ctx context.Context, errChan chan error) {
+		defer lb.serving.Done()
+		pl.serve(ctx, errChan)
+	}(lb.listenCtx, lb.listenErr)
+}
 
-			// Bind pool and forwarder
-			currentPool := toSchedule.pool
-			var forwarder *Forwarder
+// Shutdown stops accepting new connections on all the ports and waits for the sessions
+// in flight to complete until ctx ends, sessions still running after that are force-closed.
+// Sessions not attached by the time shutdown started are rejected. Listen returns once
+// shutdown completed. Returned error is the ctx error if the sessions
+// did not complete in time. Balancer can Listen again after the shutdown. Cancelling
+// the balancer context instead will cut all the sessions immediately
+func (lb *LoadBalancer) Shutdown(ctx context.Context) (DrainReport, error) {
+	lb.mutex.Lock()
+	if lb.listenCtx == nil {
+		lb.mutex.Unlock()
+		return DrainReport{}, fmt.Errorf("load balancer is not listening")
+	}
+	for port, pl := range lb.listeners {
+		pl.close()
+		delete(lb.listeners, port)
+	}
+	forwarders := make([]*Forwarder, 0, len(lb.forwarderMap))
+	for _, fwd := range lb.forwarderMap {
+		forwarders = append(forwarders, fwd)
+	}
+	stopListen := lb.listenCancel
+	lb.mutex.Unlock()
 
-			// Calculate Rate Quota or take a default of defaultRequestPerSecondRate rps
-			// TODO: Provide ability to hot reload rate quotas per pool
-			times, perTimeUnit := toSchedule.pool.RateQuota()
-			if times == 0 {
-				times = defaultRequestPerSecondRate
-			}
-			rateLimiter := NewTokenBucket(uint32(times), perTimeUnit)
-
-			// Maintain incoming connections
-			for {
-
-				conn, err := listen.Accept()
-				if err != nil {
-					if strings.Contains(err.Error(), "closed network") {
-						// Graceful
-						lb.logger.Debug().Msgf("listener closed, closed network for port: %d", toSchedule.port)
-						errChan <- nil
-					} else {
-						// Other kind of error
-						lb.logger.Err(err).Msgf("failed to accept connection, error")
-						errChan <- fmt.Errorf("failed to listen on port, error: %w", err)
-					}
-					lb.mutex.Lock()
-					delete(lb.forwarderMap, currentPool.Identity())
-					lb.mutex.Unlock()
-					return
-				}
+	// Sessions still being attached are rejected for every session drained to be reported
+	for _, fwd := range forwarders {
+		fwd.Close()
+	}
+	reports := make(chan DrainReport, len(forwarders))
+	for _, fwd := range forwarders {
+		go func(fwd *Forwarder) {
+			reports <- fwd.Drain(ctx)
+		}(fwd)
+	}
+	report := DrainReport{}
+	for range forwarders {
+		report = report.Add(<-reports)
+	}
+	lb.logger.Info().Msgf("load balancer shutdown, sessions drained: %d killed: %d", report.Drained, report.Killed)
 
-				// Check if IP address connecting is in our cache and if it violated anything
-				if entry, ok := lb.ipLRU.Get(conn.RemoteAddr().String()); ok {
-					if entry.Count > defaultIPLRUBlockThreshold {
-						// If the entry exists and has not expired, block the connection
-						if entry.ExpiresAt.After(time.Now()) {
-							lb.logger.Trace().Msgf("rate quota exceeded for pool: %s", toSchedule.pool.Identity())
-							// TODO Provide notification pipeline abstraction where certain events can be dumped for behavior adjustments
-							// example: notify.Submit(IpBlockedNotification{identity,quota,time})
-							conn.Close()
-							continue
-						} else {
-							// Invalidate lazily
-							lb.ipLRU.Invalidate(conn.RemoteAddr().String())
-						}
-					}
-				}
+	// Release the listen routine
+	stopListen()
+	if report.Killed > 0 {
+		return report, ctx.Err()
+	}
+	return report, nil
+}
 
-				lb.logger.Debug().Msgf("accepting request for port %d", toSchedule.port)
-
-				// Convert to TLS and proceed with the handshake
-				tlsConn := conn.(*tls.Conn)
-				err = tlsConn.Handshake()
-				if err != nil {
-					lb.logger.Err(err).Msg("cannot complete handshake")
-					err = tlsConn.Close()
-					if err != nil {
-						lb.logger.Err(err).Msg("cannot close connection after failed handshake")
-					}
-					// Add address to IP LRU list and increment count of engagements
-					lb.ipLRU.IncrementCount(tlsConn.RemoteAddr().String(), 5*time.Minute)
-					continue
-				}
+// Listen will try to launch balancer on all the required ports, strategy is all or nothing.
+// Pools sharing the same port are served by the single listener which selects pools
+// by the ClientHello server name and then dispatches sessions by the identity of the
+// peer certificate. Listen blocks until the balancer context ends or one of the
+// listeners fails, pools can be added and removed while balancer is listening
+func (lb *LoadBalancer) Listen() error {
 
-				// As pool using the mTLS for the identity verification (at this moment port->creds)
-				// it seems to be logical to apply the Rate quotas right after the verified credentials
-				if !rateLimiter.WithinRateLimit() {
-					lb.logger.Trace().Msgf("rate quota exceeded for pool: %s", toSchedule.pool.Identity())
-					// TODO Provide notification pipeline abstraction where certain events can be dumped for behavior adjustments
-					// example: notify.Submit(RateLimitNotification{identity,quota,time})
-					err = tlsConn.Close()
-					if err != nil {
-						lb.logger.Err(err).Msg("cannot close connection on rate quota limit")
-					}
-					continue
-				}
+	// Blocklist kept by the store is restored before accepting the connections
+	restoreCtx, restoreCancel := context.WithTimeout(lb.runCtx, defaultBlocklistStoreTimeout)
+	if err := lb.restoreBlocklist(restoreCtx); err != nil {
+		lb.logger.Err(err).Msg("cannot restore blocklist, starting with the empty one")
+	}
+	restoreCancel()
 
-				// Verify certificate CN and find or create corresponding backend to dispatch
-				certs := tlsConn.ConnectionState().PeerCertificates
-				if len(certs) == 0 {
-					lb.logger.Error().Msg("failed to extract certificate")
-					err = tlsConn.Close()
-					if err != nil {
-						lb.logger.Err(err).Msg("cannot close connection after certificate failure")
-					}
-					continue
-				}
+	lb.mutex.Lock()
+	if lb.listenCtx != nil {
+		lb.mutex.Unlock()
+		return fmt.Errorf("load balancer is already listening")
+	}
+	mapping, err := collectListenTargets(lb.poolMap)
+	if err != nil {
+		lb.mutex.Unlock()
+		return err
+	}
 
-				// TODO Complete common name verification with certificate chain if provided as chain
-				curCrt := certs[0]
-				identity := curCrt.Subject.CommonName
-
-				// Forward the connections
-				if identity == currentPool.Identity() {
-
-					if forwarder != nil {
-						go func() {
-							err := forwarder.Attach(ctx, tlsConn)
-							if err != nil {
-								if errors.Is(err, context.Canceled) {
-									lb.logger.Err(err).Msg("conn closing gracefully on context")
-									return
-								}
-								lb.logger.Err(err).Msg("cannot attach to backend")
-							}
-						}()
-					} else {
-						forwarder = NewForwarder(currentPool, lb.logger)
-						lb.mutex.Lock()
-						lb.forwarderMap[currentPool.Identity()] = forwarder
-						lb.mutex.Unlock()
-						go func() {
-							err := forwarder.Attach(ctx, tlsConn)
-							if err != nil {
-								if errors.Is(err, context.Canceled) {
-									lb.logger.Err(err).Msg("conn closing gracefully on context")
-									return
-								}
-								lb.logger.Err(err).Msgf("cannot attach to backend")
-							}
-						}()
-					}
-				} else {
-
-					// TODO Add here the rate limiting for incorrect matches, possibly placing them into the LRU cache with bad IP address match
-					lb.logger.Warn().Msgf("certificate failed identity matching %s", identity)
-					err = tlsConn.Close()
-					if err != nil {
-						lb.logger.Err(err).Msg("cannot close connection after identity mismatch")
-					}
+	// Build listeners list not to have thread failures at this stage
+	listeners := make(map[int]*portListener, len(mapping))
+	for port, pools := range mapping {
+		pl, err := newPortListener(lb, port, pools)
+		if err != nil {
+			lb.mutex.Unlock()
+			return err
+		}
+		listeners[port] = pl
+	}
 
+	// Bind all the ports and fail if any of them fail
+	for _, pl := range listeners {
+		if err = pl.open(); err != nil {
+			for _, opened := range listeners {
+				if opened.listener != nil {
+					opened.close()
 				}
 			}
-
-		}(derCtx, derCancel, errChan, params)
+			lb.mutex.Unlock()
+			return fmt.Errorf("failed to listen for one of the ports, all listeners will shutdown, error: %w", err)
+		}
 	}
-	// Wait here until all the listeners will spawn and monitor if any failed, and if failed — fail the whole task
-	wg.Wait()
-	err = <-errChan
+	metricsListener, err := lb.openMetrics()
 	if err != nil {
-		derCancel()
-		return fmt.Errorf("failed to listen for one of the ports, all listeners will shutdown, error: %w", err)
+		for _, pl := range listeners {
+			pl.close()
+		}
+		lb.mutex.Unlock()
+		return err
+	}
+	adminListener, err := lb.openAdmin()
+	if err != nil {
+		for _, pl := range listeners {
+			pl.close()
+		}
+		if metricsListener != nil {
+			metricsListener.Close()
+		}
+		lb.mutex.Unlock()
+		return err
 	}
-	return nil
-}
-
-// TokenBucket Not a thread safe rate limiting object, provides capability to
-// count the rate of calls for Allowed() method with decision
-// if call fits within certain limits or not
-type TokenBucket struct {
-	tokens   uint32
-	bucket   uint32
-	timeUnit time.Duration
-	updated  time.Time
-}
-
-// NewTokenBucket create new token bucket with required params to operate
-func NewTokenBucket(tokens uint32, timeUnit time.Duration) *TokenBucket {
-	return &TokenBucket{bucket: tokens, tokens: tokens, timeUnit: timeUnit, updated: time.Now()}
-}
 
-// WithinRateLimit get the bool decision if this call within rate limit or not
-func (t *TokenBucket) WithinRateLimit() bool {
-	curTime := time.Now()
-	passTime := curTime.Sub(t.updated)
-	t.updated = curTime
+	derCtx, derCancel := context.WithCancel(lb.runCtx)
+	defer derCancel()
+	lb.listenCtx = derCtx
+	lb.listenCancel = derCancel
+	lb.listenErr = make(chan error, 1)
+	lb.listeners = listeners
+	// Forwarders are published before any listener serves the sessions
+	for _, pl := range listeners {
+		for identity, binding := range pl.pools {
+			lb.forwarderMap[identity] = binding.forwarder
+		}
+	}
+	for _, pl := range listeners {
+		lb.startListener(pl)
+	}
+	if shared, ok := lb.blockStore.(SharedBlocklistStore); ok {
+		lb.serving.Add(1)
+		go func() {
+			defer lb.serving.Done()
+			lb.syncBlocklist(derCtx, shared)
+		}()
+	}
+	if metricsListener != nil {
+		lb.serveMetrics(derCtx, metricsListener)
+	}
+	if adminListener != nil {
+		lb.serveAdmin(derCtx, adminListener)
+	}
+	lb.mutex.Unlock()
 
-	tu := t.timeUnit.Seconds()
-	// Calculate as following:
-	// r.tokens/tu -> 10/time-unit -> 10/1 sec -> 10 in 1 second
-	// passed time -> 0.2sec * 10 in one sec = +2 units
-	t.bucket = t.bucket + uint32(passTime.Seconds()*(float64(t.tokens)/tu))
+	// Wait here until balancer ends and monitor if any listener failed, and if failed — fail the whole task
+	select {
+	case <-derCtx.Done():
+	case err = <-lb.listenErr:
+	}
 
-	if t.bucket > t.tokens {
-		t.bucket = t.tokens
+	lb.mutex.Lock()
+	for port, pl := range lb.listeners {
+		pl.close()
+		delete(lb.listeners, port)
+	}
+	for identity, fwd := range lb.forwarderMap {
+		fwd.Close()
+		delete(lb.forwarderMap, identity)
+	}
+	lb.listenCtx = nil
+	lb.listenCancel = nil
+	lb.mutex.Unlock()
+	derCancel()
+	lb.serving.Wait()
+
+	saveCtx, saveCancel := context.WithTimeout(context.Background(), defaultBlocklistStoreTimeout)
+	defer saveCancel()
+	if saveErr := lb.saveBlocklist(saveCtx); saveErr != nil {
+		lb.logger.Err(saveErr).Msg("cannot save blocklist")
 	}
 
-	if t.bucket < 1 {
-		return false
+	if err != nil {
+		return fmt.Errorf("failed to listen for one of the ports, all listeners will shutdown, error: %w", err)
 	}
-	t.bucket--
-	return true
+	return nil
 }
 
-// Collect all the targets in correlation to the ports they're running at
-func collectListenTargets(fromData map[string]ServicePool) (map[int]ServicePool, error) {
-	portMap := make(map[int]ServicePool)
+// Collect all the targets in correlation to the ports they're running at,
+// more than one pool can share the same port
+func collectListenTargets(fromData map[string]ServicePool) (map[int][]ServicePool, error) {
+	portMap := make(map[int][]ServicePool)
 	for _, pool := range fromData {
-		if _, found := portMap[pool.Port()]; !found {
-			portMap[pool.Port()] = pool
-			continue
+		if err := validateServicePool(pool); err != nil {
+			return nil, err
 		}
-		return nil, fmt.Errorf("more than one service pool per port")
+		portMap[pool.Port()] = append(portMap[pool.Port()], pool)
 	}
 	return portMap, nil
 }
 
+// validateServicePool checks the parameters required to serve the pool
+func validateServicePool(pool ServicePool) error {
+	if len(pool.Identity()) == 0 {
+		return fmt.Errorf("pool missing identity")
+	}
+	if pool.Port() < 0 || pool.Port() > 65535 {
+		return fmt.Errorf("invalid port %d for service pool %s", pool.Port(), pool.Identity())
+	}
+	for _, rte := range pool.Routes() {
+		if rte.ServiceWeight < 0 || rte.ServiceWeight > maxRouteWeight {
+			return fmt.Errorf("invalid weight %d for route %s of service pool %s", rte.ServiceWeight, rte.Path(), pool.Identity())
+		}
+		if rte.ServiceMaxConnections < 0 {
+			return fmt.Errorf("invalid max connections %d for route %s of service pool %s", rte.ServiceMaxConnections, rte.Path(), pool.Identity())
+		}
+	}
+	if pool.StrategyFactory() == nil {
+		if _, err := NewStrategy(pool.StrategyName()); err != nil {
+			return fmt.Errorf("invalid strategy for service pool %s, error: %w", pool.Identity(), err)
+		}
+	}
+	if err := validateHashKey(pool.HashKey()); err != nil {
+		return fmt.Errorf("invalid hash key for service pool %s, error: %w", pool.Identity(), err)
+	}
+	times, per := poolRateQuota(pool)
+	if err := validateRateLimit(pool.RateLimiterName(), times, per); err != nil {
+		return fmt.Errorf("invalid rate limiter for service pool %s, error: %w", pool.Identity(), err)
+	}
+	if err := pool.ClientRateLimit().validate(); err != nil {
+		return fmt.Errorf("invalid client rate limit for service pool %s, error: %w", pool.Identity(), err)
+	}
+	if err := pool.IPRateLimit().validate(); err != nil {
+		return fmt.Errorf("invalid ip rate limit for service pool %s, error: %w", pool.Identity(), err)
+	}
+	if err := pool.ConnectionLimit().validate(); err != nil {
+		return fmt.Errorf("invalid connection limit for service pool %s, error: %w", pool.Identity(), err)
+	}
+	if err := pool.Bandwidth().validate(); err != nil {
+		return fmt.Errorf("invalid bandwidth for service pool %s, error: %w", pool.Identity(), err)
+	}
+	if err := pool.BlockPolicy().validate(); err != nil {
+		return fmt.Errorf("invalid block policy for service pool %s, error: %w", pool.Identity(), err)
+	}
+	if _, err := newAccessList(pool.AllowCIDRs(), pool.DenyCIDRs()); err != nil {
+		return fmt.Errorf("invalid access lists for service pool %s, error: %w", pool.Identity(), err)
+	}
+	if err := pool.RetryPolicy().validate(); err != nil {
+		return fmt.Errorf("invalid retry policy for service pool %s, error: %w", pool.Identity(), err)
+	}
+	if err := pool.OutlierDetection().validate(); err != nil {
+		return fmt.Errorf("invalid outlier detection for service pool %s, error: %w", pool.Identity(), err)
+	}
+	return nil
+}
+
 func newZeroLogForName(name, id, level string) zerolog.Logger {
 	zLevel := zerolog.ErrorLevel
 	if len(level) > 0 {
@@ -0,0 +1,176 @@
+package xlb
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Largest chunk forwarded at once by the shaped session, keeps the waits of the
+// sessions sharing the bandwidth short and even
+const maxShapedChunk = 16 * 1024
+
+// Bandwidth limits the bytes per second forwarded by the sessions of the pool, ingress
+// is the traffic from the clients to the routes and egress from the routes to the clients.
+// Pool limits are shared by all the sessions of the pool and client limits by all the
+// sessions of the client, bursts up to the rate of one second are allowed
+type Bandwidth struct {
+	// Bytes per second from all the clients of the pool, 0 is unlimited
+	Ingress int
+	// Bytes per second to all the clients of the pool, 0 is unlimited
+	Egress int
+	// Bytes per second from every client of the pool, 0 is unlimited
+	ClientIngress int
+	// Bytes per second to every client of the pool, 0 is unlimited
+	ClientEgress int
+	// Client certificate property the client limits are keyed by, one of HashKey* constants (cert-serial default)
+	ClientKey string
+}
+
+func (b Bandwidth) clientKey() string {
+	if b.ClientKey == "" {
+		return HashKeyCertSerial
+	}
+	return b.ClientKey
+}
+
+func (b Bandwidth) validate() error {
+	if b.Ingress < 0 || b.Egress < 0 || b.ClientIngress < 0 || b.ClientEgress < 0 {
+		return errors.New("bandwidth settings cannot be negative")
+	}
+	return validateHashKey(b.ClientKey)
+}
+
+// clientBandwidth is the bandwidth shared by the sessions of the single client
+type clientBandwidth struct {
+	ingress *TokenBucket
+	egress  *TokenBucket
+	refs    int
+}
+
+// bandwidthLimiter shapes the sessions of the pool, limits are applied to the
+// sessions running at the moment of update
+type bandwidthLimiter struct {
+	mutex   sync.RWMutex
+	limit   Bandwidth
+	ingress *TokenBucket
+	egress  *TokenBucket
+	clients map[string]*clientBandwidth
+	clock   Clock
+}
+
+func newBandwidthLimiter(limit Bandwidth, clock Clock) *bandwidthLimiter {
+	if clock == nil {
+		clock = systemClock{}
+	}
+	b := &bandwidthLimiter{clients: map[string]*clientBandwidth{}, clock: clock}
+	b.update(limit)
+	return b
+}
+
+// updateBucket applies the rate to the bucket keeping the bytes already taken,
+// nil if the rate is unlimited
+func updateBucket(bucket *TokenBucket, rate int, clock Clock) *TokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if bucket == nil {
+		return newTokenBucket(rate, time.Second, clock)
+	}
+	bucket.SetRate(rate, time.Second)
+	return bucket
+}
+
+// update applies the limits to the pool and to every client
+func (b *bandwidthLimiter) update(limit Bandwidth) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.limit = limit
+	b.ingress = updateBucket(b.ingress, limit.Ingress, b.clock)
+	b.egress = updateBucket(b.egress, limit.Egress, b.clock)
+	for _, client := range b.clients {
+		client.ingress = updateBucket(client.ingress, limit.ClientIngress, b.clock)
+		client.egress = updateBucket(client.egress, limit.ClientEgress, b.clock)
+	}
+}
+
+// attach provides the bandwidth of the session client, detach must be called once the
+// session ended, clients are forgotten once all their sessions ended
+func (b *bandwidthLimiter) attach(in io.ReadWriteCloser) (*clientBandwidth, func()) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	key := sessionKey(in, b.limit.clientKey())
+	client, ok := b.clients[key]
+	if !ok {
+		client = &clientBandwidth{
+			ingress: updateBucket(nil, b.limit.ClientIngress, b.clock),
+			egress:  updateBucket(nil, b.limit.ClientEgress, b.clock),
+		}
+		b.clients[key] = client
+	}
+	client.refs++
+	return client, func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		client.refs--
+		if client.refs == 0 {
+			delete(b.clients, key)
+		}
+	}
+}
+
+// take counts the bytes forwarded in the direction, provides how long the session
+// should wait for the bytes to fit all the limits
+func (b *bandwidthLimiter) take(client *clientBandwidth, egress bool, n int) time.Duration {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	buckets := [2]*TokenBucket{b.ingress, client.ingress}
+	if egress {
+		buckets = [2]*TokenBucket{b.egress, client.egress}
+	}
+	var wait time.Duration
+	for _, bucket := range buckets {
+		if bucket != nil {
+			wait = max(wait, bucket.Take(n))
+		}
+	}
+	return wait
+}
+
+// shape wraps the reader of the session direction to fit the bandwidth
+func (b *bandwidthLimiter) shape(ctx context.Context, r io.ReadCloser, client *clientBandwidth, egress bool) io.ReadCloser {
+	return &shapedReader{ReadCloser: r, ctx: ctx, limiter: b, client: client, egress: egress}
+}
+
+// shapedReader delays the next read of the session direction until the bytes
+// read fit the bandwidth, waiting ends with the session
+type shapedReader struct {
+	io.ReadCloser
+	ctx     context.Context
+	limiter *bandwidthLimiter
+	client  *clientBandwidth
+	egress  bool
+}
+
+func (r *shapedReader) Read(p []byte) (int, error) {
+	if len(p) > maxShapedChunk {
+		p = p[:maxShapedChunk]
+	}
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		if wait := r.limiter.take(r.client, r.egress, n); wait > 0 {
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-r.ctx.Done():
+				// Other direction ended the session, bytes read are not forwarded
+				return 0, net.ErrClosed
+			}
+		}
+	}
+	return n, err
+}
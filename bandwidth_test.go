@@ -0,0 +1,77 @@
+package xlb
+
+import (
+	"github.com/rs/zerolog"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestBandwidthLimiter
+// Will test that bytes of the pool and of the client are shaped separately
+// for every direction and limits are applied to the running sessions
+func TestBandwidthLimiter(t *testing.T) {
+	clock := newFakeClock()
+	limiter := newBandwidthLimiter(Bandwidth{Ingress: 1000, ClientEgress: 100}, clock)
+	first, detachFirst := limiter.attach(nil)
+	second, detachSecond := limiter.attach(nil)
+	if first != second {
+		t.Fatalf("sessions of the same client should share the bandwidth")
+	}
+
+	if wait := limiter.take(first, false, 1000); wait != 0 {
+		t.Errorf("burst of the pool rate should not wait, got: %s", wait)
+	}
+	if wait := limiter.take(first, false, 500); wait != time.Millisecond*500 {
+		t.Errorf("bytes above the pool rate should wait, got: %s", wait)
+	}
+	if wait := limiter.take(first, true, 200); wait != time.Second {
+		t.Errorf("bytes above the client rate should wait, got: %s", wait)
+	}
+
+	// Raised rate is applied keeping the bytes taken
+	limiter.update(Bandwidth{Ingress: 2000})
+	if wait := limiter.take(first, false, 500); wait != time.Millisecond*500 {
+		t.Errorf("raised rate should shorten the wait, got: %s", wait)
+	}
+	if wait := limiter.take(first, true, 1000000); wait != 0 {
+		t.Errorf("removed client limit should not be applied, got: %s", wait)
+	}
+
+	detachFirst()
+	detachSecond()
+	if len(limiter.clients) != 0 {
+		t.Errorf("clients without sessions should be forgotten, got: %d", len(limiter.clients))
+	}
+}
+
+// TestForwarderBandwidth
+// Will test that forwarded stream is shaped by the egress rate of the pool
+func TestForwarderBandwidth(t *testing.T) {
+	address, stop := startEchoServer(t)
+	defer stop()
+
+	fwd := NewForwarder(ServicePool{
+		SvcIdentity:  "test",
+		SvcRoutes:    []ServicePoolRoute{{ServicePath: address, ServiceActive: true}},
+		SvcBandwidth: Bandwidth{Egress: 16 * 1024},
+	}, zerolog.Nop())
+
+	client, _ := attachSession(t, fwd)
+	defer client.Close()
+
+	payload := make([]byte, 48*1024)
+	go func(c net.Conn) {
+		_, _ = c.Write(payload)
+	}(client)
+
+	started := time.Now()
+	if _, err := io.ReadFull(client, payload); err != nil {
+		t.Fatalf("cannot read from session, error: %+v", err)
+	}
+	// Burst of one second is followed by two seconds of the rate
+	if elapsed := time.Since(started); elapsed < time.Millisecond*1500 {
+		t.Errorf("stream should be shaped by the egress rate, took: %s", elapsed)
+	}
+}
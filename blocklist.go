@@ -0,0 +1,262 @@
+package xlb
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Escalations of the block time for the failures above the threshold
+const (
+	EscalationConstant    = "constant"
+	EscalationLinear      = "linear"
+	EscalationExponential = "exponential"
+)
+
+const (
+	defaultBlockTime    = time.Minute * 5
+	defaultMaxBlockTime = time.Hour * 24
+)
+
+// errAddressBlocked aborts the handshake of the address blocked or denied for the requested server name
+var errAddressBlocked = errors.New("address blocked")
+
+// BlockPolicy configures blocking of the addresses failing the handshake or presenting the
+// certificate not matching any pool. Failures of the address are remembered for BlockTime
+// after the last one, address failing more than Threshold times is blocked for the block
+// time escalated by every failure above the threshold up to MaxBlockTime. Policy of the
+// pool inherits the settings it does not set from the global policy of the balancer
+type BlockPolicy struct {
+	// Failures of the address tolerated before it is blocked (10 default)
+	Threshold int
+	// How long failures are remembered and the address is blocked for the first failure above the threshold (5m default)
+	BlockTime time.Duration
+	// How block time grows with every failure above the threshold, one of Escalation* constants (linear default)
+	Escalation string
+	// Block time cap (24h default)
+	MaxBlockTime time.Duration
+	// Addresses of the same /24 IPv4 or /64 IPv6 prefix blocked to block the whole prefix,
+	// 2 or greater, 0 disables the aggregation
+	PrefixThreshold int
+}
+
+func (b BlockPolicy) threshold() int {
+	if b.Threshold <= 0 {
+		return defaultIPLRUBlockThreshold
+	}
+	return b.Threshold
+}
+
+func (b BlockPolicy) blockTime() time.Duration {
+	if b.BlockTime <= 0 {
+		return defaultBlockTime
+	}
+	return b.BlockTime
+}
+
+func (b BlockPolicy) maxBlockTime() time.Duration {
+	if b.MaxBlockTime <= 0 {
+		return max(defaultMaxBlockTime, b.blockTime())
+	}
+	return b.MaxBlockTime
+}
+
+// inherit fills the settings not set by the policy from the other policy
+func (b BlockPolicy) inherit(from BlockPolicy) BlockPolicy {
+	if b.Threshold == 0 {
+		b.Threshold = from.Threshold
+	}
+	if b.BlockTime == 0 {
+		b.BlockTime = from.BlockTime
+	}
+	if b.Escalation == "" {
+		b.Escalation = from.Escalation
+	}
+	if b.MaxBlockTime == 0 {
+		b.MaxBlockTime = from.MaxBlockTime
+	}
+	if b.PrefixThreshold == 0 {
+		b.PrefixThreshold = from.PrefixThreshold
+	}
+	return b
+}
+
+// prefixPolicy provides the policy counting the blocked addresses of the prefix as its failures
+func (b BlockPolicy) prefixPolicy() BlockPolicy {
+	b.Threshold = b.PrefixThreshold - 1
+	return b
+}
+
+// retention provides how long the address is remembered after its failures
+func (b BlockPolicy) retention(failures int) time.Duration {
+	above := failures - b.threshold()
+	if above <= 0 {
+		return b.blockTime()
+	}
+	var blockTime time.Duration
+	switch b.Escalation {
+	case EscalationConstant:
+		blockTime = b.blockTime()
+	case EscalationExponential:
+		blockTime = b.blockTime()
+		for i := 1; i < above && blockTime < b.maxBlockTime(); i++ {
+			blockTime *= 2
+		}
+	default:
+		blockTime = b.blockTime() * time.Duration(above)
+	}
+	if blockTime > b.maxBlockTime() {
+		return b.maxBlockTime()
+	}
+	return blockTime
+}
+
+// blocks reports if the address of the entry is blocked by the policy
+func (b BlockPolicy) blocks(entry CacheEntry, now time.Time) bool {
+	return b.blockedFor(entry, now) > 0
+}
+
+// blockedFor provides how long the address of the entry stays blocked by the policy, 0 if not blocked
+func (b BlockPolicy) blockedFor(entry CacheEntry, now time.Time) time.Duration {
+	if entry.Count <= b.threshold() {
+		return 0
+	}
+	return max(entry.UpdatedAt.Add(b.retention(entry.Count)).Sub(now), 0)
+}
+
+func (b BlockPolicy) validate() error {
+	if b.Threshold < 0 || b.BlockTime < 0 || b.MaxBlockTime < 0 {
+		return errors.New("block policy settings cannot be negative")
+	}
+	if b.PrefixThreshold < 0 || b.PrefixThreshold == 1 {
+		return errors.New("block policy prefix threshold should be 2 or greater")
+	}
+	switch b.Escalation {
+	case "", EscalationConstant, EscalationLinear, EscalationExponential:
+	default:
+		return fmt.Errorf("unknown block time escalation %s", b.Escalation)
+	}
+	if b.BlockTime > 0 && b.MaxBlockTime > 0 && b.MaxBlockTime < b.BlockTime {
+		return errors.New("max block time cannot be less than block time")
+	}
+	return nil
+}
+
+// addressHost provides the IP of the address without the port, addresses are blocked
+// by host as every connection of the host comes from the new ephemeral port
+func addressHost(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// addressPrefix provides the /24 prefix of IPv4 or the /64 prefix of IPv6 host
+func addressPrefix(host string) string {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}).String()
+}
+
+// cachedEntry provides the entry of the key, expired entries are invalidated lazily
+func (lb *LoadBalancer) cachedEntry(key string, now time.Time) (*CacheEntry, bool) {
+	entry, ok := lb.ipLRU.Get(key)
+	if !ok {
+		return nil, false
+	}
+	if !entry.ExpiresAt.After(now) {
+		lb.ipLRU.Invalidate(key)
+		return nil, false
+	}
+	return entry, true
+}
+
+// addressBlocked reports if the host or its prefix is blocked by every policy, policies
+// are the policies of the pools the connection of the host can reach
+func (lb *LoadBalancer) addressBlocked(host string, policies []BlockPolicy) bool {
+	return lb.addressBlockedFor(host, policies) > 0
+}
+
+// addressBlockedFor provides how long the host stays blocked by every policy, 0 if
+// the host is not blocked by any of them
+func (lb *LoadBalancer) addressBlockedFor(host string, policies []BlockPolicy) time.Duration {
+	if len(policies) == 0 {
+		return 0
+	}
+	now := time.Now()
+	entry, hostFailed := lb.cachedEntry(host, now)
+	prefix, prefixFailed := lb.cachedEntry(addressPrefix(host), now)
+	if !hostFailed && !prefixFailed {
+		return 0
+	}
+	var blockedFor time.Duration
+	for i, policy := range policies {
+		var policyBlock time.Duration
+		if hostFailed {
+			policyBlock = policy.blockedFor(*entry, now)
+		}
+		if prefixFailed && policy.PrefixThreshold > 0 {
+			policyBlock = max(policyBlock, policy.prefixPolicy().blockedFor(*prefix, now))
+		}
+		if policyBlock == 0 {
+			return 0
+		}
+		if i == 0 || policyBlock < blockedFor {
+			blockedFor = policyBlock
+		}
+	}
+	return blockedFor
+}
+
+// addressFailed counts the failure of the host, provides the block time if the
+// failure got the host blocked by every policy, 0 otherwise
+func (lb *LoadBalancer) addressFailed(host string, policies []BlockPolicy) time.Duration {
+	if lb.addressBlocked(host, policies) {
+		lb.countFailure(host, policies)
+		return 0
+	}
+	lb.countFailure(host, policies)
+	return lb.addressBlockedFor(host, policies)
+}
+
+// countFailure counts the failure of the host, host is remembered for the longest
+// retention of the policies. Host getting blocked by the policy aggregating the
+// prefixes is counted as the failure of its prefix
+func (lb *LoadBalancer) countFailure(host string, policies []BlockPolicy) {
+	entry := lb.ipLRU.IncrementCountFor(host, func(count int) time.Duration {
+		retention := lb.blockPolicy.retention(count)
+		for _, policy := range policies {
+			retention = max(retention, policy.retention(count))
+		}
+		return retention
+	})
+	lb.publishBlocklist(entry)
+
+	aggregating := make([]BlockPolicy, 0, len(policies))
+	for _, policy := range policies {
+		if policy.PrefixThreshold > 0 && entry.Count == policy.threshold()+1 {
+			aggregating = append(aggregating, policy.prefixPolicy())
+		}
+	}
+	prefix := addressPrefix(host)
+	if len(aggregating) == 0 || prefix == "" {
+		return
+	}
+	lb.publishBlocklist(lb.ipLRU.IncrementCountFor(prefix, func(count int) time.Duration {
+		var retention time.Duration
+		for _, policy := range aggregating {
+			retention = max(retention, policy.retention(count))
+		}
+		return retention
+	}))
+}
@@ -0,0 +1,109 @@
+package xlb
+
+import (
+	"github.com/rs/zerolog"
+	"testing"
+	"time"
+)
+
+// TestBlockPolicyEscalation
+// Will test how block time grows with the failures above the threshold
+func TestBlockPolicyEscalation(t *testing.T) {
+	cases := []struct {
+		policy   BlockPolicy
+		failures int
+		expected time.Duration
+	}{
+		{BlockPolicy{Threshold: 2, BlockTime: time.Minute}, 1, time.Minute},
+		{BlockPolicy{Threshold: 2, BlockTime: time.Minute}, 5, time.Minute * 3},
+		{BlockPolicy{Threshold: 2, BlockTime: time.Minute, Escalation: EscalationConstant}, 5, time.Minute},
+		{BlockPolicy{Threshold: 2, BlockTime: time.Minute, Escalation: EscalationExponential}, 5, time.Minute * 4},
+		{BlockPolicy{Threshold: 2, BlockTime: time.Minute, Escalation: EscalationExponential, MaxBlockTime: time.Hour}, 100, time.Hour},
+		{BlockPolicy{}, 11, time.Minute * 5},
+	}
+	for _, c := range cases {
+		if got := c.policy.retention(c.failures); got != c.expected {
+			t.Errorf("policy %+v should block for %s after %d failures, got: %s", c.policy, c.expected, c.failures, got)
+		}
+	}
+
+	inherited := BlockPolicy{Threshold: 3}.inherit(BlockPolicy{Threshold: 5, Escalation: EscalationExponential})
+	if inherited.Threshold != 3 || inherited.Escalation != EscalationExponential {
+		t.Errorf("pool policy should inherit only settings it does not set, got: %+v", inherited)
+	}
+	if err := (BlockPolicy{BlockTime: time.Hour, MaxBlockTime: time.Minute}).validate(); err == nil {
+		t.Errorf("max block time less than block time should not be valid")
+	}
+}
+
+// TestLoadBalancerAddressBlocked
+// Will test that address is blocked once it failed the policies of all the pools it can reach
+func TestLoadBalancerAddressBlocked(t *testing.T) {
+	lb := &LoadBalancer{ipLRU: NewLRUCache(10)}
+	strict := BlockPolicy{Threshold: 1}
+	lenient := BlockPolicy{Threshold: 3}
+	both := []BlockPolicy{strict, lenient}
+
+	for i := 0; i < 2; i++ {
+		lb.addressFailed("10.0.0.1", both)
+	}
+	if !lb.addressBlocked("10.0.0.1", []BlockPolicy{strict}) {
+		t.Errorf("address above threshold of the strict pool should be blocked for it")
+	}
+	if lb.addressBlocked("10.0.0.1", both) {
+		t.Errorf("address should not be blocked while lenient pool tolerates it")
+	}
+	for i := 0; i < 2; i++ {
+		lb.addressFailed("10.0.0.1", both)
+	}
+	if !lb.addressBlocked("10.0.0.1", both) {
+		t.Errorf("address above thresholds of all the pools should be blocked")
+	}
+	if lb.addressBlocked("10.0.0.2", both) {
+		t.Errorf("address without failures should not be blocked")
+	}
+}
+
+// TestLoadBalancerPrefixBlocked
+// Will test that prefix is blocked once enough of its hosts are blocked
+func TestLoadBalancerPrefixBlocked(t *testing.T) {
+	lb := &LoadBalancer{ipLRU: NewLRUCache(10)}
+	policies := []BlockPolicy{{Threshold: 1, PrefixThreshold: 2}}
+
+	for _, host := range []string{"10.0.0.1", "10.0.0.2"} {
+		lb.addressFailed(host, policies)
+		lb.addressFailed(host, policies)
+	}
+	if !lb.addressBlocked("10.0.0.3", policies) {
+		t.Errorf("host of the blocked prefix should be blocked")
+	}
+	if lb.addressBlocked("10.0.1.1", policies) {
+		t.Errorf("host of the other prefix should not be blocked")
+	}
+	if addressPrefix("2001:db8::1") != "2001:db8::/64" {
+		t.Errorf("IPv6 hosts should be aggregated by /64, got: %s", addressPrefix("2001:db8::1"))
+	}
+}
+
+// TestPortListenerBlockedEvent
+// Will test that blocked address is reported once with the block time when it gets blocked
+func TestPortListenerBlockedEvent(t *testing.T) {
+	lb := &LoadBalancer{ipLRU: NewLRUCache(10), events: NewEventBus(), logger: zerolog.Nop()}
+	pl := &portListener{lb: lb, port: 9000}
+	blocked := lb.events.Subscribe(10, EventIPBlocked)
+	policies := []BlockPolicy{{Threshold: 2, BlockTime: time.Minute}}
+
+	for i := 0; i < 5; i++ {
+		pl.addressFailed("10.0.0.1", policies, "handshake failed")
+	}
+	if len(blocked.Events()) != 1 {
+		t.Fatalf("block should be reported once, reported: %d", len(blocked.Events()))
+	}
+	event := <-blocked.Events()
+	if event.Address != "10.0.0.1" || event.Port != 9000 || event.Duration <= time.Second*59 || event.Duration > time.Minute {
+		t.Errorf("unexpected event %+v", event)
+	}
+	if blockTime := lb.addressBlockedFor("10.0.0.1", policies); blockTime <= time.Minute {
+		t.Errorf("failures of the blocked address should escalate the block, got: %s", blockTime)
+	}
+}
@@ -0,0 +1,170 @@
+package xlb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	defaultBlocklistSyncInterval = time.Second * 10
+	defaultBlocklistStoreTimeout = time.Second * 10
+	blocklistPublishQueue        = 1024
+	blocklistSnapshotVersion     = 1
+)
+
+// BlocklistStore keeps the blocklist beyond the balancer process, entries are loaded
+// when balancer starts listening and saved once it stopped
+type BlocklistStore interface {
+	// Load provides the entries kept by the store
+	Load(ctx context.Context) ([]CacheEntry, error)
+	// Save stores the entries of the balancer
+	Save(ctx context.Context, entries []CacheEntry) error
+}
+
+// SharedBlocklistStore is the store shared by several balancers, every failure counted
+// by the balancer is published to the store and entries published by the other
+// balancers are loaded periodically while balancer is listening
+type SharedBlocklistStore interface {
+	BlocklistStore
+	// Publish stores the entry updated by the balancer
+	Publish(ctx context.Context, entry CacheEntry) error
+}
+
+// FileBlocklistStore keeps the snapshot of the blocklist in the JSON file
+type FileBlocklistStore struct {
+	path string
+}
+
+// NewFileBlocklistStore creates the store of the snapshot at the path, missing
+// file is the empty blocklist
+func NewFileBlocklistStore(path string) *FileBlocklistStore {
+	return &FileBlocklistStore{path: path}
+}
+
+type blocklistSnapshot struct {
+	Version int          `json:"version"`
+	SavedAt time.Time    `json:"saved_at"`
+	Entries []CacheEntry `json:"entries"`
+}
+
+func (f *FileBlocklistStore) Load(_ context.Context) ([]CacheEntry, error) {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cannot read blocklist snapshot, error: %w", err)
+	}
+	snapshot := blocklistSnapshot{}
+	if err = json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("cannot parse blocklist snapshot, error: %w", err)
+	}
+	if snapshot.Version != blocklistSnapshotVersion {
+		return nil, fmt.Errorf("unsupported blocklist snapshot version %d", snapshot.Version)
+	}
+	return snapshot.Entries, nil
+}
+
+// Save replaces the snapshot, the file is replaced at once for the snapshot
+// not to be torn if balancer is killed while saving
+func (f *FileBlocklistStore) Save(_ context.Context, entries []CacheEntry) error {
+	data, err := json.Marshal(blocklistSnapshot{
+		Version: blocklistSnapshotVersion,
+		SavedAt: time.Now(),
+		Entries: entries,
+	})
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return fmt.Errorf("cannot write blocklist snapshot, error: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("cannot write blocklist snapshot, error: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("cannot write blocklist snapshot, error: %w", err)
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// restoreBlocklist merges the entries of the store which are not expired yet,
+// entries are merged from the least recently used to keep the order
+func (lb *LoadBalancer) restoreBlocklist(ctx context.Context) error {
+	if lb.blockStore == nil {
+		return nil
+	}
+	entries, err := lb.blockStore.Load(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].ExpiresAt.After(now) {
+			lb.ipLRU.Merge(entries[i])
+		}
+	}
+	return nil
+}
+
+// saveBlocklist stores the entries which are not expired yet
+func (lb *LoadBalancer) saveBlocklist(ctx context.Context) error {
+	if lb.blockStore == nil {
+		return nil
+	}
+	now := time.Now()
+	entries := lb.ipLRU.Entries()
+	alive := entries[:0]
+	for _, entry := range entries {
+		if entry.ExpiresAt.After(now) {
+			alive = append(alive, entry)
+		}
+	}
+	return lb.blockStore.Save(ctx, alive)
+}
+
+// publishBlocklist queues the entry for the shared store, entries are dropped
+// if the store cannot keep up
+func (lb *LoadBalancer) publishBlocklist(entry CacheEntry) {
+	if lb.blockPublish == nil {
+		return
+	}
+	select {
+	case lb.blockPublish <- entry:
+	default:
+		lb.logger.Warn().Msgf("blocklist entry of %s is not published, queue is full", entry.IP)
+	}
+}
+
+// syncBlocklist publishes the entries updated by the balancer to the shared store and
+// loads the entries of the other balancers until ctx ends
+func (lb *LoadBalancer) syncBlocklist(ctx context.Context, shared SharedBlocklistStore) {
+	ticker := time.NewTicker(lb.blockSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case entry := <-lb.blockPublish:
+			opCtx, cancel := context.WithTimeout(ctx, defaultBlocklistStoreTimeout)
+			if err := shared.Publish(opCtx, entry); err != nil && ctx.Err() == nil {
+				lb.logger.Err(err).Msgf("cannot publish blocklist entry of %s", entry.IP)
+			}
+			cancel()
+		case <-ticker.C:
+			opCtx, cancel := context.WithTimeout(ctx, defaultBlocklistStoreTimeout)
+			if err := lb.restoreBlocklist(opCtx); err != nil && ctx.Err() == nil {
+				lb.logger.Err(err).Msg("cannot load shared blocklist")
+			}
+			cancel()
+		}
+	}
+}
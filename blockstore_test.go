@@ -0,0 +1,236 @@
+package xlb
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// respSession is the state of the transaction of the connection to the RESP server
+type respSession struct {
+	watched map[string]int
+	queued  [][]string
+	multi   bool
+}
+
+// startRESPServer creates the stand-in of the Redis server keeping the keys in memory,
+// supports the commands used by RedisBlocklistStore
+func startRESPServer(t *testing.T) (string, func()) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot start resp server, error: %+v", err)
+	}
+	var mutex sync.Mutex
+	values := map[string]string{}
+	expires := map[string]time.Time{}
+	versions := map[string]int{}
+	get := func(key string) (string, bool) {
+		if exp, ok := expires[key]; ok && !exp.After(time.Now()) {
+			delete(values, key)
+			delete(expires, key)
+			versions[key]++
+		}
+		value, ok := values[key]
+		return value, ok
+	}
+	bulk := func(s string) string { return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n" }
+
+	var run func(command []string, session *respSession) string
+	run = func(command []string, session *respSession) string {
+		switch strings.ToUpper(command[0]) {
+		case "PING":
+			return "+PONG\r\n"
+		case "SET":
+			values[command[1]] = command[2]
+			versions[command[1]]++
+			delete(expires, command[1])
+			if len(command) == 5 && strings.ToUpper(command[3]) == "PX" {
+				ms, _ := strconv.Atoi(command[4])
+				expires[command[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+			}
+			return "+OK\r\n"
+		case "MGET":
+			reply := "*" + strconv.Itoa(len(command)-1) + "\r\n"
+			for _, key := range command[1:] {
+				if value, ok := get(key); ok {
+					reply += bulk(value)
+				} else {
+					reply += "$-1\r\n"
+				}
+			}
+			return reply
+		case "SCAN":
+			prefix := strings.TrimSuffix(command[3], "*")
+			keys := make([]string, 0)
+			for key := range values {
+				if _, ok := get(key); ok && strings.HasPrefix(key, prefix) {
+					keys = append(keys, bulk(key))
+				}
+			}
+			return "*2\r\n" + bulk("0") + "*" + strconv.Itoa(len(keys)) + "\r\n" + strings.Join(keys, "")
+		case "WATCH":
+			for _, key := range command[1:] {
+				get(key)
+				session.watched[key] = versions[key]
+			}
+			return "+OK\r\n"
+		case "MULTI":
+			session.multi = true
+			return "+OK\r\n"
+		case "EXEC":
+			queued, watched := session.queued, session.watched
+			session.multi, session.queued, session.watched = false, nil, map[string]int{}
+			for key, version := range watched {
+				if get(key); versions[key] != version {
+					return "*-1\r\n"
+				}
+			}
+			reply := "*" + strconv.Itoa(len(queued)) + "\r\n"
+			for _, queuedCommand := range queued {
+				reply += run(queuedCommand, session)
+			}
+			return reply
+		}
+		return "-ERR unknown command\r\n"
+	}
+	handle := func(command []string, session *respSession) string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if session.multi && strings.ToUpper(command[0]) != "EXEC" {
+			session.queued = append(session.queued, command)
+			return "+QUEUED\r\n"
+		}
+		return run(command, session)
+	}
+
+	go func() {
+		for {
+			conn, err := listen.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				session := &respSession{watched: map[string]int{}}
+				r := bufio.NewReader(c)
+				for {
+					reply, err := decodeRESP(r)
+					if err != nil {
+						return
+					}
+					items, _ := reply.([]interface{})
+					command := make([]string, len(items))
+					for i, item := range items {
+						command[i], _ = item.(string)
+					}
+					if _, err = c.Write([]byte(handle(command, session))); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return listen.Addr().String(), func() { _ = listen.Close() }
+}
+
+// TestFileBlocklistStore
+// Will test that blocklist entries which are not expired survive the restart
+func TestFileBlocklistStore(t *testing.T) {
+	store := NewFileBlocklistStore(filepath.Join(t.TempDir(), "blocklist.json"))
+	policies := []BlockPolicy{{Threshold: 1}}
+
+	lb := &LoadBalancer{ipLRU: NewLRUCache(10), blockStore: store}
+	if err := lb.restoreBlocklist(context.Background()); err != nil {
+		t.Fatalf("missing snapshot should be the empty blocklist, error: %+v", err)
+	}
+	lb.addressFailed("10.0.0.1", policies)
+	lb.addressFailed("10.0.0.1", policies)
+	lb.ipLRU.Put("10.0.0.2", time.Now().Add(-time.Minute), 5)
+	if err := lb.saveBlocklist(context.Background()); err != nil {
+		t.Fatalf("cannot save blocklist, error: %+v", err)
+	}
+
+	restarted := &LoadBalancer{ipLRU: NewLRUCache(10), blockStore: store}
+	if err := restarted.restoreBlocklist(context.Background()); err != nil {
+		t.Fatalf("cannot restore blocklist, error: %+v", err)
+	}
+	if !restarted.addressBlocked("10.0.0.1", policies) {
+		t.Errorf("blocked address should be blocked after restart")
+	}
+	if _, ok := restarted.ipLRU.Get("10.0.0.2"); ok {
+		t.Errorf("expired entry should not be restored")
+	}
+}
+
+// TestRedisBlocklistStore
+// Will test that failures counted by one balancer block the address for the other one
+func TestRedisBlocklistStore(t *testing.T) {
+	address, stop := startRESPServer(t)
+	defer stop()
+	policies := []BlockPolicy{{Threshold: 1}}
+
+	newBalancer := func() *LoadBalancer {
+		return &LoadBalancer{
+			ipLRU:        NewLRUCache(10),
+			blockStore:   NewRedisBlocklistStore(address, "", ""),
+			blockPublish: make(chan CacheEntry, blocklistPublishQueue),
+		}
+	}
+	first, second := newBalancer(), newBalancer()
+	first.blockSyncInterval = time.Hour
+	second.blockSyncInterval = time.Millisecond * 50
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go first.syncBlocklist(ctx, first.blockStore.(SharedBlocklistStore))
+	go second.syncBlocklist(ctx, second.blockStore.(SharedBlocklistStore))
+
+	first.addressFailed("10.0.0.1", policies)
+	first.addressFailed("10.0.0.1", policies)
+
+	deadline := time.Now().Add(time.Second * 2)
+	for !second.addressBlocked("10.0.0.1", policies) {
+		if time.Now().After(deadline) {
+			t.Fatalf("address blocked by the first balancer should be blocked by the second one")
+		}
+		<-time.After(time.Millisecond * 20)
+	}
+	if second.addressBlocked("10.0.0.2", policies) {
+		t.Errorf("address without failures should not be blocked")
+	}
+}
+
+// TestRedisBlocklistStoreMerge
+// Will test that the entry written by the balancer does not undo the block
+// escalated by the other balancer
+func TestRedisBlocklistStoreMerge(t *testing.T) {
+	address, stop := startRESPServer(t)
+	defer stop()
+	store := NewRedisBlocklistStore(address, "", "")
+	ctx := context.Background()
+
+	now := time.Now().Truncate(time.Millisecond)
+	escalated := CacheEntry{IP: "10.0.0.1", Count: 5, ExpiresAt: now.Add(time.Hour), UpdatedAt: now}
+	if err := store.Publish(ctx, escalated); err != nil {
+		t.Fatalf("cannot publish entry, error: %+v", err)
+	}
+	stale := CacheEntry{IP: "10.0.0.1", Count: 2, ExpiresAt: now.Add(time.Minute), UpdatedAt: now.Add(time.Second)}
+	if err := store.Publish(ctx, stale); err != nil {
+		t.Fatalf("cannot publish entry, error: %+v", err)
+	}
+
+	entries, err := store.Load(ctx)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("single entry should be loaded, got: %+v error: %v", entries, err)
+	}
+	entry := entries[0]
+	if entry.Count != 5 || !entry.ExpiresAt.Equal(escalated.ExpiresAt) || !entry.UpdatedAt.Equal(stale.UpdatedAt) {
+		t.Errorf("stored entry should keep the greater count and the latest times, got: %+v", entry)
+	}
+}
@@ -0,0 +1,234 @@
+// Command xlb runs the load balancer configured by the YAML or JSON config file
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/rs/zerolog"
+	"github.com/xdire/xlb"
+	"io"
+	"os"
+	"os/signal"
+	"runtime"
+	"runtime/debug"
+	"syscall"
+	"time"
+)
+
+// Exit codes of the command
+const (
+	exitOK = iota
+	// Balancer failed while running, like the port which cannot be bound
+	exitFailure
+	// Command or flags are not valid
+	exitUsage
+	// Config cannot be loaded or is not valid
+	exitConfig
+)
+
+const defaultConfigPath = "xlb.yaml"
+
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+	command := "run"
+	if len(args) > 0 && len(args[0]) > 0 && args[0][0] != '-' {
+		command, args = args[0], args[1:]
+	}
+	switch command {
+	case "run":
+		return runBalancer(args, stderr)
+	case "validate":
+		return validateConfig(args, stdout, stderr)
+	case "version":
+		fmt.Fprintln(stdout, versionString())
+		return exitOK
+	case "help":
+		usage(stdout)
+		return exitOK
+	}
+	fmt.Fprintf(stderr, "unknown command %q\n", command)
+	usage(stderr)
+	return exitUsage
+}
+
+func usage(w io.Writer) {
+	fmt.Fprint(w, `Usage: xlb [command] [flags]
+
+Commands:
+  run       run the balancer until SIGTERM, SIGHUP reloads the config (default)
+  validate  check the config and exit
+  version   print the version
+
+Run "xlb <command> -h" for the flags of the command.
+`)
+}
+
+func versionString() string {
+	revision := "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				revision = setting.Value
+			}
+		}
+	}
+	return fmt.Sprintf("xlb %s (revision %s, %s)", version, revision, runtime.Version())
+}
+
+func configFlag(flags *flag.FlagSet) *string {
+	path := os.Getenv("XLB_CONFIG")
+	if path == "" {
+		path = defaultConfigPath
+	}
+	return flags.String("config", path, "Path of the YAML or JSON config file, XLB_CONFIG if set")
+}
+
+// loadConfig reads and validates the config
+func loadConfig(path string) (*xlb.Config, error) {
+	cfg, err := xlb.LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s, error: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func validateConfig(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	path := configFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	cfg, err := loadConfig(*path)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitConfig
+	}
+	fmt.Fprintf(stdout, "config %s is valid, pools: %d\n", *path, len(cfg.Pools))
+	return exitOK
+}
+
+func runBalancer(args []string, stderr io.Writer) int {
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	path := configFlag(flags)
+	logLevel := flags.String("log-level", "", "Log level as trace,debug,info,warn,error, overrides the config")
+	logFormat := flags.String("log-format", "json", "Log format as json or console")
+	drainTimeout := flags.Duration("drain-timeout", time.Second*30, "How long sessions are given to complete on SIGTERM")
+	watchInterval := flags.Duration("watch-interval", time.Second*5, "How often the config file is checked for changes")
+	logEvents := flags.Bool("log-events", true, "Log security and routing events")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if *logFormat != "json" && *logFormat != "console" {
+		fmt.Fprintf(stderr, "unknown log format %q\n", *logFormat)
+		return exitUsage
+	}
+
+	cfg, err := loadConfig(*path)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitConfig
+	}
+	if *logLevel != "" {
+		cfg.LogLevel = *logLevel
+	}
+	logger, err := newLogger(stderr, *logFormat, cfg.LogLevel)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+	pools, err := cfg.ServicePools()
+	if err != nil {
+		logger.Err(err).Msg("cannot load pools")
+		return exitConfig
+	}
+	opt, err := cfg.Options()
+	if err != nil {
+		logger.Err(err).Msg("cannot load options")
+		return exitConfig
+	}
+	opt.Logger = &logger
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	balancer, err := xlb.NewLoadBalancer(ctx, pools, opt)
+	if err != nil {
+		logger.Err(err).Msg("cannot create load balancer")
+		return exitConfig
+	}
+	if *logEvents {
+		balancer.AttachSink(xlb.NewLogSink(logger), 0)
+	}
+
+	// Watcher handles SIGHUP as well as the changes of the config file
+	go xlb.NewConfigWatcher(balancer, *path, *watchInterval).Run(ctx)
+
+	terminate := make(chan os.Signal, 2)
+	signal.Notify(terminate, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(terminate)
+
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- balancer.Listen()
+	}()
+	logger.Info().Msgf("%s started with config %s", versionString(), *path)
+
+	select {
+	case err = <-listenErr:
+		if err != nil {
+			logger.Err(err).Msg("load balancer failed")
+			return exitFailure
+		}
+		return exitOK
+	case sig := <-terminate:
+		logger.Info().Msgf("%s received, draining sessions for %s", sig, *drainTimeout)
+	}
+
+	// Second signal cuts the drain short
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), *drainTimeout)
+	defer drainCancel()
+	go func() {
+		select {
+		case sig := <-terminate:
+			logger.Warn().Msgf("%s received, closing all the sessions", sig)
+			drainCancel()
+		case <-drainCtx.Done():
+		}
+	}()
+	if _, err = balancer.Shutdown(drainCtx); err != nil {
+		logger.Warn().Err(err).Msg("sessions were not drained")
+	}
+	// Releases the balancer which was not listening yet
+	cancel()
+	if err = <-listenErr; err != nil {
+		logger.Err(err).Msg("load balancer failed while shutting down")
+		return exitFailure
+	}
+	return exitOK
+}
+
+func newLogger(w io.Writer, format, level string) (zerolog.Logger, error) {
+	lvl := zerolog.InfoLevel
+	if level != "" {
+		parsed, err := zerolog.ParseLevel(level)
+		if err != nil {
+			return zerolog.Logger{}, fmt.Errorf("unknown log level %q", level)
+		}
+		lvl = parsed
+	}
+	if format == "console" {
+		w = zerolog.ConsoleWriter{Out: w, TimeFormat: time.RFC3339}
+	}
+	return zerolog.New(w).Level(lvl).With().Timestamp().Str("service", "xlb").Logger(), nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"github.com/xdire/xlb/tlsutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func writeTestConfig(t *testing.T, content string) string {
+	dir := t.TempDir()
+	for _, file := range []string{"server.crt", "server.key", "ca.crt"} {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = os.WriteFile(filepath.Join(dir, file), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(dir, "xlb.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const testConfig = `
+log_level: warn
+metrics_address: localhost:9180
+pools:
+  - identity: test
+    port: 9181
+    certificate_file: server.crt
+    private_key_file: server.key
+    ca_certificate_file: ca.crt
+    routes:
+      - address: localhost:9182
+`
+
+// TestCommands
+// Will test that the commands and the config problems return their exit codes
+func TestCommands(t *testing.T) {
+	err := tlsutil.CreateLocalTLSData("test")
+	defer func() {
+		_, err := tlsutil.WipeLocalTLSData("./")
+		if err != nil {
+			t.Error("cannot clean pre-arranged test files")
+		}
+	}()
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := writeTestConfig(t, testConfig)
+	invalid := writeTestConfig(t, "pools: []\n")
+
+	tests := []struct {
+		name   string
+		args   []string
+		code   int
+		stdout string
+	}{
+		{name: "version", args: []string{"version"}, code: exitOK, stdout: "xlb " + version},
+		{name: "valid config", args: []string{"validate", "-config", valid}, code: exitOK, stdout: "is valid, pools: 1"},
+		{name: "invalid config", args: []string{"validate", "-config", invalid}, code: exitConfig},
+		{name: "missing config", args: []string{"validate", "-config", filepath.Join(t.TempDir(), "xlb.yaml")}, code: exitConfig},
+		{name: "unknown command", args: []string{"start"}, code: exitUsage},
+		{name: "unknown flag", args: []string{"validate", "-port", "1"}, code: exitUsage},
+		{name: "unknown log format", args: []string{"-config", valid, "-log-format", "xml"}, code: exitUsage},
+		{name: "run invalid config", args: []string{"run", "-config", invalid}, code: exitConfig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+			if code := run(tt.args, stdout, stderr); code != tt.code {
+				t.Fatalf("expected exit code %d, got %d, stderr: %s", tt.code, code, stderr)
+			}
+			if !strings.Contains(stdout.String(), tt.stdout) {
+				t.Errorf("expected output to contain %q, got %q", tt.stdout, stdout)
+			}
+		})
+	}
+}
+
+// TestRunTerminate
+// Will test that the balancer serves the config and exits cleanly on SIGTERM
+func TestRunTerminate(t *testing.T) {
+	err := tlsutil.CreateLocalTLSData("test")
+	defer func() {
+		_, err := tlsutil.WipeLocalTLSData("./")
+		if err != nil {
+			t.Error("cannot clean pre-arranged test files")
+		}
+	}()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeTestConfig(t, testConfig)
+
+	exit := make(chan int, 1)
+	go func() {
+		exit <- run([]string{"-config", path, "-drain-timeout", "1s"}, &bytes.Buffer{}, &bytes.Buffer{})
+	}()
+
+	// Metrics listener is up once the balancer listens and the signals are handled
+	started := false
+	for i := 0; i < 50 && !started; i++ {
+		res, err := http.Get("http://localhost:9180/metrics")
+		if err == nil {
+			res.Body.Close()
+			started = res.StatusCode == http.StatusOK
+		}
+		select {
+		case code := <-exit:
+			t.Fatalf("balancer exited with code %d before serving", code)
+		case <-time.After(time.Millisecond * 100):
+		}
+	}
+	if !started {
+		t.Fatal("balancer did not start serving metrics")
+	}
+
+	if err = syscall.Kill(syscall.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case code := <-exit:
+		if code != exitOK {
+			t.Errorf("expected exit code %d, got %d", exitOK, code)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("balancer did not stop on SIGTERM")
+	}
+}
@@ -0,0 +1,387 @@
+package xlb
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConfigSchema is the JSON Schema of the config file
+//
+//go:embed config.schema.json
+var ConfigSchema []byte
+
+// Config is the declarative configuration of the balancer read from the YAML or JSON file,
+// unknown settings are rejected. Files referenced by the config are resolved relative to
+// the directory of the config file
+type Config struct {
+	// Log level as trace,debug,info,error
+	LogLevel string `json:"log_level,omitempty"`
+	// Capacity of the blocklist
+	IPBlocklistCapacity int `json:"ip_blocklist_capacity,omitempty"`
+	// Blocking of the addresses for all the pools
+	BlockPolicy *BlockPolicySpec `json:"block_policy,omitempty"`
+	// Store keeping the blocklist
+	Blocklist *BlocklistConfig `json:"blocklist,omitempty"`
+	// Address of the metrics listener, metrics are not served if empty
+	MetricsAddress string `json:"metrics_address,omitempty"`
+	// Admin server, not served if missing
+	Admin *AdminConfig `json:"admin,omitempty"`
+	// Pools of the balancer
+	Pools []PoolConfig `json:"pools"`
+
+	// Directory the files are resolved relative to
+	dir string
+}
+
+// PoolConfig is the PoolSpec which certificates can be read from the files,
+// files take precedence over the PEM strings of the spec
+type PoolConfig struct {
+	PoolSpec
+	CertificateFile   string `json:"certificate_file,omitempty"`
+	PrivateKeyFile    string `json:"private_key_file,omitempty"`
+	CACertificateFile string `json:"ca_certificate_file,omitempty"`
+}
+
+// BlocklistConfig selects the store of the blocklist, file and redis are exclusive
+type BlocklistConfig struct {
+	// Path of the snapshot file
+	File string `json:"file,omitempty"`
+	// Server speaking Redis protocol sharing the blocklist between the balancers
+	Redis *RedisConfig `json:"redis,omitempty"`
+	// How often entries of the other balancers are loaded from Redis
+	SyncInterval Duration `json:"sync_interval,omitempty"`
+}
+
+type RedisConfig struct {
+	Address   string `json:"address"`
+	KeyPrefix string `json:"key_prefix,omitempty"`
+	// Password is read from the environment variable if it is not set
+	Password    string `json:"password,omitempty"`
+	PasswordEnv string `json:"password_env,omitempty"`
+}
+
+// AdminConfig is the AdminOptions which credentials are read from the files
+type AdminConfig struct {
+	Address           string   `json:"address"`
+	CertificateFile   string   `json:"certificate_file"`
+	PrivateKeyFile    string   `json:"private_key_file"`
+	CACertificateFile string   `json:"ca_certificate_file"`
+	Identities        []string `json:"identities,omitempty"`
+}
+
+// LoadConfig reads the config file, files with .yaml or .yml extension are read
+// as YAML, JSON otherwise. Config is not validated
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read config, error: %w", err)
+	}
+	format := "json"
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		format = "yaml"
+	}
+	cfg, err := ParseConfig(data, format)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config %s, error: %w", path, err)
+	}
+	cfg.dir = filepath.Dir(path)
+	return cfg, nil
+}
+
+// ParseConfig decodes the config of the format, one of yaml or json. Files referenced
+// by the config are resolved relative to the working directory
+func ParseConfig(data []byte, format string) (*Config, error) {
+	if format == "yaml" {
+		var document interface{}
+		if err := yaml.Unmarshal(data, &document); err != nil {
+			return nil, err
+		}
+		converted, err := json.Marshal(document)
+		if err != nil {
+			return nil, err
+		}
+		data = converted
+	} else if format != "json" {
+		return nil, fmt.Errorf("unknown config format %s", format)
+	}
+	cfg := &Config{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate checks the config the way Listen would, all the problems found are reported
+func (c *Config) Validate() error {
+	errs := make([]error, 0)
+	if len(c.Pools) == 0 {
+		errs = append(errs, fmt.Errorf("no pools configured"))
+	}
+	if c.IPBlocklistCapacity < 0 {
+		errs = append(errs, fmt.Errorf("invalid ip blocklist capacity %d", c.IPBlocklistCapacity))
+	}
+
+	opt, err := c.Options()
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		if err = opt.BlockPolicy.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("invalid block policy, error: %w", err))
+		}
+		if err = opt.Admin.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("invalid admin, error: %w", err))
+		}
+	}
+
+	// Ports of the balancer listeners cannot be taken by the pools
+	taken := map[int]string{}
+	for name, address := range map[string]string{"metrics": c.MetricsAddress, "admin": c.adminAddress()} {
+		if address == "" {
+			continue
+		}
+		port, err := addressPort(address)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s address %s", name, address))
+			continue
+		}
+		if other, ok := taken[port]; ok && port != 0 {
+			errs = append(errs, fmt.Errorf("duplicate port %d of %s and %s", port, name, other))
+		}
+		taken[port] = name
+	}
+
+	identities := map[string]struct{}{}
+	for i, pc := range c.Pools {
+		name := pc.Identity
+		if name == "" {
+			name = "#" + strconv.Itoa(i+1)
+		}
+		if _, ok := identities[pc.Identity]; ok && pc.Identity != "" {
+			errs = append(errs, fmt.Errorf("duplicate service pool %s", pc.Identity))
+		}
+		identities[pc.Identity] = struct{}{}
+		if other, ok := taken[pc.Port]; ok {
+			errs = append(errs, fmt.Errorf("duplicate port %d of service pool %s and %s", pc.Port, name, other))
+		}
+		if pc.Port == 0 {
+			errs = append(errs, fmt.Errorf("missing port for service pool %s", name))
+		}
+		if len(pc.Routes) == 0 {
+			errs = append(errs, fmt.Errorf("no routes for service pool %s", name))
+		}
+		routes := map[string]struct{}{}
+		for _, rte := range pc.Routes {
+			if _, _, err := net.SplitHostPort(rte.Address); err != nil {
+				errs = append(errs, fmt.Errorf("invalid route %q of service pool %s", rte.Address, name))
+			}
+			if _, ok := routes[rte.Address]; ok {
+				errs = append(errs, fmt.Errorf("duplicate route %s of service pool %s", rte.Address, name))
+			}
+			routes[rte.Address] = struct{}{}
+		}
+		if err := pc.validateDurations(); err != nil {
+			errs = append(errs, fmt.Errorf("service pool %s, error: %w", name, err))
+		}
+
+		pool, err := c.servicePool(pc)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err = validateServicePool(pool); err != nil {
+			errs = append(errs, err)
+		}
+		if _, _, err = loadPoolCredentials(pool); err != nil {
+			errs = append(errs, fmt.Errorf("service pool %s, error: %w", name, err))
+		}
+		if _, err = newPoolRateLimiter(pool); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateDurations checks that none of the durations of the pool are negative
+func (pc PoolConfig) validateDurations() error {
+	durations := map[string]Duration{
+		"rate_quota_period": pc.RateQuotaPeriod,
+		"route_timeout":     pc.RouteTimeout,
+		"drain_timeout":     pc.DrainTimeout,
+	}
+	if l := pc.ClientRateLimit; l != nil {
+		durations["client_rate_limit.period"] = l.Period
+	}
+	if l := pc.IPRateLimit; l != nil {
+		durations["ip_rate_limit.period"] = l.Period
+	}
+	if l := pc.ConnectionLimit; l != nil {
+		durations["connection_limit.queue_timeout"] = l.QueueTimeout
+	}
+	if b := pc.BlockPolicy; b != nil {
+		durations["block_policy.block_time"] = b.BlockTime
+		durations["block_policy.max_block_time"] = b.MaxBlockTime
+	}
+	if h := pc.HealthCheck; h != nil {
+		durations["health_check.recheck_interval"] = h.RecheckInterval
+		durations["health_check.interval"] = h.Interval
+	}
+	if r := pc.RetryPolicy; r != nil {
+		durations["retry_policy.timeout"] = r.Timeout
+		durations["retry_policy.connect_timeout"] = r.ConnectTimeout
+	}
+	if o := pc.OutlierDetection; o != nil {
+		durations["outlier_detection.min_session_duration"] = o.MinSessionDuration
+		durations["outlier_detection.ejection_time"] = o.EjectionTime
+	}
+	errs := make([]error, 0)
+	for _, name := range sortedKeys(durations) {
+		if durations[name] < 0 {
+			errs = append(errs, fmt.Errorf("negative duration %s of %s", time.Duration(durations[name]), name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ServicePools converts the pools of the config reading the certificate files
+func (c *Config) ServicePools() ([]ServicePool, error) {
+	pools := make([]ServicePool, 0, len(c.Pools))
+	for _, pc := range c.Pools {
+		pool, err := c.servicePool(pc)
+		if err != nil {
+			return nil, err
+		}
+		pools = append(pools, pool)
+	}
+	return pools, nil
+}
+
+func (c *Config) servicePool(pc PoolConfig) (ServicePool, error) {
+	spec := pc.PoolSpec
+	for _, file := range []struct {
+		path  string
+		value *string
+	}{
+		{pc.CertificateFile, &spec.Certificate},
+		{pc.PrivateKeyFile, &spec.PrivateKey},
+		{pc.CACertificateFile, &spec.CACertificate},
+	} {
+		if file.path == "" {
+			continue
+		}
+		data, err := c.readFile(file.path)
+		if err != nil {
+			return ServicePool{}, fmt.Errorf("service pool %s, error: %w", pc.Identity, err)
+		}
+		*file.value = string(data)
+	}
+	return spec.ServicePool()
+}
+
+// Options provides the options of the balancer reading the admin credential files,
+// logger is not set
+func (c *Config) Options() (Options, error) {
+	opt := Options{
+		LogLevel:            c.LogLevel,
+		IpBlockListCapacity: c.IPBlocklistCapacity,
+		MetricsAddress:      c.MetricsAddress,
+	}
+	if b := c.BlockPolicy; b != nil {
+		opt.BlockPolicy = BlockPolicy{
+			Threshold:       b.Threshold,
+			BlockTime:       time.Duration(b.BlockTime),
+			Escalation:      b.Escalation,
+			MaxBlockTime:    time.Duration(b.MaxBlockTime),
+			PrefixThreshold: b.PrefixThreshold,
+		}
+	}
+	if bl := c.Blocklist; bl != nil {
+		if bl.File != "" && bl.Redis != nil {
+			return Options{}, fmt.Errorf("blocklist can be kept either in the file or in redis")
+		}
+		if bl.File != "" {
+			opt.BlocklistStore = NewFileBlocklistStore(c.resolve(bl.File))
+		}
+		if r := bl.Redis; r != nil {
+			if r.Address == "" {
+				return Options{}, fmt.Errorf("missing blocklist redis address")
+			}
+			password := r.Password
+			if password == "" && r.PasswordEnv != "" {
+				password = os.Getenv(r.PasswordEnv)
+			}
+			opt.BlocklistStore = NewRedisBlocklistStore(r.Address, r.KeyPrefix, password)
+		}
+		if bl.SyncInterval < 0 {
+			return Options{}, fmt.Errorf("negative blocklist sync interval %s", time.Duration(bl.SyncInterval))
+		}
+		opt.BlocklistSyncInterval = time.Duration(bl.SyncInterval)
+	}
+	if a := c.Admin; a != nil {
+		if a.Address == "" {
+			return Options{}, fmt.Errorf("missing admin address")
+		}
+		opt.Admin = AdminOptions{Address: a.Address, Identities: a.Identities}
+		for _, file := range []struct {
+			path  string
+			value *string
+		}{
+			{a.CertificateFile, &opt.Admin.Certificate},
+			{a.PrivateKeyFile, &opt.Admin.PrivateKey},
+			{a.CACertificateFile, &opt.Admin.CACert},
+		} {
+			data, err := c.readFile(file.path)
+			if err != nil {
+				return Options{}, fmt.Errorf("admin, error: %w", err)
+			}
+			*file.value = string(data)
+		}
+	}
+	return opt, nil
+}
+
+func (c *Config) adminAddress() string {
+	if c.Admin == nil {
+		return ""
+	}
+	return c.Admin.Address
+}
+
+func (c *Config) resolve(path string) string {
+	if filepath.IsAbs(path) || c.dir == "" {
+		return path
+	}
+	return filepath.Join(c.dir, path)
+}
+
+func (c *Config) readFile(path string) ([]byte, error) {
+	if path == "" {
+		return nil, fmt.Errorf("missing file path")
+	}
+	data, err := os.ReadFile(c.resolve(path))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s, error: %w", path, err)
+	}
+	return data, nil
+}
+
+// addressPort provides the port of the host:port address
+func addressPort(address string) (int, error) {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(port)
+}
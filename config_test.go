@@ -0,0 +1,205 @@
+package xlb
+
+import (
+	"encoding/json"
+	"github.com/xdire/xlb/tlsutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestConfig writes the config next to the test certificates, certificate files
+// are referenced relative to the config
+func writeTestConfig(t *testing.T, dir, name, content string) string {
+	for _, file := range []string{"server.crt", "server.key", "ca.crt"} {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = os.WriteFile(filepath.Join(dir, file), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestLoadConfig
+// Will test that YAML config is loaded with the certificate files and validated
+func TestLoadConfig(t *testing.T) {
+	err := tlsutil.CreateLocalTLSData("test")
+	defer func() {
+		_, err := tlsutil.WipeLocalTLSData("./")
+		if err != nil {
+			t.Error("cannot clean pre-arranged test files")
+		}
+	}()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := writeTestConfig(t, t.TempDir(), "xlb.yaml", `
+log_level: info
+metrics_address: localhost:9140
+blocklist:
+  file: blocklist.json
+pools:
+  - identity: test
+    port: 9141
+    certificate_file: server.crt
+    private_key_file: server.key
+    ca_certificate_file: ca.crt
+    rate_quota_times: 100
+    rate_quota_period: 1s
+    routes:
+      - address: localhost:9142
+      - address: localhost:9143
+        weight: 2
+    health_check:
+      interval: 2s
+      probe:
+        type: http
+        path: /health
+`)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("cannot load config, error: %+v", err)
+	}
+	if err = cfg.Validate(); err != nil {
+		t.Fatalf("config should be valid, error: %+v", err)
+	}
+	pools, err := cfg.ServicePools()
+	if err != nil {
+		t.Fatalf("cannot convert pools, error: %+v", err)
+	}
+	if len(pools) != 1 || !strings.Contains(pools[0].GetCertificate(), "BEGIN CERTIFICATE") || pools[0].Routes()[1].Weight() != 2 {
+		t.Errorf("unexpected pools %+v", pools)
+	}
+	opt, err := cfg.Options()
+	if err != nil {
+		t.Fatalf("cannot convert options, error: %+v", err)
+	}
+	if store, ok := opt.BlocklistStore.(*FileBlocklistStore); !ok || store.path != filepath.Join(filepath.Dir(path), "blocklist.json") {
+		t.Errorf("blocklist file should be resolved relative to the config, got: %+v", opt.BlocklistStore)
+	}
+
+	if _, err = ParseConfig([]byte("pools: []\nunknown: 1\n"), "yaml"); err == nil {
+		t.Errorf("unknown settings should be rejected")
+	}
+	if _, err = ParseConfig([]byte(`{"pools": [{"identity": "test", "route_timeout": "fast"}]}`), "json"); err == nil {
+		t.Errorf("bad duration should be rejected")
+	}
+}
+
+// TestConfigValidate
+// Will test that all the problems of the config are reported before Listen
+func TestConfigValidate(t *testing.T) {
+	err := tlsutil.CreateLocalTLSData("test")
+	defer func() {
+		_, err := tlsutil.WipeLocalTLSData("./")
+		if err != nil {
+			t.Error("cannot clean pre-arranged test files")
+		}
+	}()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	if err = os.WriteFile(filepath.Join(dir, "broken.crt"), []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	path := writeTestConfig(t, dir, "xlb.json", `{
+		"metrics_address": "localhost:9150",
+		"pools": [
+			{"identity": "a", "port": 9150, "routes": [{"address": "localhost:9151"}],
+			 "certificate_file": "server.crt", "private_key_file": "server.key", "ca_certificate_file": "ca.crt"},
+			{"identity": "a", "port": 9152, "routes": [{"address": "localhost:9151"}],
+			 "certificate_file": "server.crt", "private_key_file": "server.key", "ca_certificate_file": "ca.crt"},
+			{"identity": "b", "port": 9153, "routes": [], "drain_timeout": "-1s",
+			 "certificate_file": "broken.crt", "private_key_file": "server.key", "ca_certificate_file": "ca.crt"}
+		]
+	}`)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("cannot load config, error: %+v", err)
+	}
+	err = cfg.Validate()
+	if err == nil {
+		t.Fatalf("config should be invalid")
+	}
+	for _, expected := range []string{
+		"duplicate port 9150 of service pool a and metrics",
+		"duplicate service pool a",
+		"no routes for service pool b",
+		"negative duration -1s of drain_timeout",
+		"service pool b, error: invalid service pool pki data",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("validation should report %q, got: %v", expected, err)
+		}
+	}
+}
+
+// TestConfigSchema
+// Will test that the schema describes every setting of the config
+func TestConfigSchema(t *testing.T) {
+	schema := struct {
+		Properties map[string]json.RawMessage `json:"properties"`
+		Defs       struct {
+			Pool struct {
+				Properties map[string]json.RawMessage `json:"properties"`
+			} `json:"pool"`
+		} `json:"$defs"`
+	}{}
+	if err := json.Unmarshal(ConfigSchema, &schema); err != nil {
+		t.Fatalf("cannot parse schema, error: %+v", err)
+	}
+	compare := func(name string, typ reflect.Type, properties map[string]json.RawMessage) {
+		expected := jsonFields(typ)
+		actual := make([]string, 0, len(properties))
+		for property := range properties {
+			actual = append(actual, property)
+		}
+		sort.Strings(actual)
+		if !reflect.DeepEqual(expected, actual) {
+			t.Errorf("schema of %s should have properties %v, got: %v", name, expected, actual)
+		}
+	}
+	compare("config", reflect.TypeOf(Config{}), schema.Properties)
+	compare("pool", reflect.TypeOf(PoolConfig{}), schema.Defs.Pool.Properties)
+}
+
+// jsonFields collects the JSON names of the exported fields including the embedded ones
+func jsonFields(typ reflect.Type) []string {
+	fields := make([]string, 0)
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.Anonymous {
+			fields = append(fields, jsonFields(field.Type)...)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		fields = append(fields, strings.Split(field.Tag.Get("json"), ",")[0])
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// TestConfigDuration
+// Will test that durations are written back as duration strings
+func TestConfigDuration(t *testing.T) {
+	data, err := json.Marshal(RetryPolicySpec{Timeout: Duration(time.Second * 90)})
+	if err != nil || !strings.Contains(string(data), `"timeout":"1m30s"`) {
+		t.Errorf("unexpected duration encoding %s %v", data, err)
+	}
+}
@@ -0,0 +1,239 @@
+package xlb
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"syscall"
+	"time"
+)
+
+const defaultConfigWatchInterval = time.Second * 5
+
+// PoolsDiff lists the identities of the pools changed by ApplyPools
+type PoolsDiff struct {
+	Added   []string `json:"added,omitempty"`
+	Updated []string `json:"updated,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// Empty checks that no pools were changed
+func (d PoolsDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Updated) == 0 && len(d.Removed) == 0
+}
+
+// ApplyPools makes the pools provided the only pools of the balancer, pools missing
+// are removed, new pools are added and changed pools are updated, pools not changed
+// are left untouched. Pools are validated before any change is applied, pools failed
+// to apply are reported by the error while the other pools are still applied
+func (lb *LoadBalancer) ApplyPools(pools []ServicePool) (PoolsDiff, error) {
+	desired := make(map[string]ServicePool, len(pools))
+	for _, pool := range pools {
+		if err := validateServicePool(pool); err != nil {
+			return PoolsDiff{}, err
+		}
+		if _, exists := desired[pool.Identity()]; exists {
+			return PoolsDiff{}, fmt.Errorf("duplicate service pool %s", pool.Identity())
+		}
+		desired[pool.Identity()] = pool
+	}
+
+	lb.mutex.Lock()
+	current := make(map[string]ServicePool, len(lb.poolMap))
+	for identity, pool := range lb.poolMap {
+		current[identity] = pool
+	}
+	lb.mutex.Unlock()
+
+	diff := PoolsDiff{}
+	errs := make([]error, 0)
+	// Pools are removed first for the ports they free to be taken by the added pools
+	for _, identity := range sortedKeys(current) {
+		if _, ok := desired[identity]; ok {
+			continue
+		}
+		if err := lb.RemoveServicePool(identity); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		diff.Removed = append(diff.Removed, identity)
+	}
+	for _, identity := range sortedKeys(desired) {
+		pool := desired[identity]
+		existing, ok := current[identity]
+		if ok && samePool(existing, pool) {
+			continue
+		}
+		if err := lb.UpdatePool(pool); err != nil {
+			errs = append(errs, fmt.Errorf("service pool %s, error: %w", identity, err))
+			continue
+		}
+		if ok {
+			diff.Updated = append(diff.Updated, identity)
+		} else {
+			diff.Added = append(diff.Added, identity)
+		}
+	}
+	return diff, errors.Join(errs...)
+}
+
+// samePool compares the pools, probes are compared by their settings as the probes
+// built from the config hold fresh TLS configs on every load
+func samePool(a, b ServicePool) bool {
+	probeA, probeB := a.SvcHealthProbe, b.SvcHealthProbe
+	a.SvcHealthProbe, b.SvcHealthProbe = nil, nil
+	return reflect.DeepEqual(a, b) && sameProbe(probeA, probeB)
+}
+
+func sameProbe(a, b HealthProbe) bool {
+	switch probeA := a.(type) {
+	case HTTPProbe:
+		probeB, ok := b.(HTTPProbe)
+		if !ok || !sameTLSConfig(probeA.TLSConfig, probeB.TLSConfig) {
+			return false
+		}
+		probeA.TLSConfig, probeB.TLSConfig = nil, nil
+		return probeA == probeB
+	case GRPCProbe:
+		probeB, ok := b.(GRPCProbe)
+		return ok && probeA.Service == probeB.Service && sameTLSConfig(probeA.TLSConfig, probeB.TLSConfig)
+	case TLSProbe:
+		probeB, ok := b.(TLSProbe)
+		return ok && sameTLSConfig(probeA.Config, probeB.Config)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// sameTLSConfig compares the configs by the settings, root pools by the certificates they hold
+func sameTLSConfig(a, b *tls.Config) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if !a.RootCAs.Equal(b.RootCAs) {
+		return false
+	}
+	a, b = a.Clone(), b.Clone()
+	a.RootCAs, b.RootCAs = nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+// ConfigWatcher reloads the config file into the balancer once the file or the
+// certificate files it references change, or once the process receives SIGHUP.
+// Only the pools are reloaded, other settings are applied on restart
+type ConfigWatcher struct {
+	lb       *LoadBalancer
+	path     string
+	interval time.Duration
+	// Fingerprint of the config applied last and the error reported last
+	applied []byte
+	lastErr string
+}
+
+// NewConfigWatcher creates the watcher of the config file checking the file every
+// interval (5s default), config the balancer was created from is expected to be at path
+func NewConfigWatcher(lb *LoadBalancer, path string, interval time.Duration) *ConfigWatcher {
+	if interval <= 0 {
+		interval = defaultConfigWatchInterval
+	}
+	return &ConfigWatcher{lb: lb, path: path, interval: interval}
+}
+
+// Run watches the config until ctx ends
+func (w *ConfigWatcher) Run(ctx context.Context) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	// Config balancer was created from is the baseline
+	if fingerprint, err := w.fingerprint(); err == nil {
+		w.applied = fingerprint
+	}
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.reload(false)
+		case <-hangup:
+			w.lb.logger.Info().Msgf("reloading config %s on SIGHUP", w.path)
+			w.reload(true)
+		}
+	}
+}
+
+// Reload reads the config and applies the pools, config is applied even if not changed
+func (w *ConfigWatcher) Reload() (PoolsDiff, error) {
+	cfg, err := LoadConfig(w.path)
+	if err != nil {
+		return PoolsDiff{}, err
+	}
+	if err = cfg.Validate(); err != nil {
+		return PoolsDiff{}, fmt.Errorf("invalid config %s, error: %w", w.path, err)
+	}
+	pools, err := cfg.ServicePools()
+	if err != nil {
+		return PoolsDiff{}, err
+	}
+	return w.lb.ApplyPools(pools)
+}
+
+// reload applies the config if it changed since applied last or if forced, same
+// errors are reported once not to flood the log while the config stays broken
+func (w *ConfigWatcher) reload(force bool) {
+	fingerprint, err := w.fingerprint()
+	if err == nil && !force && bytes.Equal(fingerprint, w.applied) {
+		return
+	}
+	var diff PoolsDiff
+	if err == nil {
+		diff, err = w.Reload()
+	}
+	if err != nil {
+		if err.Error() != w.lastErr || force {
+			w.lb.logger.Err(err).Msgf("cannot reload config %s, keeping the pools running", w.path)
+		}
+		w.lastErr = err.Error()
+		return
+	}
+	w.applied = fingerprint
+	w.lastErr = ""
+	if !diff.Empty() {
+		w.lb.logger.Info().Msgf("config %s reloaded, pools added: %v updated: %v removed: %v",
+			w.path, diff.Added, diff.Updated, diff.Removed)
+	}
+}
+
+// fingerprint hashes the config and the certificate files of the pools
+func (w *ConfigWatcher) fingerprint() ([]byte, error) {
+	hash := sha256.New()
+	data, err := os.ReadFile(w.path)
+	if err != nil {
+		return nil, err
+	}
+	hash.Write(data)
+	if cfg, err := LoadConfig(w.path); err == nil {
+		files := make([]string, 0)
+		for _, pc := range cfg.Pools {
+			files = append(files, pc.CertificateFile, pc.PrivateKeyFile, pc.CACertificateFile)
+		}
+		sort.Strings(files)
+		for _, file := range files {
+			if file == "" {
+				continue
+			}
+			// Missing files are reported by the reload
+			data, _ = os.ReadFile(cfg.resolve(file))
+			hash.Write(data)
+		}
+	}
+	return hash.Sum(nil), nil
+}
@@ -0,0 +1,184 @@
+package xlb
+
+import (
+	"context"
+	"github.com/xdire/xlb/tlsutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLoadBalancerApplyPools
+// Will test that only the pools changed are added, updated and removed
+func TestLoadBalancerApplyPools(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pool := func(identity string, port int, route string) ServicePool {
+		return ServicePool{
+			SvcIdentity: identity,
+			SvcPort:     port,
+			SvcRoutes:   []ServicePoolRoute{{ServicePath: route, ServiceActive: true}},
+		}
+	}
+	lb, err := NewLoadBalancer(ctx, []ServicePool{pool("a", 9160, "localhost:9161"), pool("b", 9162, "localhost:9163")}, Options{})
+	if err != nil {
+		t.Fatalf("cannot configure load balancer, error: %+v", err)
+	}
+
+	diff, err := lb.ApplyPools([]ServicePool{pool("a", 9160, "localhost:9161"), pool("b", 9162, "localhost:9164"), pool("c", 9165, "localhost:9166")})
+	if err != nil {
+		t.Fatalf("cannot apply pools, error: %+v", err)
+	}
+	if !reflect.DeepEqual(diff, PoolsDiff{Added: []string{"c"}, Updated: []string{"b"}}) {
+		t.Errorf("unexpected diff %+v", diff)
+	}
+	diff, err = lb.ApplyPools([]ServicePool{pool("c", 9165, "localhost:9166")})
+	if err != nil || !reflect.DeepEqual(diff, PoolsDiff{Removed: []string{"a", "b"}}) {
+		t.Errorf("unexpected diff %+v %v", diff, err)
+	}
+	if _, err = lb.ApplyPools([]ServicePool{pool("c", 9165, "localhost:9166"), pool("c", 9167, "localhost:9166")}); err == nil {
+		t.Errorf("duplicate pools should not be applied")
+	}
+	if len(lb.poolMap) != 1 {
+		t.Errorf("pools should be left as they were if not applied, got: %d", len(lb.poolMap))
+	}
+}
+
+// TestConfigWatcher
+// Will test that changed config file is applied to the balancer and broken config is not
+func TestConfigWatcher(t *testing.T) {
+	err := tlsutil.CreateLocalTLSData("test")
+	defer func() {
+		_, err := tlsutil.WipeLocalTLSData("./")
+		if err != nil {
+			t.Error("cannot clean pre-arranged test files")
+		}
+	}()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := `
+pools:
+  - identity: test
+    port: 9170
+    certificate_file: server.crt
+    private_key_file: server.key
+    ca_certificate_file: ca.crt
+    routes:
+      - address: ROUTE
+`
+	path := writeTestConfig(t, t.TempDir(), "xlb.yaml", strings.Replace(template, "ROUTE", "localhost:9171", 1))
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pools, err := cfg.ServicePools()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lb, err := NewLoadBalancer(ctx, pools, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go NewConfigWatcher(lb, path, time.Millisecond*50).Run(ctx)
+	routeOf := func() string {
+		lb.mutex.Lock()
+		defer lb.mutex.Unlock()
+		return lb.poolMap["test"].Routes()[0].Path()
+	}
+
+	<-time.After(time.Millisecond * 100)
+	if err = os.WriteFile(path, []byte(strings.Replace(template, "ROUTE", "localhost:9172", 1)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second * 2)
+	for routeOf() != "localhost:9172" {
+		if time.Now().After(deadline) {
+			t.Fatalf("changed config should be applied")
+		}
+		<-time.After(time.Millisecond * 20)
+	}
+
+	if err = os.WriteFile(path, []byte(strings.Replace(template, "ROUTE", "nowhere", 1)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	<-time.After(time.Millisecond * 200)
+	if routeOf() != "localhost:9172" {
+		t.Errorf("invalid config should not be applied")
+	}
+}
+
+// TestLoadBalancerApplyPoolsHealthCheck
+// Will test that pools reloaded from the same spec with the TLS probe are not updated,
+// and the health check settings changed on reload are applied to the served pool
+func TestLoadBalancerApplyPoolsHealthCheck(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err := tlsutil.CreateLocalTLSData("test")
+	defer func() {
+		_, err := tlsutil.WipeLocalTLSData("./")
+		if err != nil {
+			t.Error("cannot clean pre-arranged test files")
+		}
+	}()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := os.ReadFile("server.crt")
+	key, _ := os.ReadFile("server.key")
+	ca, _ := os.ReadFile("ca.crt")
+	pool := func(interval time.Duration) ServicePool {
+		pool, err := PoolSpec{
+			Identity:      "test",
+			Port:          9192,
+			Certificate:   string(cert),
+			PrivateKey:    string(key),
+			CACertificate: string(ca),
+			Routes:        []RouteSpec{{Address: "localhost:9193"}},
+			HealthCheck: &HealthCheckSpec{
+				Interval: Duration(interval),
+				Failures: 2,
+				Probe:    &ProbeSpec{Type: ProbeTLS, CACertificate: string(ca)},
+			},
+		}.ServicePool()
+		if err != nil {
+			t.Fatalf("cannot build pool, error: %+v", err)
+		}
+		return pool
+	}
+	lb, err := NewLoadBalancer(ctx, []ServicePool{pool(time.Second)}, Options{})
+	if err != nil {
+		t.Fatalf("cannot configure load balancer, error: %+v", err)
+	}
+	go lb.Listen()
+	<-time.After(time.Millisecond * 500)
+	fwd, ok := lb.forwarder("test")
+	if !ok {
+		t.Fatalf("pool should be served")
+	}
+
+	diff, err := lb.ApplyPools([]ServicePool{pool(time.Second)})
+	if err != nil || !reflect.DeepEqual(diff, PoolsDiff{}) {
+		t.Errorf("unchanged pool should not be updated, got: %+v %v", diff, err)
+	}
+	diff, err = lb.ApplyPools([]ServicePool{pool(time.Second * 3)})
+	if err != nil || !reflect.DeepEqual(diff, PoolsDiff{Updated: []string{"test"}}) {
+		t.Errorf("changed pool should be updated, got: %+v %v", diff, err)
+	}
+	if settings := fwd.health.settings.Load(); settings.activeCheckInterval != 3000 || settings.failureThreshold != 2 {
+		t.Errorf("health check settings should be applied, got: %+v", *settings)
+	}
+	diff, err = lb.ApplyPools([]ServicePool{pool(0)})
+	if err != nil || !reflect.DeepEqual(diff, PoolsDiff{Updated: []string{"test"}}) {
+		t.Errorf("changed pool should be updated, got: %+v %v", diff, err)
+	}
+	if fwd.health.ActiveChecks() {
+		t.Errorf("active health checks should be disabled")
+	}
+}
@@ -0,0 +1,240 @@
+package xlb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Behaviors of the session hitting the connection limit
+const (
+	OverflowReject = "reject"
+	OverflowQueue  = "queue"
+)
+
+const (
+	defaultConnectionQueueSize    = 100
+	defaultConnectionQueueTimeout = time.Second
+)
+
+// ErrConnectionLimit is returned by the forwarder for the session rejected by the connection limit
+var ErrConnectionLimit = errors.New("connection limit reached")
+
+// ConnectionLimit caps the sessions open at once for the whole pool and for every client
+// of the pool, routes are capped by the ServicePoolRoute. Session hitting any of the caps
+// is rejected right away or waits in the bounded queue until the session holding the cap
+// ends, session not admitted within QueueTimeout is rejected
+type ConnectionLimit struct {
+	// Sessions open at once for the pool, 0 is unlimited
+	MaxConnections int
+	// Sessions open at once for every client of the pool, 0 is unlimited
+	MaxClientConnections int
+	// Client certificate property the client cap is keyed by, one of HashKey* constants (cert-serial default)
+	ClientKey string
+	// Behavior of the session hitting the cap, one of Overflow* constants (reject default)
+	Overflow string
+	// Sessions waiting at once for every cap, sessions above it are rejected (100 default)
+	QueueSize int
+	// How long the session waits for all the caps to admit it (1s default)
+	QueueTimeout time.Duration
+}
+
+func (c ConnectionLimit) queued() bool { return c.Overflow == OverflowQueue }
+
+func (c ConnectionLimit) queueSize() int {
+	if !c.queued() {
+		return 0
+	}
+	if c.QueueSize <= 0 {
+		return defaultConnectionQueueSize
+	}
+	return c.QueueSize
+}
+
+func (c ConnectionLimit) queueTimeout() time.Duration {
+	if c.QueueTimeout <= 0 {
+		return defaultConnectionQueueTimeout
+	}
+	return c.QueueTimeout
+}
+
+func (c ConnectionLimit) clientKey() string {
+	if c.ClientKey == "" {
+		return HashKeyCertSerial
+	}
+	return c.ClientKey
+}
+
+func (c ConnectionLimit) validate() error {
+	if c.MaxConnections < 0 || c.MaxClientConnections < 0 || c.QueueSize < 0 || c.QueueTimeout < 0 {
+		return errors.New("connection limit settings cannot be negative")
+	}
+	switch c.Overflow {
+	case "", OverflowReject, OverflowQueue:
+	default:
+		return fmt.Errorf("unknown connection limit overflow %s", c.Overflow)
+	}
+	return validateHashKey(c.ClientKey)
+}
+
+// waitQueue is the bounded set of the sessions waiting for the cap to be released,
+// every release wakes all the waiters to compete for the cap again
+type waitQueue struct {
+	mutex    sync.Mutex
+	waiting  int
+	released chan struct{}
+}
+
+// enter reserves the place in the queue and provides the channel closed on the next
+// release, false if the queue is full
+func (q *waitQueue) enter(size int) (<-chan struct{}, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.waiting >= size {
+		return nil, false
+	}
+	q.waiting++
+	if q.released == nil {
+		q.released = make(chan struct{})
+	}
+	return q.released, true
+}
+
+func (q *waitQueue) leave() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.waiting--
+}
+
+// notify wakes the sessions waiting in the queue
+func (q *waitQueue) notify() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.released != nil {
+		close(q.released)
+		q.released = nil
+	}
+}
+
+// wait takes the cap with tryAcquire, waiting in the queue for the releases of the cap
+// until ctx ends if the limit allows to queue, error of tryAcquire ends the wait
+func (q *waitQueue) wait(ctx context.Context, limit ConnectionLimit, tryAcquire func() (bool, error)) error {
+	for {
+		if ok, err := tryAcquire(); ok || err != nil {
+			return err
+		}
+		released, ok := q.enter(limit.queueSize())
+		if !ok {
+			return ErrConnectionLimit
+		}
+		// Cap might be released before the session entered the queue
+		if ok, err := tryAcquire(); ok || err != nil {
+			q.leave()
+			return err
+		}
+		select {
+		case <-released:
+			q.leave()
+		case <-ctx.Done():
+			q.leave()
+			return fmt.Errorf("%w, not admitted within %s", ErrConnectionLimit, limit.queueTimeout())
+		}
+	}
+}
+
+// connectionSemaphore counts the sessions open at once against the cap
+type connectionSemaphore struct {
+	open  atomic.Int32
+	queue waitQueue
+}
+
+// tryAcquire takes the place of the session if less than max sessions are open, 0 max is unlimited
+func (s *connectionSemaphore) tryAcquire(max int) bool {
+	for {
+		open := s.open.Load()
+		if max > 0 && int(open) >= max {
+			return false
+		}
+		if s.open.CompareAndSwap(open, open+1) {
+			return true
+		}
+	}
+}
+
+// acquire takes the place of the session within the limit
+func (s *connectionSemaphore) acquire(ctx context.Context, max int, limit ConnectionLimit) error {
+	return s.queue.wait(ctx, limit, func() (bool, error) { return s.tryAcquire(max), nil })
+}
+
+func (s *connectionSemaphore) release() {
+	s.open.Add(-1)
+	s.queue.notify()
+}
+
+// Open provides the count of the sessions holding the place
+func (s *connectionSemaphore) Open() int { return int(s.open.Load()) }
+
+type keyedSemaphore struct {
+	connectionSemaphore
+	refs int
+}
+
+// keyedSemaphores counts the sessions of every client separately, clients are
+// forgotten once all their sessions ended and none is waiting
+type keyedSemaphores struct {
+	mutex sync.Mutex
+	keys  map[string]*keyedSemaphore
+}
+
+// acquire takes the place of the client session within the limit, release must be called
+// once the session ended if no error returned
+func (k *keyedSemaphores) acquire(ctx context.Context, key string, max int, limit ConnectionLimit) (func(), error) {
+	k.mutex.Lock()
+	if k.keys == nil {
+		k.keys = map[string]*keyedSemaphore{}
+	}
+	sem, ok := k.keys[key]
+	if !ok {
+		sem = &keyedSemaphore{}
+		k.keys[key] = sem
+	}
+	sem.refs++
+	k.mutex.Unlock()
+
+	if err := sem.acquire(ctx, max, limit); err != nil {
+		k.forget(key, sem)
+		return nil, err
+	}
+	return func() {
+		sem.release()
+		k.forget(key, sem)
+	}, nil
+}
+
+func (k *keyedSemaphores) forget(key string, sem *keyedSemaphore) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	sem.refs--
+	if sem.refs == 0 {
+		delete(k.keys, key)
+	}
+}
+
+// notify wakes the sessions of all the clients waiting in the queues
+func (k *keyedSemaphores) notify() {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	for _, sem := range k.keys {
+		sem.queue.notify()
+	}
+}
+
+// Len provides the count of the clients with the sessions open or waiting
+func (k *keyedSemaphores) Len() int {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return len(k.keys)
+}
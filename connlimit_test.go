@@ -0,0 +1,121 @@
+package xlb
+
+import (
+	"context"
+	"errors"
+	"github.com/rs/zerolog"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestConnectionSemaphore
+// Will test that sessions above the cap are rejected or wait in the bounded queue
+func TestConnectionSemaphore(t *testing.T) {
+	sem := connectionSemaphore{}
+	reject := ConnectionLimit{}
+	if err := sem.acquire(context.Background(), 1, reject); err != nil {
+		t.Fatalf("session within cap should be admitted, error: %+v", err)
+	}
+	if err := sem.acquire(context.Background(), 1, reject); !errors.Is(err, ErrConnectionLimit) {
+		t.Fatalf("session above cap should be rejected, got: %+v", err)
+	}
+
+	// Waiting session is admitted once the cap is released
+	queue := ConnectionLimit{Overflow: OverflowQueue, QueueSize: 1}
+	admitted := make(chan error, 1)
+	go func() {
+		admitted <- sem.acquire(context.Background(), 1, queue)
+	}()
+	<-time.After(time.Millisecond * 50)
+
+	// Queue is bounded
+	if err := sem.acquire(context.Background(), 1, queue); !errors.Is(err, ErrConnectionLimit) {
+		t.Errorf("session above queue size should be rejected, got: %+v", err)
+	}
+	sem.release()
+	select {
+	case err := <-admitted:
+		if err != nil {
+			t.Errorf("waiting session should be admitted, error: %+v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("waiting session was not admitted on release")
+	}
+
+	// Waiting session is rejected once the queue timeout passed
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := sem.acquire(ctx, 1, queue); !errors.Is(err, ErrConnectionLimit) {
+		t.Errorf("session should be rejected after queue timeout, got: %+v", err)
+	}
+	if sem.Open() != 1 {
+		t.Errorf("only admitted session should be open, got: %d", sem.Open())
+	}
+}
+
+// TestForwarderConnectionLimit
+// Will test that sessions above the pool cap are rejected and the routes
+// at their cap are skipped by the strategy
+func TestForwarderConnectionLimit(t *testing.T) {
+	address, stop := startEchoServer(t)
+	defer stop()
+	other, stopOther := startEchoServer(t)
+	defer stopOther()
+
+	fwd := NewForwarder(ServicePool{
+		SvcIdentity: "test",
+		SvcRoutes: []ServicePoolRoute{
+			{ServicePath: address, ServiceActive: true, ServiceMaxConnections: 1},
+			{ServicePath: other, ServiceActive: true, ServiceWeight: 10},
+		},
+		SvcConnectionLimit: ConnectionLimit{MaxConnections: 2},
+	}, zerolog.Nop())
+
+	// Least connections strategy prefers the heavier route, first route is selected once
+	first, _ := attachSession(t, fwd)
+	defer first.Close()
+	second, _ := attachSession(t, fwd)
+	defer second.Close()
+	for _, rte := range fwd.currentRoutes() {
+		if rte.Connections() != 1 {
+			t.Errorf("every route should take one session, route %s got: %d", rte.Address(), rte.Connections())
+		}
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	if err := fwd.Attach(context.Background(), server); !errors.Is(err, ErrConnectionLimit) {
+		t.Errorf("session above pool cap should be rejected, got: %+v", err)
+	}
+}
+
+// TestForwarderRouteConnectionQueue
+// Will test that session waits for the route at its cap to be released
+func TestForwarderRouteConnectionQueue(t *testing.T) {
+	address, stop := startEchoServer(t)
+	defer stop()
+
+	fwd := NewForwarder(ServicePool{
+		SvcIdentity:        "test",
+		SvcRoutes:          []ServicePoolRoute{{ServicePath: address, ServiceActive: true, ServiceMaxConnections: 1}},
+		SvcConnectionLimit: ConnectionLimit{Overflow: OverflowQueue, QueueTimeout: time.Second * 2},
+	}, zerolog.Nop())
+
+	first, firstResult := attachSession(t, fwd)
+	go func() {
+		<-time.After(time.Millisecond * 100)
+		first.Close()
+	}()
+
+	second, _ := attachSession(t, fwd)
+	defer second.Close()
+	select {
+	case <-firstResult:
+	case <-time.After(time.Second):
+		t.Fatalf("first session was not closed")
+	}
+	if conn := fwd.currentRoutes()[0].Connections(); conn != 1 {
+		t.Errorf("route should take only the waiting session, got: %d", conn)
+	}
+}
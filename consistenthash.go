@@ -0,0 +1,171 @@
+package xlb
+
+import (
+	"crypto/tls"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Session properties the consistent hashing can be keyed by
+const (
+	HashKeyRemoteIP    = "remote-ip"
+	HashKeyCommonName  = "common-name"
+	HashKeyCertSerial  = "cert-serial"
+	HashKeyCertSubject = "cert-subject"
+	HashKeySPIFFEID    = "spiffe-id"
+	HashKeyCertSAN     = "cert-san"
+)
+
+// Virtual nodes placed on the ring for every route
+const hashRingReplicas = 160
+
+// KeyedStrategy is the Strategy which selects the route by the key of the
+// session, forwarder will call NextFor instead of Next for such strategies
+type KeyedStrategy interface {
+	Strategy
+	NextFor(key string, routes []*Route) *Route
+}
+
+// validateHashKey checks that session property is supported for hashing
+func validateHashKey(hashKey string) error {
+	switch hashKey {
+	case "", HashKeyRemoteIP, HashKeyCommonName, HashKeyCertSerial, HashKeyCertSubject, HashKeySPIFFEID, HashKeyCertSAN:
+		return nil
+	}
+	return fmt.Errorf("unknown hash key %s", hashKey)
+}
+
+// sessionKey extracts the session property to hash, certificate properties
+// are taken from the leaf peer certificate, remote IP is used as the fallback
+func sessionKey(in io.ReadWriteCloser, hashKey string) string {
+	if tlsConn, ok := in.(*tls.Conn); ok && hashKey != "" && hashKey != HashKeyRemoteIP {
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			crt := certs[0]
+			switch hashKey {
+			case HashKeyCommonName:
+				return crt.Subject.CommonName
+			case HashKeyCertSerial:
+				return crt.SerialNumber.String()
+			case HashKeyCertSubject:
+				return crt.Subject.String()
+			case HashKeySPIFFEID:
+				for _, uri := range crt.URIs {
+					if uri.Scheme == "spiffe" {
+						return uri.String()
+					}
+				}
+			case HashKeyCertSAN:
+				if names := certificateAltNames(crt); len(names) > 0 {
+					return strings.Join(names, ",")
+				}
+			}
+		}
+	}
+	if conn, ok := in.(net.Conn); ok && conn.RemoteAddr() != nil {
+		host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil {
+			return conn.RemoteAddr().String()
+		}
+		return host
+	}
+	return ""
+}
+
+type ringNode struct {
+	hash  uint64
+	route *Route
+}
+
+// consistentHash places every route on the hash ring with multiple virtual
+// nodes and selects the first available route clockwise from the key hash.
+// Ring is rebuilt only when routes are added or removed from the forwarder,
+// so only the keys of the added or removed routes are moved, routes which are
+// unavailable are skipped to the next node on the ring keeping the ring intact.
+// Route weights are not considered, every route owns the same share of the ring
+type consistentHash struct {
+	connectionHooks
+	mutex  sync.RWMutex
+	routes []*Route
+	ring   []ringNode
+}
+
+// Next selects random available route for the sessions without the key
+func (ch *consistentHash) Next(routes []*Route) *Route {
+	return ch.NextFor(strconv.FormatUint(rand.Uint64(), 16), routes)
+}
+
+// NextFor selects the route owning the key on the ring
+func (ch *consistentHash) NextFor(key string, routes []*Route) *Route {
+	ring := ch.ringFor(routes)
+	if len(ring) == 0 {
+		return nil
+	}
+	h := hashString(key)
+	start := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+	for i := 0; i < len(ring); i++ {
+		node := ring[(start+i)%len(ring)]
+		if node.route.Available() {
+			return node.route
+		}
+	}
+	return nil
+}
+
+// ringFor provides the ring for the routes snapshot rebuilding it if route set changed
+func (ch *consistentHash) ringFor(routes []*Route) []ringNode {
+	ch.mutex.RLock()
+	if sameRoutes(ch.routes, routes) {
+		ring := ch.ring
+		ch.mutex.RUnlock()
+		return ring
+	}
+	ch.mutex.RUnlock()
+
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	if !sameRoutes(ch.routes, routes) {
+		ring := make([]ringNode, 0, len(routes)*hashRingReplicas)
+		for _, route := range routes {
+			for i := 0; i < hashRingReplicas; i++ {
+				ring = append(ring, ringNode{hashString(route.Address() + "#" + strconv.Itoa(i)), route})
+			}
+		}
+		sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+		ch.routes = routes
+		ch.ring = ring
+	}
+	return ch.ring
+}
+
+func sameRoutes(a, b []*Route) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// hashString provides FNV-1a hash with the final avalanche mixing
+// for the similar keys to be spread evenly on the ring
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
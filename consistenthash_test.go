@@ -0,0 +1,115 @@
+package xlb
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+// assignKeys maps the keys to the routes selected by the strategy
+func assignKeys(strategy KeyedStrategy, keys []string, routes []*Route) map[string]*Route {
+	assigned := make(map[string]*Route, len(keys))
+	for _, key := range keys {
+		assigned[key] = strategy.NextFor(key, routes)
+	}
+	return assigned
+}
+
+func TestConsistentHash(t *testing.T) {
+	keys := make([]string, 2000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+	}
+
+	t.Run("Stable and spread", func(t *testing.T) {
+		strategy := &consistentHash{}
+		routes := newTestRoutes(1, 1, 1, 1)
+		first := assignKeys(strategy, keys, routes)
+		second := assignKeys(strategy, keys, routes)
+		perRoute := map[*Route]int{}
+		for _, key := range keys {
+			if first[key] != second[key] {
+				t.Fatalf("key %s moved without routes change", key)
+			}
+			perRoute[first[key]]++
+		}
+		for i, rte := range routes {
+			share := float64(perRoute[rte]) / float64(len(keys))
+			if share < 0.15 || share > 0.35 {
+				t.Errorf("route %d owns %.2f of the keys, expected about 0.25", i, share)
+			}
+		}
+	})
+
+	t.Run("Minimal movement on route added", func(t *testing.T) {
+		strategy := &consistentHash{}
+		routes := newTestRoutes(1, 1, 1, 1, 1)
+		before := assignKeys(strategy, keys, routes)
+		added := append(append([]*Route{}, routes...), newRoute(ServicePoolRoute{ServicePath: "localhost:9999", ServiceActive: true}))
+		after := assignKeys(strategy, keys, added)
+		moved := 0
+		for _, key := range keys {
+			if before[key] != after[key] {
+				moved++
+				if after[key] != added[5] {
+					t.Errorf("key %s moved between existing routes", key)
+				}
+			}
+		}
+		if share := float64(moved) / float64(len(keys)); share > 0.3 {
+			t.Errorf("too many keys moved on route added: %.2f", share)
+		}
+	})
+
+	t.Run("Minimal movement on route removed", func(t *testing.T) {
+		strategy := &consistentHash{}
+		routes := newTestRoutes(1, 1, 1, 1, 1)
+		before := assignKeys(strategy, keys, routes)
+		removed := append(append([]*Route{}, routes[:2]...), routes[3:]...)
+		after := assignKeys(strategy, keys, removed)
+		for _, key := range keys {
+			if before[key] != routes[2] && before[key] != after[key] {
+				t.Errorf("key %s of remaining route moved", key)
+			}
+		}
+	})
+
+	t.Run("Unhealthy route skipped to the next node", func(t *testing.T) {
+		strategy := &consistentHash{}
+		routes := newTestRoutes(1, 1, 1)
+		before := assignKeys(strategy, keys, routes)
+		routes[1].healthy.Store(false)
+		during := assignKeys(strategy, keys, routes)
+		for _, key := range keys {
+			if during[key] == routes[1] {
+				t.Fatalf("unhealthy route selected for key %s", key)
+			}
+			if before[key] != routes[1] && before[key] != during[key] {
+				t.Errorf("key %s of healthy route moved", key)
+			}
+		}
+		routes[1].healthy.Store(true)
+		recovered := assignKeys(strategy, keys, routes)
+		for _, key := range keys {
+			if before[key] != recovered[key] {
+				t.Errorf("key %s did not return to the recovered route", key)
+			}
+		}
+	})
+
+	t.Run("Session key", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+		if key := sessionKey(server, HashKeyRemoteIP); key != "pipe" {
+			t.Errorf("remote address should be used as the key, got: %s", key)
+		}
+		// Certificate properties are not available for plain connections
+		if key := sessionKey(server, HashKeyCertSerial); key != "pipe" {
+			t.Errorf("remote address should be used as the fallback key, got: %s", key)
+		}
+		if err := validateHashKey("unknown"); err == nil {
+			t.Errorf("unknown hash key should fail validation")
+		}
+	})
+}
@@ -0,0 +1,194 @@
+package xlb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ErrRouteNotFound is returned for the operations on the route the pool does not have
+var ErrRouteNotFound = errors.New("route does not exist")
+
+// PoolStatus describes the pool and the state of its routes
+type PoolStatus struct {
+	Identity    string   `json:"identity"`
+	Port        int      `json:"port"`
+	ServerNames []string `json:"server_names,omitempty"`
+	Strategy    string   `json:"strategy"`
+	// Pool is served, routes report the configuration only if not
+	Serving  bool          `json:"serving"`
+	Sessions int           `json:"sessions"`
+	Routes   []RouteStatus `json:"routes"`
+}
+
+// RouteStatus describes the route of the pool
+type RouteStatus struct {
+	Address        string `json:"address"`
+	Active         bool   `json:"active"`
+	Healthy        bool   `json:"healthy"`
+	Connections    uint32 `json:"connections"`
+	Weight         int    `json:"weight"`
+	MaxConnections int    `json:"max_connections"`
+}
+
+// Pools provides the status of all the pools ordered by the identity
+func (lb *LoadBalancer) Pools() []PoolStatus {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	statuses := make([]PoolStatus, 0, len(lb.poolMap))
+	for identity, pool := range lb.poolMap {
+		status := PoolStatus{
+			Identity:    identity,
+			Port:        pool.Port(),
+			ServerNames: pool.ServerNames(),
+			Strategy:    pool.StrategyName(),
+			Routes:      make([]RouteStatus, 0, len(pool.Routes())),
+		}
+		if fwd, ok := lb.forwarderMap[identity]; ok {
+			status.Serving = true
+			status.Strategy = fwd.currentStrategyName()
+			status.Sessions = fwd.sessionCount()
+			for _, rte := range fwd.currentRoutes() {
+				status.Routes = append(status.Routes, RouteStatus{
+					Address:        rte.Address(),
+					Active:         rte.Active(),
+					Healthy:        rte.Healthy(),
+					Connections:    rte.Connections(),
+					Weight:         rte.Weight(),
+					MaxConnections: rte.MaxConnections(),
+				})
+			}
+		} else {
+			for _, rte := range pool.Routes() {
+				status.Routes = append(status.Routes, RouteStatus{
+					Address:        rte.Path(),
+					Active:         rte.Active(),
+					Weight:         rte.Weight(),
+					MaxConnections: rte.MaxConnections(),
+				})
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Identity < statuses[j].Identity })
+	return statuses
+}
+
+// SetRouteActive enables or disables the route of the pool, sessions of the disabled
+// route are given the pool drain window to complete. Route stays in the pool
+// configuration and can be enabled back
+func (lb *LoadBalancer) SetRouteActive(identity, address string, active bool) error {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	return lb.setRouteActive(identity, address, active)
+}
+
+// DrainRoute disables the route of the pool and waits for its sessions to complete
+// until ctx ends, sessions still running after that are force-closed. The pool drain
+// window does not apply to the sessions of the route drained
+func (lb *LoadBalancer) DrainRoute(ctx context.Context, identity, address string) (DrainReport, error) {
+	lb.mutex.Lock()
+	fwd, ok := lb.forwarderMap[identity]
+	if ok {
+		release := fwd.holdDrain(address)
+		defer release()
+	}
+	if err := lb.setRouteActive(identity, address, false); err != nil {
+		lb.mutex.Unlock()
+		return DrainReport{}, err
+	}
+	lb.mutex.Unlock()
+	if !ok {
+		return DrainReport{}, nil
+	}
+	return fwd.DrainRoute(ctx, address), nil
+}
+
+// setRouteActive expects lb.mutex to be held by the caller
+func (lb *LoadBalancer) setRouteActive(identity, address string, active bool) error {
+	pool, ok := lb.poolMap[identity]
+	if !ok {
+		return fmt.Errorf("pool %s, error: %w", identity, ErrPoolNotFound)
+	}
+	// Routes are copied for the pool provided by the caller not to change
+	routes := make([]ServicePoolRoute, len(pool.SvcRoutes))
+	copy(routes, pool.SvcRoutes)
+	found := false
+	for i := range routes {
+		if routes[i].Path() == address {
+			routes[i].ServiceActive = active
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("route %s of pool %s, error: %w", address, identity, ErrRouteNotFound)
+	}
+	updated := pool
+	updated.SvcRoutes = routes
+	return lb.updatePool(pool, updated)
+}
+
+// Blocklist provides the addresses tracked by the blocklist which are not expired,
+// from the most to the least recently updated
+func (lb *LoadBalancer) Blocklist() []CacheEntry {
+	now := time.Now()
+	entries := lb.ipLRU.Entries()
+	alive := entries[:0]
+	for _, entry := range entries {
+		if entry.ExpiresAt.After(now) {
+			alive = append(alive, entry)
+		}
+	}
+	return alive
+}
+
+// Unblock removes the address or the prefix from the blocklist, returns false if it
+// was not tracked. Entries kept by the SharedBlocklistStore are restored on the next sync
+// until they expire in the store
+func (lb *LoadBalancer) Unblock(address string) bool {
+	if _, ok := lb.ipLRU.Get(address); !ok {
+		return false
+	}
+	lb.ipLRU.Invalidate(address)
+	return true
+}
+
+// ClearBlocklist removes all the entries of the blocklist, returns the count of entries removed
+func (lb *LoadBalancer) ClearBlocklist() int {
+	entries := lb.ipLRU.Entries()
+	for _, entry := range entries {
+		lb.ipLRU.Invalidate(entry.IP)
+	}
+	return len(entries)
+}
+
+// Sessions provides the sessions forwarded by all the pools
+func (lb *LoadBalancer) Sessions() []SessionInfo {
+	lb.mutex.Lock()
+	forwarders := make([]*Forwarder, 0, len(lb.forwarderMap))
+	for _, fwd := range lb.forwarderMap {
+		forwarders = append(forwarders, fwd)
+	}
+	lb.mutex.Unlock()
+	sessions := make([]SessionInfo, 0)
+	for _, fwd := range forwarders {
+		sessions = append(sessions, fwd.Sessions()...)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].Pool != sessions[j].Pool {
+			return sessions[i].Pool < sessions[j].Pool
+		}
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions
+}
+
+// KillSession force-closes the session of the pool, returns false if the session is not forwarded
+func (lb *LoadBalancer) KillSession(identity string, id uint64) bool {
+	lb.mutex.Lock()
+	fwd, ok := lb.forwarderMap[identity]
+	lb.mutex.Unlock()
+	return ok && fwd.KillSession(id)
+}
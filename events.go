@@ -0,0 +1,127 @@
+package xlb
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventType names the security and routing events emitted by the balancer
+type EventType string
+
+const (
+	EventIPBlocked         EventType = "ip-blocked"
+	EventRateLimited       EventType = "rate-limit-exceeded"
+	EventConnectionLimited EventType = "connection-limit-exceeded"
+	EventHandshakeFailed   EventType = "handshake-failed"
+	EventIdentityMismatch  EventType = "identity-mismatch"
+	EventRouteUnhealthy    EventType = "route-unhealthy"
+	EventRouteRecovered    EventType = "route-recovered"
+	EventPoolUpdated       EventType = "pool-updated"
+	EventSessionOpened     EventType = "session-opened"
+	EventSessionClosed     EventType = "session-closed"
+)
+
+const defaultSubscriptionBuffer = 256
+
+// Event describes what happened in the balancer, fields not related to the event are empty
+type Event struct {
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+	// Identity of the pool
+	Pool string `json:"pool,omitempty"`
+	// Port the connection was accepted at
+	Port int `json:"port,omitempty"`
+	// Host of the client
+	Address string `json:"address,omitempty"`
+	// Identity presented by the client certificate
+	Identity string `json:"identity,omitempty"`
+	// Address of the route
+	Route string `json:"route,omitempty"`
+	// Why the event happened, like the limit exceeded or the handshake error
+	Reason string `json:"reason,omitempty"`
+	// Duration of the closed session or the block time of the blocked address
+	Duration time.Duration `json:"duration,omitempty"`
+}
+
+// EventBus delivers the events to the subscribers, events never wait for the subscribers,
+// events not fitting the subscription buffer are dropped and counted
+type EventBus struct {
+	mutex       sync.RWMutex
+	subscribers map[*Subscription]struct{}
+}
+
+// NewEventBus creates the bus without subscribers
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: map[*Subscription]struct{}{}}
+}
+
+// Subscription receives the events of the types it was subscribed to
+type Subscription struct {
+	bus     *EventBus
+	events  chan Event
+	types   map[EventType]struct{}
+	dropped atomic.Uint64
+	closed  bool
+}
+
+// Subscribe creates the subscription buffering up to buffer events (256 default),
+// subscription receives events of the types provided or all the events if none provided
+func (b *EventBus) Subscribe(buffer int, types ...EventType) *Subscription {
+	if buffer <= 0 {
+		buffer = defaultSubscriptionBuffer
+	}
+	sub := &Subscription{bus: b, events: make(chan Event, buffer)}
+	if len(types) > 0 {
+		sub.types = make(map[EventType]struct{}, len(types))
+		for _, t := range types {
+			sub.types[t] = struct{}{}
+		}
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.subscribers[sub] = struct{}{}
+	return sub
+}
+
+// Emit delivers the event to every subscription without blocking, nil bus drops the event
+func (b *EventBus) Emit(event Event) {
+	if b == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	for sub := range b.subscribers {
+		if sub.types != nil {
+			if _, ok := sub.types[event.Type]; !ok {
+				continue
+			}
+		}
+		select {
+		case sub.events <- event:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// Events provides the channel of the events, channel is closed once subscription closed
+func (s *Subscription) Events() <-chan Event { return s.events }
+
+// Dropped provides the count of the events which did not fit the buffer
+func (s *Subscription) Dropped() uint64 { return s.dropped.Load() }
+
+// Close stops the delivery of the events to the subscription
+func (s *Subscription) Close() {
+	s.bus.mutex.Lock()
+	defer s.bus.mutex.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	delete(s.bus.subscribers, s)
+	close(s.events)
+}
@@ -0,0 +1,127 @@
+package xlb
+
+import (
+	"context"
+	"github.com/rs/zerolog"
+	"github.com/xdire/xlb/httputil"
+	"github.com/xdire/xlb/tlsutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestEventBus
+// Will test that subscriptions receive only the subscribed event types and overflow is counted
+func TestEventBus(t *testing.T) {
+	bus := NewEventBus()
+	all := bus.Subscribe(2)
+	blocked := bus.Subscribe(10, EventIPBlocked)
+
+	bus.Emit(Event{Type: EventIPBlocked, Address: "10.0.0.1"})
+	bus.Emit(Event{Type: EventRateLimited, Pool: "pool"})
+	bus.Emit(Event{Type: EventIPBlocked, Address: "10.0.0.2"})
+
+	if all.Dropped() != 1 {
+		t.Errorf("event not fitting the buffer should be dropped, dropped: %d", all.Dropped())
+	}
+	if len(blocked.Events()) != 2 {
+		t.Fatalf("filtered subscription should receive 2 events, received: %d", len(blocked.Events()))
+	}
+	event := <-blocked.Events()
+	if event.Type != EventIPBlocked || event.Address != "10.0.0.1" || event.Time.IsZero() {
+		t.Errorf("unexpected event %+v", event)
+	}
+
+	all.Close()
+	all.Close()
+	bus.Emit(Event{Type: EventIPBlocked})
+	for range all.Events() {
+	}
+	if len(blocked.Events()) != 2 {
+		t.Errorf("open subscription should keep receiving after the other one closed")
+	}
+
+	var nilBus *EventBus
+	nilBus.Emit(Event{Type: EventIPBlocked})
+}
+
+// TestForwarderRouteEvents
+// Will test that forwarder emits the route health changes of its pool
+func TestForwarderRouteEvents(t *testing.T) {
+	bus := NewEventBus()
+	sub := bus.Subscribe(10, EventRouteUnhealthy)
+	fwd := NewForwarder(ServicePool{
+		SvcIdentity: "pool",
+		SvcRoutes:   []ServicePoolRoute{{ServicePath: "127.0.0.1:1", ServiceActive: true}},
+	}, zerolog.Nop()).withEvents(bus)
+	defer fwd.Close()
+
+	fwd.health.AddUnhealthy(context.Background(), fwd.currentRoutes()[0], time.Millisecond*100)
+	select {
+	case event := <-sub.Events():
+		if event.Pool != "pool" || event.Route != "127.0.0.1:1" {
+			t.Errorf("unexpected event %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("route marked unhealthy should be emitted")
+	}
+}
+
+// TestLoadBalancerConnectionLimitEvent
+// Will test that session rejected by the connection cap is emitted as connection limited
+// rather than rate limited
+func TestLoadBalancerConnectionLimitEvent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err := tlsutil.CreateLocalTLSData("test")
+	defer func() {
+		_, err := tlsutil.WipeLocalTLSData("./")
+		if err != nil {
+			t.Error("cannot clean pre-arranged test files")
+		}
+	}()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := os.ReadFile("server.crt")
+	key, _ := os.ReadFile("server.key")
+	ca, _ := os.ReadFile("ca.crt")
+
+	address, stop := startEchoServer(t)
+	defer stop()
+	lb, err := NewLoadBalancer(ctx, []ServicePool{{
+		SvcIdentity:        "test",
+		SvcPort:            9195,
+		SvcRoutes:          []ServicePoolRoute{{ServicePath: address, ServiceActive: true}},
+		Certificate:        string(cert),
+		CertKey:            string(key),
+		CACert:             string(ca),
+		SvcConnectionLimit: ConnectionLimit{MaxConnections: 1},
+	}}, Options{})
+	if err != nil {
+		t.Fatalf("cannot configure load balancer, error: %+v", err)
+	}
+	limited := lb.Events().Subscribe(10, EventConnectionLimited, EventRateLimited)
+	go lb.Listen()
+	<-time.After(time.Millisecond * 500)
+	fwd, ok := lb.forwarder("test")
+	if !ok {
+		t.Fatalf("pool should be served")
+	}
+
+	// Session taking the only slot of the pool
+	session, _ := attachSession(t, fwd)
+	defer session.Close()
+	if _, err = httputil.SendTestRequest("https://localhost:9195/api"); err == nil {
+		t.Errorf("session above the pool cap should be rejected")
+	}
+	select {
+	case event := <-limited.Events():
+		if event.Type != EventConnectionLimited || event.Pool != "test" || event.Reason == "" {
+			t.Errorf("unexpected event %+v", event)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatalf("session rejected by the cap should be emitted")
+	}
+}
@@ -0,0 +1,145 @@
+package xlb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultEventSinkTimeout = time.Second * 5
+
+// EventSink delivers the events outside of the balancer
+type EventSink interface {
+	Send(ctx context.Context, event Event) error
+}
+
+// LogSink writes every event as the log line
+type LogSink struct {
+	logger zerolog.Logger
+}
+
+// NewLogSink creates the sink writing the events to the logger at info level
+func NewLogSink(logger zerolog.Logger) *LogSink {
+	return &LogSink{logger: logger}
+}
+
+func (l *LogSink) Send(_ context.Context, event Event) error {
+	entry := l.logger.Info().Str("event", string(event.Type)).Time("at", event.Time)
+	if event.Pool != "" {
+		entry = entry.Str("pool", event.Pool)
+	}
+	if event.Port != 0 {
+		entry = entry.Int("port", event.Port)
+	}
+	if event.Address != "" {
+		entry = entry.Str("address", event.Address)
+	}
+	if event.Identity != "" {
+		entry = entry.Str("identity", event.Identity)
+	}
+	if event.Route != "" {
+		entry = entry.Str("route", event.Route)
+	}
+	if event.Duration != 0 {
+		entry = entry.Dur("duration", event.Duration)
+	}
+	entry.Msg(event.Reason)
+	return nil
+}
+
+// WebhookSink posts every event as JSON to the URL
+type WebhookSink struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookSink creates the sink posting to the URL, nil client resolves to
+// the client with 5s timeout
+func NewWebhookSink(url string, client *http.Client) *WebhookSink {
+	if client == nil {
+		client = &http.Client{Timeout: defaultEventSinkTimeout}
+	}
+	return &WebhookSink{url: url, client: client}
+}
+
+func (w *WebhookSink) Send(ctx context.Context, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot post event to webhook, error: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// JSONLSink appends every event as the JSON line to the file
+type JSONLSink struct {
+	mutex   sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// NewJSONLSink opens the file for appending the events, file is created if missing
+func NewJSONLSink(path string) (*JSONLSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open events file, error: %w", err)
+	}
+	return &JSONLSink{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+func (j *JSONLSink) Send(_ context.Context, event Event) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.encoder.Encode(event)
+}
+
+// Close closes the file
+func (j *JSONLSink) Close() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.file.Close()
+}
+
+// AttachSink subscribes the sink to the events of the types provided (all the events if
+// none provided) and delivers them until the balancer context ends or the subscription
+// is closed, events failed to be delivered are logged and skipped
+func (lb *LoadBalancer) AttachSink(sink EventSink, buffer int, types ...EventType) *Subscription {
+	sub := lb.events.Subscribe(buffer, types...)
+	go func() {
+		for {
+			select {
+			case <-lb.runCtx.Done():
+				sub.Close()
+				return
+			case event, ok := <-sub.Events():
+				if !ok {
+					return
+				}
+				ctx, cancel := context.WithTimeout(lb.runCtx, defaultEventSinkTimeout)
+				if err := sink.Send(ctx, event); err != nil {
+					lb.logger.Err(err).Msgf("cannot deliver %s event", event.Type)
+				}
+				cancel()
+			}
+		}
+	}()
+	return sub
+}
@@ -0,0 +1,92 @@
+package xlb
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestJSONLSink
+// Will test that every event is appended to the file as the JSON line
+func TestJSONLSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	sink, err := NewJSONLSink(path)
+	if err != nil {
+		t.Fatalf("cannot open sink, error: %+v", err)
+	}
+	for _, address := range []string{"10.0.0.1", "10.0.0.2"} {
+		if err = sink.Send(context.Background(), Event{Type: EventIPBlocked, Address: address}); err != nil {
+			t.Fatalf("cannot send event, error: %+v", err)
+		}
+	}
+	if err = sink.Close(); err != nil {
+		t.Fatalf("cannot close sink, error: %+v", err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("cannot open events file, error: %+v", err)
+	}
+	defer file.Close()
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		event := Event{}
+		if err = json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("cannot parse event line, error: %+v", err)
+		}
+		if event.Type != EventIPBlocked {
+			t.Errorf("unexpected event %+v", event)
+		}
+		lines++
+	}
+	if lines != 2 {
+		t.Errorf("file should have 2 events, found: %d", lines)
+	}
+}
+
+// TestWebhookSinkAttached
+// Will test that sink attached to the balancer receives the events of the subscribed types
+func TestWebhookSinkAttached(t *testing.T) {
+	received := make(chan Event, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		event := Event{}
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- event
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lb := &LoadBalancer{runCtx: ctx, events: NewEventBus()}
+	lb.AttachSink(NewWebhookSink(server.URL, nil), 0, EventRateLimited)
+
+	lb.events.Emit(Event{Type: EventIPBlocked, Address: "10.0.0.1"})
+	lb.events.Emit(Event{Type: EventRateLimited, Pool: "pool", Reason: "pool rate quota"})
+	select {
+	case event := <-received:
+		if event.Type != EventRateLimited || event.Pool != "pool" {
+			t.Errorf("unexpected event %+v", event)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatalf("webhook should receive the event")
+	}
+
+	failing := NewWebhookSink(server.URL+"/missing", nil)
+	if err := failing.Send(context.Background(), Event{Type: EventIPBlocked}); err == nil {
+		t.Errorf("webhook responding with error status should fail the delivery")
+	}
+}
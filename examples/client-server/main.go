@@ -33,6 +33,7 @@ func main() {
 	rateDuration := flag.Duration("rate-duration", time.Second, "Rate duration for the load balancer")
 	serverCert := flag.String("server-cert", "server.crt", "Server certificate file for the load balancer")
 	serverKey := flag.String("server-key", "server.key", "Server key file for the load balancer")
+	caCert := flag.String("ca-cert", "ca.crt", "CA certificate file issuing the client certificates")
 	routesStr := flag.String("routes", "", "Routes for the load balancer in the format 'localhost:9081,localhost:9082,localhost:9083'")
 
 	// Flag for launching the SDK client
@@ -94,16 +95,24 @@ func main() {
 			return
 		}
 
+		ca, err := os.ReadFile(*caCert)
+		if err != nil {
+			log.Fatalf("no ca certificate")
+			return
+		}
+
 		balancer, err := xlb.NewLoadBalancer(ctx, []xlb.ServicePool{{
-			SvcIdentity:          "test",
+			SvcIdentity:          *identity,
 			SvcPort:              *port,
 			SvcRateQuotaTimes:    *rateQuota,
 			SvcRateQuotaDuration: *rateDuration,
 			SvcRoutes:            pRoutes,
 			Certificate:          string(cert),
 			CertKey:              string(key),
+			CACert:               string(ca),
 		}}, xlb.Options{LogLevel: "debug"})
 		if err != nil {
+			log.Fatalf("cannot create load balancer, error: %+v", err)
 			return
 		}
 
@@ -6,9 +6,8 @@ import (
 	"fmt"
 	"github.com/rs/zerolog"
 	"io"
-	"math"
 	"net"
-	"strings"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -16,73 +15,242 @@ import (
 
 const (
 	closedNetworkConnection = "use of closed network connection"
+	defaultDrainTimeout     = time.Second * 30
 )
 
-type route struct {
+// ErrForwarderClosed rejects the session attached after the forwarder was closed
+var ErrForwarderClosed = errors.New("forwarder is closed")
+
+// DrainReport describes the outcome of draining the forwarded sessions
+type DrainReport struct {
+	// Sessions which completed on their own within the drain window
+	Drained int
+	// Sessions which were force-closed at the end of the drain window
+	Killed int
+}
+
+// Add sums reports of the multiple drains
+func (d DrainReport) Add(other DrainReport) DrainReport {
+	return DrainReport{Drained: d.Drained + other.Drained, Killed: d.Killed + other.Killed}
+}
+
+// session is the single client connection forwarded to the route
+type session struct {
+	id      uint64
+	client  string
+	started time.Time
+	route   *Route
+	in      io.Closer
+	out     io.Closer
+	done    chan struct{}
+	killed  atomic.Bool
+}
+
+// SessionInfo describes the session forwarded by the pool
+type SessionInfo struct {
+	// Identifier of the session unique within the pool
+	ID uint64 `json:"id"`
+	// Identity of the pool
+	Pool string `json:"pool"`
+	// Address of the route the session is forwarded to
+	Route string `json:"route"`
+	// Host of the client
+	Client    string    `json:"client"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// kill force-closes both sides of the session, returns false if session was already killed
+func (s *session) kill() bool {
+	if !s.killed.CompareAndSwap(false, true) {
+		return false
+	}
+	s.in.Close()
+	s.out.Close()
+	return true
+}
+
+// Route is the upstream of the Forwarder, route state is maintained by the forwarder
+// and its health check scheduler and can be observed by the Strategy
+type Route struct {
 	address     string
 	healthy     atomic.Bool
 	connections uint32
 	active      atomic.Bool
+	weight      atomic.Int32
+	failures    atomic.Int32
+	maxConns    atomic.Int32
+	// Unix milliseconds the ejection of the route ends at
+	ejectedUntil atomic.Int64
+}
+
+func newRoute(rte ServicePoolRoute) *Route {
+	r := &Route{
+		address:     rte.Path(),
+		healthy:     atomic.Bool{},
+		connections: 0,
+		active:      atomic.Bool{},
+	}
+	r.weight.Store(int32(rte.Weight()))
+	r.maxConns.Store(int32(rte.MaxConnections()))
+	r.active.Store(rte.Active())
+	r.healthy.Store(true)
+	return r
+}
+
+// Address of the upstream
+func (r *Route) Address() string { return r.address }
+
+// Connections currently forwarded to the upstream
+func (r *Route) Connections() uint32 { return atomic.LoadUint32(&r.connections) }
+
+// Healthy reports false while route is watched by the health check scheduler
+func (r *Route) Healthy() bool { return r.healthy.Load() }
+
+// Active reports false if route was deactivated or removed from the pool
+func (r *Route) Active() bool { return r.active.Load() }
+
+// Weight of the route, 1 or greater
+func (r *Route) Weight() int { return int(r.weight.Load()) }
+
+// MaxConnections the route accepts at once, 0 is unlimited
+func (r *Route) MaxConnections() int { return int(r.maxConns.Load()) }
+
+// Available reports if route can accept new sessions
+func (r *Route) Available() bool { return r.active.Load() && r.healthy.Load() && !r.full() }
+
+// full reports if route reached its connection cap
+func (r *Route) full() bool {
+	max := r.maxConns.Load()
+	return max > 0 && atomic.LoadUint32(&r.connections) >= uint32(max)
+}
+
+// acquire counts the new session of the route if the route is below its connection cap
+func (r *Route) acquire() bool {
+	for {
+		conns := atomic.LoadUint32(&r.connections)
+		if max := r.maxConns.Load(); max > 0 && conns >= uint32(max) {
+			return false
+		}
+		if atomic.CompareAndSwapUint32(&r.connections, conns, conns+1) {
+			return true
+		}
+	}
 }
 
 type Forwarder struct {
-	routes      *[]*route
-	mutex       sync.RWMutex
-	updateLock  bool
-	strategy    leastConnection
-	logger      zerolog.Logger
-	dialTimeout time.Duration
-	health      *HealthCheckScheduler
+	routes       *[]*Route
+	mutex        sync.RWMutex
+	updateLock   bool
+	strategy     Strategy
+	strategyName string
+	hashKey      string
+	logger       zerolog.Logger
+	dialTimeout  time.Duration
+	drainTimeout time.Duration
+	health       *HealthCheckScheduler
+	outlier      OutlierDetection
+	ejectMu      sync.Mutex
+	retry        RetryPolicy
+	retries      retryBudget
+	connLimit    ConnectionLimit
+	poolConns    connectionSemaphore
+	clientConns  keyedSemaphores
+	routeQueue   waitQueue
+	bandwidth    *bandwidthLimiter
+	sessions     map[*session]struct{}
+	sessionsMu   sync.Mutex
+	nextSession  atomic.Uint64
+	identity     string
+	events       atomic.Pointer[EventBus]
+	metrics      atomic.Pointer[Metrics]
+	ctx          context.Context
+	cancel       context.CancelFunc
+	// Routes which sessions are drained by the caller instead of the pool drain window
+	drainHeld map[string]int
+	// Sessions are not tracked anymore once forwarder is closed, guarded by sessionsMu
+	closed bool
 }
 
 // NewForwarder creates load balancer forwarder that can be used to
 // establish proxy communication between client and destination, adding
 // some features like: the least loaded server balancing, health check
-// routing, dynamic route update
+// routing, dynamic route update, draining of the removed routes
 func NewForwarder(params ServicePool, logger zerolog.Logger) *Forwarder {
-	rescheduleTime := params.HealthCheckRescheduleMs()
-	if rescheduleTime == 0 {
-		rescheduleTime = 5000
-	}
+	ctx, cancel := context.WithCancel(context.Background())
 	fwd := &Forwarder{
-		routes: &[]*route{},
-		logger: logger,
-		health: NewHealthCheckScheduler(HealthSchedulerOptions{
-			MaxItems:        len(params.Routes()) * 2,
-			Logger:          logger,
-			ReleaseChecks:   params.HealthCheckValidations(),
-			CheckIntervalMs: rescheduleTime,
-			MaxWatchers:     len(params.Routes()),
-		}),
-	}
-	// Add strategy linking the forwarder
-	fwd.strategy = leastConnection{fwd}
+		routes:    &[]*Route{},
+		logger:    logger,
+		sessions:  map[*session]struct{}{},
+		drainHeld: map[string]int{},
+		identity:  params.Identity(),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+	healthOptions := poolHealthChecks(params)
+	healthOptions.MaxItems = len(params.Routes()) * 2
+	healthOptions.Logger = logger
+	healthOptions.MaxWatchers = len(params.Routes())
+	healthOptions.Probe = params.HealthProbe()
+	healthOptions.OnHealthChange = fwd.routeHealthChanged
+	healthOptions.OnCheck = func(rte *Route, took time.Duration, _ error) {
+		// Check completing after the route was removed does not restore its series
+		if rte.active.Load() {
+			fwd.metrics.Load().healthChecked(fwd.identity, rte.address, took)
+		}
+	}
+	fwd.health = NewHealthCheckScheduler(healthOptions)
+	// Add strategy selected for the pool
+	fwd.strategy, fwd.strategyName = poolStrategy(params, logger)
+	fwd.hashKey = params.HashKey()
 	// Default or provided timeout
 	dialTimeout := params.RouteTimeout()
 	if dialTimeout == 0 {
 		dialTimeout = time.Second * 30
 	}
 	fwd.dialTimeout = dialTimeout
+	fwd.drainTimeout = drainTimeoutOrDefault(params.DrainTimeout())
+	fwd.outlier = params.OutlierDetection()
+	fwd.retry = params.RetryPolicy()
+	fwd.connLimit = params.ConnectionLimit()
+	fwd.bandwidth = newBandwidthLimiter(params.Bandwidth(), nil)
 	// Assign routes
 	for _, rte := range params.Routes() {
 		if !rte.Active() {
 			continue
 		}
-		*fwd.routes = append(*fwd.routes, func() *route {
-			r := &route{
-				address:     rte.Path(),
-				healthy:     atomic.Bool{},
-				connections: 0,
-				active:      atomic.Bool{},
-			}
-			r.active.Store(true)
-			r.healthy.Store(true)
-			return r
-		}())
+		r := newRoute(rte)
+		*fwd.routes = append(*fwd.routes, r)
+		fwd.health.Watch(fwd.ctx, r, fwd.dialTimeout)
 	}
 	return fwd
 }
 
+// withEvents makes the forwarder emit the route health and session events to the bus
+func (f *Forwarder) withEvents(events *EventBus) *Forwarder {
+	f.events.Store(events)
+	return f
+}
+
+// withMetrics makes the forwarder count the sessions of the pool
+func (f *Forwarder) withMetrics(metrics *Metrics) *Forwarder {
+	f.metrics.Store(metrics)
+	return f
+}
+
+// emit sends the event of the pool to the bus if forwarder has one
+func (f *Forwarder) emit(event Event) {
+	event.Pool = f.identity
+	f.events.Load().Emit(event)
+}
+
+func (f *Forwarder) routeHealthChanged(rte *Route, healthy bool, reason string) {
+	if healthy {
+		f.emit(Event{Type: EventRouteRecovered, Route: rte.address})
+		return
+	}
+	f.emit(Event{Type: EventRouteUnhealthy, Route: rte.address, Reason: reason})
+}
+
 // UpdateServicePool will update service pool merging the new pool routes
 // configuration with existing routes
 func (f *Forwarder) UpdateServicePool(pool ServicePool) {
@@ -90,140 +258,500 @@ func (f *Forwarder) UpdateServicePool(pool ServicePool) {
 	defer f.mutex.Unlock()
 
 	// Create the match map
-	currentPoolMap := map[string]*route{}
+	currentPoolMap := map[string]*Route{}
 	for _, rte := range *f.routes {
 		currentPoolMap[rte.address] = rte
 	}
 
-	newRoutePool := make([]*route, 0)
+	newRoutePool := make([]*Route, 0)
+	deactivated := make([]*Route, 0)
 	for _, poolRoute := range pool.Routes() {
 		// If route exists then change parameters and inherit current connection stage
 		if fwdRoute, exists := currentPoolMap[poolRoute.Path()]; exists {
-			fwdRoute.active.Store(poolRoute.Active())
+			fwdRoute.weight.Store(int32(poolRoute.Weight()))
+			fwdRoute.maxConns.Store(int32(poolRoute.MaxConnections()))
+			if fwdRoute.active.Swap(poolRoute.Active()) && !poolRoute.Active() {
+				deactivated = append(deactivated, fwdRoute)
+			}
 			newRoutePool = append(newRoutePool, fwdRoute)
 			delete(currentPoolMap, poolRoute.Path())
 			continue
 		}
 		// Create new otherwise
-		newRoutePool = append(newRoutePool, func() *route {
-			r := &route{
-				address:     poolRoute.Path(),
-				healthy:     atomic.Bool{},
-				connections: 0,
-				active:      atomic.Bool{},
-			}
-			r.active.Store(poolRoute.Active())
-			r.healthy.Store(true)
-			return r
-		}())
+		newRoutePool = append(newRoutePool, newRoute(poolRoute))
 	}
 	// For the routes not in the new update, mark inactive for the rest of the resources free them if holding the pointer
 	for _, rte := range currentPoolMap {
-		rte.active.Store(false)
+		if rte.active.Swap(false) {
+			deactivated = append(deactivated, rte)
+		}
+		f.metrics.Load().removeRoute(f.identity, rte.address)
 	}
 	f.routes = &newRoutePool
+	f.drainTimeout = drainTimeoutOrDefault(pool.DrainTimeout())
+	f.health.SetProbe(pool.HealthProbe())
+	f.health.SetChecks(poolHealthChecks(pool))
+	f.health.SetMaxWatchers(len(newRoutePool))
+	f.outlier = pool.OutlierDetection()
+	f.retry = pool.RetryPolicy()
+	f.connLimit = pool.ConnectionLimit()
+	f.bandwidth.update(pool.Bandwidth())
+	// Sessions waiting in the queues are woken up in case caps were raised
+	f.poolConns.queue.notify()
+	f.clientConns.notify()
+	f.routeQueue.notify()
+	// New and reactivated routes are probed if active health checks enabled
+	for _, rte := range newRoutePool {
+		if rte.active.Load() {
+			f.health.Watch(f.ctx, rte, f.dialTimeout)
+		}
+	}
+	if pool.StrategyFactory() != nil || pool.StrategyName() != f.strategyName {
+		f.strategy, f.strategyName = poolStrategy(pool, f.logger)
+	}
+	f.hashKey = pool.HashKey()
 	f.logger.Info().Msgf("forwarder routes updated to: %+v from: %+v", *f.routes, pool.Routes())
+
+	// Sessions of deactivated routes are given the drain window to complete
+	for _, rte := range deactivated {
+		if f.drainHeld[rte.address] > 0 {
+			continue
+		}
+		go func(rte *Route, timeout time.Duration) {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			report := f.drain(ctx, func(s *session) bool { return s.route == rte })
+			f.logger.Info().Msgf("route %s drained, sessions drained: %d killed: %d", rte.address, report.Drained, report.Killed)
+		}(rte, f.drainTimeout)
+	}
+}
+
+// poolHealthChecks provides the health checks settings of the pool
+func poolHealthChecks(pool ServicePool) HealthSchedulerOptions {
+	rescheduleTime := pool.HealthCheckRescheduleMs()
+	if rescheduleTime == 0 {
+		rescheduleTime = 5000
+	}
+	return HealthSchedulerOptions{
+		ReleaseChecks:         pool.HealthCheckValidations(),
+		CheckIntervalMs:       rescheduleTime,
+		ActiveCheckIntervalMs: pool.HealthCheckIntervalMs(),
+		FailureThreshold:      pool.HealthCheckFailures(),
+	}
+}
+
+// Close will stop routing new sessions through the forwarder marking all the routes
+// inactive and stops health checks for them. Sessions already attached are left to
+// complete, sessions still being attached are rejected with ErrForwarderClosed
+func (f *Forwarder) Close() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.sessionsMu.Lock()
+	f.closed = true
+	f.sessionsMu.Unlock()
+	for _, rte := range *f.routes {
+		rte.active.Store(false)
+	}
+	f.cancel()
+}
+
+// Drain waits for the sessions attached to the forwarder to complete until ctx ends,
+// sessions still running after that are force-closed. Drain does not prevent new
+// sessions to be attached, use Close to stop routing first, then every session
+// attached is reported
+func (f *Forwarder) Drain(ctx context.Context) DrainReport {
+	return f.drain(ctx, nil)
+}
+
+// DrainRoute waits for the sessions of the route to complete until ctx ends, sessions
+// still running after that are force-closed. Route should be deactivated first not to
+// take new sessions
+func (f *Forwarder) DrainRoute(ctx context.Context, address string) DrainReport {
+	return f.drain(ctx, func(s *session) bool { return s.route.address == address })
+}
+
+// holdDrain makes the routes of the address deactivated by the pool updates skip the
+// drain window of the pool until released, sessions are expected to be drained by the caller
+func (f *Forwarder) holdDrain(address string) (release func()) {
+	f.mutex.Lock()
+	f.drainHeld[address]++
+	f.mutex.Unlock()
+	return func() {
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		if f.drainHeld[address]--; f.drainHeld[address] <= 0 {
+			delete(f.drainHeld, address)
+		}
+	}
+}
+
+// Sessions provides the sessions forwarded at the moment ordered by the start
+func (f *Forwarder) Sessions() []SessionInfo {
+	f.sessionsMu.Lock()
+	sessions := make([]SessionInfo, 0, len(f.sessions))
+	for s := range f.sessions {
+		sessions = append(sessions, SessionInfo{
+			ID:        s.id,
+			Pool:      f.identity,
+			Route:     s.route.address,
+			Client:    s.client,
+			StartedAt: s.started,
+		})
+	}
+	f.sessionsMu.Unlock()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+	return sessions
+}
+
+func (f *Forwarder) sessionCount() int {
+	f.sessionsMu.Lock()
+	defer f.sessionsMu.Unlock()
+	return len(f.sessions)
+}
+
+// KillSession force-closes the session, returns false if session is not forwarded
+func (f *Forwarder) KillSession(id uint64) bool {
+	f.sessionsMu.Lock()
+	var found *session
+	for s := range f.sessions {
+		if s.id == id {
+			found = s
+			break
+		}
+	}
+	f.sessionsMu.Unlock()
+	return found != nil && found.kill()
+}
+
+// DrainTimeout provides the drain window configured for the forwarder
+func (f *Forwarder) DrainTimeout() time.Duration {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.drainTimeout
+}
+
+func (f *Forwarder) drain(ctx context.Context, match func(s *session) bool) DrainReport {
+	f.sessionsMu.Lock()
+	pending := make([]*session, 0, len(f.sessions))
+	for s := range f.sessions {
+		if match == nil || match(s) {
+			pending = append(pending, s)
+		}
+	}
+	f.sessionsMu.Unlock()
+
+	report := DrainReport{}
+	for _, s := range pending {
+		// Prefer completed session over the ended context if both are ready
+		select {
+		case <-s.done:
+			report.Drained++
+			continue
+		default:
+		}
+		select {
+		case <-s.done:
+			report.Drained++
+		case <-ctx.Done():
+			if s.kill() {
+				report.Killed++
+			}
+		}
+	}
+	return report
+}
+
+// transportResult is the end of the one direction of the session
+type transportResult struct {
+	err error
+	// Direction reading the upstream
+	upstream bool
+}
+
+// track registers the session for the drain, closed forwarder does not track the sessions
+func (f *Forwarder) track(rte *Route, in io.Closer, out io.Closer, client string) (*session, error) {
+	s := &session{
+		id:      f.nextSession.Add(1),
+		client:  client,
+		started: time.Now(),
+		route:   rte,
+		in:      in,
+		out:     out,
+		done:    make(chan struct{}),
+	}
+	f.sessionsMu.Lock()
+	defer f.sessionsMu.Unlock()
+	if f.closed {
+		return nil, ErrForwarderClosed
+	}
+	f.sessions[s] = struct{}{}
+	return s, nil
+}
+
+func (f *Forwarder) untrack(s *session) {
+	f.sessionsMu.Lock()
+	delete(f.sessions, s)
+	f.sessionsMu.Unlock()
+	close(s.done)
 }
 
 // Attach will attach some incoming session to the pool of upstream traffic distribution
 func (f *Forwarder) Attach(ctx context.Context, in io.ReadWriteCloser) error {
 
-	errTransport := make(chan error, 2)
+	errTransport := make(chan transportResult, 2)
 	defer in.Close()
 
-	var rte *route
+	var rte *Route
 	var dest net.Conn
 	var err error
 
-	// Find next available route for satisfy connection request or fail finding nothing
-	for {
-		rte = f.strategy.Next()
-		// If no routes found, meaning all unhealthy or non-active then  provide error
-		if rte == nil {
-			return fmt.Errorf("no active routes available")
+	// Sessions are keyed only for the strategies providing the affinity
+	strategy, hashKey := f.currentStrategy()
+	keyed, isKeyed := strategy.(KeyedStrategy)
+	key := ""
+	if isKeyed {
+		key = sessionKey(in, hashKey)
+	}
+
+	// Session is admitted within the connection caps of the pool and the client
+	limit := f.currentConnectionLimit()
+	admitCtx, cancelAdmit := context.WithTimeout(ctx, limit.queueTimeout())
+	defer cancelAdmit()
+	metrics := f.metrics.Load()
+	if err = f.poolConns.acquire(admitCtx, limit.MaxConnections, limit); err != nil {
+		metrics.connectionRejected(f.identity, rejectConnectionLimit)
+		return fmt.Errorf("pool sessions capped at %d, error: %w", limit.MaxConnections, err)
+	}
+	defer f.poolConns.release()
+	if limit.MaxClientConnections > 0 {
+		release, err := f.clientConns.acquire(admitCtx, sessionKey(in, limit.clientKey()), limit.MaxClientConnections, limit)
+		if err != nil {
+			metrics.connectionRejected(f.identity, rejectConnectionLimit)
+			return fmt.Errorf("client sessions capped at %d, error: %w", limit.MaxClientConnections, err)
+		}
+		defer release()
+	}
+	metrics.connectionAccepted(f.identity)
+	next := func(routes []*Route) *Route {
+		if isKeyed {
+			return keyed.NextFor(key, routes)
 		}
+		return strategy.Next(routes)
+	}
 
-		dest, err = net.DialTimeout("tcp", rte.address, f.dialTimeout)
+	// Find next available route for satisfy connection request, failing over to the other
+	// routes within the retry policy and the retry budget of the pool
+	retry, dialTimeout := f.currentRetryPolicy()
+	f.retries.deposit(retry)
+	deadline := time.Now().Add(retry.timeout(dialTimeout))
+	for attempt := 1; ; attempt++ {
+		rte, err = f.nextRoute(admitCtx, limit, next)
 		if err != nil {
-			f.logger.Err(err).Msgf("route unreachable %s", rte.address)
-			f.health.AddUnhealthy(ctx, rte, f.dialTimeout)
-			continue
+			return err
+		}
+
+		dialer := net.Dialer{Timeout: min(retry.connectTimeout(dialTimeout), time.Until(deadline))}
+		dialStarted := time.Now()
+		dest, err = dialer.DialContext(ctx, "tcp", rte.address)
+		// Route removed while dialing does not restore its series
+		if rte.active.Load() {
+			metrics.dialed(f.identity, rte.address, time.Since(dialStarted))
+		}
+		if err == nil {
+			// Exit loop on first valid route
+			break
+		}
+		f.releaseRoute(rte)
+		f.logger.Err(err).Msgf("route unreachable %s", rte.address)
+		f.health.AddUnhealthy(f.ctx, rte, dialTimeout)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if attempt >= retry.maxAttempts() {
+			return fmt.Errorf("routes unreachable after %d attempts, error: %w", attempt, err)
+		}
+		if time.Until(deadline) <= 0 {
+			return fmt.Errorf("routes unreachable within %s, error: %w", retry.timeout(dialTimeout), err)
+		}
+		if !f.retries.withdraw(retry) {
+			return fmt.Errorf("retry budget of the pool exhausted, error: %w", err)
 		}
-		// Exit loop on first valid route
-		break
 	}
 
 	defer dest.Close()
+	upstream := &upstreamConn{Conn: dest}
 
-	// Connection increment here as we reached destination
-	atomic.AddUint32(&rte.connections, 1)
+	// Track the session to be able to drain it
+	address := sessionKey(in, HashKeyRemoteIP)
+	s, err := f.track(rte, in, dest, address)
+	if err != nil {
+		f.releaseRoute(rte)
+		return err
+	}
+	defer f.untrack(s)
+
+	// Connection was counted as route selected, decrement as all pipes are closed
+	strategy.Opened(rte)
+	defer func() {
+		f.releaseRoute(rte)
+		strategy.Closed(rte)
+	}()
+	started := s.started
+	f.emit(Event{Type: EventSessionOpened, Address: address, Route: rte.address})
+	defer func() {
+		f.emit(Event{Type: EventSessionClosed, Address: address, Route: rte.address, Duration: time.Since(started)})
+	}()
+
+	// Both directions are shaped by the bandwidth of the pool and the client
+	shapeCtx, endShaping := context.WithCancel(ctx)
+	defer endShaping()
+	client, detach := f.bandwidth.attach(in)
+	defer detach()
+	bytesIn, bytesOut := metrics.transferCounters(f.identity)
 
 	go func(w io.WriteCloser, r io.ReadCloser) {
 		defer w.Close()
 		defer r.Close()
-		_, err := io.Copy(w, r)
-		errTransport <- err
-	}(dest, in)
+		_, err := io.Copy(countingWriter{Writer: w, counter: bytesIn}, r)
+		errTransport <- transportResult{err: err}
+	}(upstream, f.bandwidth.shape(shapeCtx, in, client, false))
 
 	go func(w io.WriteCloser, r io.ReadCloser) {
 		defer w.Close()
 		defer r.Close()
-		_, err := io.Copy(w, r)
-		errTransport <- err
-	}(in, dest)
+		_, err := io.Copy(countingWriter{Writer: w, counter: bytesOut}, r)
+		errTransport <- transportResult{err: err, upstream: true}
+	}(in, f.bandwidth.shape(shapeCtx, upstream, client, true))
 
 	var errs []error
+	upstreamEnded := false
 	for i := 0; i < 2; i++ {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case err = <-errTransport:
+		case res := <-errTransport:
+			// Side which ended the session first, the other side is not waiting for the bandwidth anymore
+			if i == 0 {
+				upstreamEnded = res.upstream
+				endShaping()
+			}
 			// If detected error, check that error has nature of a normal behavior in the system
 			// and will not affect the further behavior
-			if err != nil && !(errors.Is(err, io.EOF) || strings.Contains(err.Error(), closedNetworkConnection)) {
-				errs = append(errs, err)
+			if transportFailure(res.err) {
+				errs = append(errs, res.err)
 			}
 		}
 	}
-
-	// Connection decrement here as all pipes are closed by now
-	atomic.AddUint32(&rte.connections, ^uint32(0))
 	close(errTransport)
+
+	// Upstream breaking the transport or ending the session too soon is the outlier,
+	// sessions force-closed by the drain are not counted
+	if !s.killed.Load() {
+		if upstream.failed.Load() || upstreamEnded && time.Since(started) < f.currentOutlierDetection().MinSessionDuration {
+			f.sessionFailed(rte)
+		} else {
+			f.sessionSucceeded(rte)
+		}
+	}
 	if len(errs) > 0 {
 		return fmt.Errorf("forwarder attach closed with errors: %+v", errs)
 	}
 	return nil
 }
 
-type leastConnection struct {
-	fwd *Forwarder
+// nextRoute selects the route with next counting the session for the route, if all the
+// routes which can take the session are at their connection cap the session waits for
+// them to be released if the limit allows to queue
+func (f *Forwarder) nextRoute(ctx context.Context, limit ConnectionLimit, next func([]*Route) *Route) (*Route, error) {
+	var rte *Route
+	err := f.routeQueue.wait(ctx, limit, func() (bool, error) {
+		routes := f.currentRoutes()
+		// Route selected might reach its cap concurrently, then selection repeats
+		for i := 0; i <= len(routes); i++ {
+			rte = next(routes)
+			if rte == nil {
+				break
+			}
+			if rte.acquire() {
+				return true, nil
+			}
+		}
+		for _, route := range routes {
+			if route.Active() && route.Healthy() && route.full() {
+				return false, nil
+			}
+		}
+		// If no routes found, meaning all unhealthy or non-active then  provide error
+		return false, fmt.Errorf("no active routes available")
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rte, nil
 }
 
-// Next will make selection of the next route using the algorithm of least
-// utilization (from the standpoint of this system) of the host connectivity
-func (lc leastConnection) Next() *route {
-	minVal := uint32(math.MaxUint32)
+// releaseRoute stops counting the session for the route waking the sessions waiting for the route
+func (f *Forwarder) releaseRoute(rte *Route) {
+	atomic.AddUint32(&rte.connections, ^uint32(0))
+	f.routeQueue.notify()
+}
 
-	// Lock and unlock just to get access to the latest routes slice
-	// this delivers support for hot-reload of the routes by pointer refresh
-	// leastConnection might work for one cycle with outdated records
-	lc.fwd.mutex.RLock()
-	defer lc.fwd.mutex.RUnlock()
+// Lock and unlock just to get access to the latest routes slice
+// this delivers support for hot-reload of the routes by pointer refresh
+// strategy might work for one cycle with outdated records
+func (f *Forwarder) currentRoutes() []*Route {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return *f.routes
+}
 
-	var rte *route
-	for _, route := range *lc.fwd.routes {
-		if route.active.Load() && route.healthy.Load() {
-			conn := atomic.LoadUint32(&route.connections)
-			if conn < minVal {
-				minVal = conn
-				rte = route
-			}
-		}
+func (f *Forwarder) currentRetryPolicy() (RetryPolicy, time.Duration) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.retry, f.dialTimeout
+}
+
+func (f *Forwarder) currentOutlierDetection() OutlierDetection {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.outlier
+}
+
+func (f *Forwarder) currentConnectionLimit() ConnectionLimit {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.connLimit
+}
+
+func (f *Forwarder) currentStrategy() (Strategy, string) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.strategy, f.hashKey
+}
+
+func (f *Forwarder) currentStrategyName() string {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.strategyName
+}
+
+// poolStrategy creates strategy configured for the pool, falls back to the
+// least connections strategy if pool strategy is unknown
+func poolStrategy(pool ServicePool, logger zerolog.Logger) (Strategy, string) {
+	if factory := pool.StrategyFactory(); factory != nil {
+		return factory(), pool.StrategyName()
+	}
+	strategy, err := NewStrategy(pool.StrategyName())
+	if err != nil {
+		logger.Err(err).Msgf("pool %s falls back to %s strategy", pool.Identity(), StrategyLeastConnections)
+		strategy, _ = NewStrategy(StrategyLeastConnections)
+	}
+	return strategy, pool.StrategyName()
+}
+
+func drainTimeoutOrDefault(timeout time.Duration) time.Duration {
+	if timeout == 0 {
+		return defaultDrainTimeout
 	}
-	// @ManualTesting
-	// to observe the route to be dispatched in logs, uncomment following line
-	//if rte != nil {
-	//	fmt.Println(fmt.Sprintf("[FORWARDER][STRATEGY][TEST] route selected: %s %d %v", rte.address, rte.connections, rte.healthy.Load()))
-	//}
-	return rte
+	return timeout
 }
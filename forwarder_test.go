@@ -0,0 +1,153 @@
+package xlb
+
+import (
+	"context"
+	"github.com/rs/zerolog"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startEchoServer creates the upstream echoing everything back to the sender
+func startEchoServer(t *testing.T) (string, func()) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot start echo server, error: %+v", err)
+	}
+	go func() {
+		for {
+			conn, err := listen.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}(conn)
+		}
+	}()
+	return listen.Addr().String(), func() { _ = listen.Close() }
+}
+
+// attachSession attaches the new client session to forwarder returning the client
+// side of the session and the channel with the Attach result
+func attachSession(t *testing.T, fwd *Forwarder) (net.Conn, chan error) {
+	client, server := net.Pipe()
+	result := make(chan error, 1)
+	go func() {
+		result <- fwd.Attach(context.Background(), server)
+	}()
+	// Make the round trip to be sure session reached the upstream
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatalf("cannot write to session, error: %+v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatalf("cannot read from session, error: %+v", err)
+	}
+	return client, result
+}
+
+// TestForwarderDrain
+// Will test that completed sessions are reported drained and sessions running
+// after the drain window are force-closed
+func TestForwarderDrain(t *testing.T) {
+	address, stop := startEchoServer(t)
+	defer stop()
+
+	fwd := NewForwarder(ServicePool{
+		SvcIdentity: "test",
+		SvcRoutes:   []ServicePoolRoute{{ServicePath: address, ServiceActive: true}},
+	}, zerolog.Nop())
+
+	completing, completingResult := attachSession(t, fwd)
+	lingering, lingeringResult := attachSession(t, fwd)
+	defer lingering.Close()
+
+	go func() {
+		<-time.After(time.Millisecond * 100)
+		completing.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer cancel()
+	report := fwd.Drain(ctx)
+	if report.Drained != 1 || report.Killed != 1 {
+		t.Errorf("expected 1 drained and 1 killed session, got: %+v", report)
+	}
+
+	for _, result := range []chan error{completingResult, lingeringResult} {
+		select {
+		case <-result:
+		case <-time.After(time.Second):
+			t.Fatalf("session was not closed after drain")
+		}
+	}
+	if conn := atomic.LoadUint32(&(*fwd.routes)[0].connections); conn != 0 {
+		t.Errorf("route connections should be released, got: %d", conn)
+	}
+}
+
+// TestForwarderRouteDrainOnUpdate
+// Will test that sessions of the route removed by the update are force-closed
+// after the drain window of the pool
+func TestForwarderRouteDrainOnUpdate(t *testing.T) {
+	address, stop := startEchoServer(t)
+	defer stop()
+
+	pool := ServicePool{
+		SvcIdentity:     "test",
+		SvcRoutes:       []ServicePoolRoute{{ServicePath: address, ServiceActive: true}},
+		SvcDrainTimeout: time.Millisecond * 200,
+	}
+	fwd := NewForwarder(pool, zerolog.Nop())
+
+	client, result := attachSession(t, fwd)
+	defer client.Close()
+
+	pool.SvcRoutes = []ServicePoolRoute{}
+	fwd.UpdateServicePool(pool)
+
+	select {
+	case <-result:
+	case <-time.After(time.Second * 2):
+		t.Fatalf("session of removed route was not closed after drain window")
+	}
+}
+
+// TestForwarderWeightUpdate
+// Will test that weight of the existing route is updated in place
+// keeping the connections counted for the route
+func TestForwarderWeightUpdate(t *testing.T) {
+	pool := ServicePool{
+		SvcIdentity: "test",
+		SvcRoutes: []ServicePoolRoute{
+			{ServicePath: "localhost:9001", ServiceActive: true, ServiceWeight: 1},
+			{ServicePath: "localhost:9002", ServiceActive: true, ServiceWeight: 1},
+		},
+	}
+	fwd := NewForwarder(pool, zerolog.Nop())
+	first := (*fwd.routes)[0]
+	atomic.StoreUint32(&first.connections, 3)
+
+	pool.SvcRoutes[0].ServiceWeight = 8
+	fwd.UpdateServicePool(pool)
+
+	updated := (*fwd.routes)[0]
+	if updated != first {
+		t.Fatalf("existing route should be kept on update")
+	}
+	if updated.Weight() != 8 {
+		t.Errorf("route weight should be updated, got: %d", updated.Weight())
+	}
+	if updated.Connections() != 3 {
+		t.Errorf("route connections should be kept, got: %d", updated.Connections())
+	}
+	// 3 of 8 is less loaded than 1 of 1
+	atomic.StoreUint32(&(*fwd.routes)[1].connections, 1)
+	if rte := fwd.strategy.Next(fwd.currentRoutes()); rte != updated {
+		t.Errorf("strategy should respect updated weight")
+	}
+}
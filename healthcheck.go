@@ -5,7 +5,7 @@ import (
 	"context"
 	"fmt"
 	"github.com/rs/zerolog"
-	"net"
+	"math/rand"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -17,79 +17,306 @@ type HealthSchedulerOptions struct {
 	ReleaseChecks   int
 	CheckIntervalMs int
 	MaxWatchers     int
+	// Interval to probe healthy watched routes, 0 disables active checks
+	ActiveCheckIntervalMs int
+	// Consecutive failed probes before watched route marked unhealthy
+	FailureThreshold int
+	// Probe checking the routes, TCP connect default
+	Probe HealthProbe
+	// Delay of the first recovery check after route marked unhealthy (1000ms or CheckIntervalMs if less default)
+	BackoffInitialMs int
+	// Growth of the recovery check delay after every failed check (2 default)
+	BackoffMultiplier float64
+	// Cap of the recovery check delay (CheckIntervalMs default)
+	BackoffMaxMs int
+	// Fraction of the delay randomly taken off every check for the routes not being
+	// checked in lockstep, 0.2 default, negative disables the jitter
+	BackoffJitter float64
+	// Called every time the route is marked unhealthy or recovered, reason describes
+	// why the route was marked unhealthy
+	OnHealthChange func(rte *Route, healthy bool, reason string)
+	// Called after every probe of the route with the time the probe took
+	OnCheck func(rte *Route, took time.Duration, err error)
 }
 
 type HealthCheckScheduler struct {
-	Q             taskQueue
-	mu            sync.Mutex
-	ctx           context.Context
-	nextId        int64
-	isSleeping    int32
-	taskAdded     chan int
-	logger        zerolog.Logger
-	releaseChecks int
-	checkInterval int
-	maxWatchers   uint32
-	curWatchers   uint32
+	Q              taskQueue
+	mu             sync.Mutex
+	ctx            context.Context
+	nextId         int64
+	isSleeping     int32
+	taskAdded      chan int
+	logger         zerolog.Logger
+	maxWatchers    uint32
+	curWatchers    uint32
+	watched        map[*Route]*healthCheckItem
+	probe          atomic.Value
+	settings       atomic.Pointer[healthCheckSettings]
+	onHealthChange func(rte *Route, healthy bool, reason string)
+	onCheck        func(rte *Route, took time.Duration, err error)
 }
 
+// healthCheckSettings are the checks settings which can be changed while scheduler runs
+type healthCheckSettings struct {
+	releaseChecks       int
+	activeCheckInterval int
+	failureThreshold    int
+	backoffInitial      int
+	backoffMultiplier   float64
+	backoffMax          int
+	backoffJitter       float64
+}
+
+// probeHolder keeps the probes of different types in the same atomic.Value
+type probeHolder struct {
+	HealthProbe
+}
+
+// healthCheckItem is scheduled for the route either to recover it while route
+// is unhealthy, or to probe it periodically while route is healthy and watched
 type healthCheckItem struct {
-	exec     func() error
+	exec     func(ctx context.Context) error
 	failures int
 	success  int
-	route    *route
+	route    *Route
+	watched  bool
+	task     *taskItem
 }
 
 func NewHealthCheckScheduler(opt HealthSchedulerOptions) *HealthCheckScheduler {
 	maxItems := 16
-	releaseChecks := 1
-	checkIntervalMs := 5000
+	maxWatchers := 1
 
 	if opt.MaxItems > 0 {
 		maxItems = opt.MaxItems
 	}
+	if opt.MaxWatchers > 0 {
+		maxWatchers = opt.MaxWatchers
+	}
+	ts := &HealthCheckScheduler{
+		Q:              newTaskQueue(maxItems),
+		taskAdded:      make(chan int, 2),
+		logger:         opt.Logger,
+		maxWatchers:    uint32(maxWatchers),
+		watched:        map[*Route]*healthCheckItem{},
+		onHealthChange: opt.OnHealthChange,
+		onCheck:        opt.OnCheck,
+	}
+	ts.SetProbe(opt.Probe)
+	ts.settings.Store(newHealthCheckSettings(opt))
+	return ts
+}
+
+// newHealthCheckSettings resolves the checks settings of the options applying the defaults
+func newHealthCheckSettings(opt HealthSchedulerOptions) *healthCheckSettings {
+	releaseChecks := 1
+	checkIntervalMs := 5000
+	failureThreshold := 3
+
 	if opt.ReleaseChecks > 0 {
 		releaseChecks = opt.ReleaseChecks
 	}
 	if opt.CheckIntervalMs > 0 {
 		checkIntervalMs = opt.CheckIntervalMs
 	}
-	return &HealthCheckScheduler{
-		Q:             newTaskQueue(maxItems),
-		taskAdded:     make(chan int, 2),
-		logger:        opt.Logger,
-		releaseChecks: releaseChecks,
-		checkInterval: checkIntervalMs,
-		maxWatchers:   uint32(opt.MaxWatchers),
+	if opt.FailureThreshold > 0 {
+		failureThreshold = opt.FailureThreshold
+	}
+	backoffMax := checkIntervalMs
+	if opt.BackoffMaxMs > 0 {
+		backoffMax = opt.BackoffMaxMs
+	}
+	backoffInitial := min(1000, backoffMax)
+	if opt.BackoffInitialMs > 0 {
+		backoffInitial = min(opt.BackoffInitialMs, backoffMax)
+	}
+	backoffMultiplier := 2.0
+	if opt.BackoffMultiplier >= 1 {
+		backoffMultiplier = opt.BackoffMultiplier
+	}
+	backoffJitter := 0.2
+	if opt.BackoffJitter != 0 {
+		backoffJitter = min(opt.BackoffJitter, 1)
+	}
+	return &healthCheckSettings{
+		releaseChecks:       releaseChecks,
+		activeCheckInterval: max(opt.ActiveCheckIntervalMs, 0),
+		failureThreshold:    failureThreshold,
+		backoffInitial:      backoffInitial,
+		backoffMultiplier:   backoffMultiplier,
+		backoffMax:          backoffMax,
+		backoffJitter:       backoffJitter,
 	}
 }
 
-func (ts *HealthCheckScheduler) AddUnhealthy(ctx context.Context, rte *route, timeout time.Duration) {
+// SetMaxWatchers changes how many routes can be checked at once, running watchers
+// are not stopped by the lowered limit
+func (ts *HealthCheckScheduler) SetMaxWatchers(maxWatchers int) {
+	atomic.StoreUint32(&ts.maxWatchers, uint32(max(maxWatchers, 1)))
+}
+
+// SetChecks applies the checks settings of the options (release checks, intervals,
+// failure threshold and backoff) to the following checks, other options are ignored.
+// Watched routes stop being probed while healthy once active checks are disabled
+func (ts *HealthCheckScheduler) SetChecks(opt HealthSchedulerOptions) {
+	ts.settings.Store(newHealthCheckSettings(opt))
+}
+
+// SetProbe replaces the probe used for the following checks, nil resets to TCP connect probe
+func (ts *HealthCheckScheduler) SetProbe(probe HealthProbe) {
+	if probe == nil {
+		probe = TCPProbe{}
+	}
+	ts.probe.Store(probeHolder{probe})
+}
+
+// ActiveChecks reports if scheduler probes the watched routes while they are healthy
+func (ts *HealthCheckScheduler) ActiveChecks() bool {
+	return ts.settings.Load().activeCheckInterval > 0
+}
+
+// Watch will schedule periodic probing of the route, route will be marked unhealthy
+// after failure threshold reached and recovered after release checks passed, then
+// probing continues. Route is no longer watched once it becomes inactive
+func (ts *HealthCheckScheduler) Watch(ctx context.Context, rte *Route, timeout time.Duration) {
+	if !ts.ActiveChecks() {
+		return
+	}
+	ts.mu.Lock()
+	if _, exists := ts.watched[rte]; exists {
+		ts.mu.Unlock()
+		return
+	}
+	item := &healthCheckItem{exec: ts.probeCheck(rte, timeout), route: rte, watched: true}
+	ts.watched[rte] = item
+	ts.mu.Unlock()
+
+	ts.add(item, ts.jitter(int64(ts.settings.Load().activeCheckInterval)))
+	ts.spawnWatcher(ctx)
+}
+
+func (ts *HealthCheckScheduler) AddUnhealthy(ctx context.Context, rte *Route, timeout time.Duration) {
 	// Do not accept already unhealthy routes (possibly duplicates) if one cannot change their state
 	// mark unhealthy on CAS
 	if !rte.healthy.CompareAndSwap(true, false) {
 		return
 	}
+	ts.healthChanged(rte, false, "route unreachable")
+	// Watched route already has the item scheduled, bring its check closer to recover asap
+	if ts.reschedule(rte, ts.backoff(0), true) {
+		return
+	}
 	// Add to the scheduler
-	ts.add(&healthCheckItem{func() error {
-		dest, err := net.DialTimeout("tcp", rte.address, timeout)
-		if err != nil {
-			ts.logger.Error().Msgf("HC@route unreachable %s", rte.address)
-			return err
+	ts.add(&healthCheckItem{exec: ts.probeCheck(rte, timeout), route: rte}, ts.backoff(0))
+	ts.spawnWatcher(ctx)
+}
+
+// healthChanged reports the health of the route flipped
+func (ts *HealthCheckScheduler) healthChanged(rte *Route, healthy bool, reason string) {
+	if ts.onHealthChange != nil {
+		ts.onHealthChange(rte, healthy, reason)
+	}
+}
+
+// probeCheck creates the check executing the current probe against the route within timeout
+func (ts *HealthCheckScheduler) probeCheck(rte *Route, timeout time.Duration) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		probe := ts.probe.Load().(probeHolder)
+		started := time.Now()
+		err := probe.Probe(ctx, rte.address)
+		if ts.onCheck != nil {
+			ts.onCheck(rte, time.Since(started), err)
 		}
-		err = dest.Close()
 		if err != nil {
+			ts.logger.Error().Msgf("HC@route %s probe failed, error: %v", rte.address, err)
 			return err
 		}
 		return nil
-	}, 0, 0, rte}, int64(ts.checkInterval))
+	}
+}
 
+// backoff provides the delay of the next recovery check after the consecutive failures,
+// delay grows exponentially from the initial one up to the cap
+func (ts *HealthCheckScheduler) backoff(failures int) int64 {
+	settings := ts.settings.Load()
+	delay := float64(settings.backoffInitial)
+	for i := 0; i < failures && delay < float64(settings.backoffMax); i++ {
+		delay *= settings.backoffMultiplier
+	}
+	return ts.jitter(min(int64(delay), int64(settings.backoffMax)))
+}
+
+// jitter takes random fraction off the delay
+func (ts *HealthCheckScheduler) jitter(delay int64) int64 {
+	jitter := ts.settings.Load().backoffJitter
+	if jitter <= 0 || delay <= 0 {
+		return delay
+	}
+	return delay - int64(rand.Float64()*jitter*float64(delay))
+}
+
+// Eject marks the healthy route unhealthy keeping it out of traffic for the duration,
+// then the route is recovered by the regular checks
+func (ts *HealthCheckScheduler) Eject(ctx context.Context, rte *Route, timeout time.Duration, duration time.Duration) bool {
+	if !rte.healthy.CompareAndSwap(true, false) {
+		return false
+	}
+	rte.ejectedUntil.Store(time.Now().UTC().Add(duration).UnixMilli())
+	ts.healthChanged(rte, false, "route ejected")
+	if ts.reschedule(rte, duration.Milliseconds(), false) {
+		return true
+	}
+	ts.add(&healthCheckItem{exec: ts.probeCheck(rte, timeout), route: rte}, duration.Milliseconds())
+	ts.spawnWatcher(ctx)
+	return true
+}
+
+// reschedule moves the item of the watched route to be checked after the delay,
+// item is only moved closer if earlierOnly set
+func (ts *HealthCheckScheduler) reschedule(rte *Route, after int64, earlierOnly bool) bool {
+	ts.mu.Lock()
+	item, exists := ts.watched[rte]
+	if !exists {
+		ts.mu.Unlock()
+		return false
+	}
+	// Item which is being checked right now will be rescheduled by the watcher
+	wake := false
+	if item.task != nil && item.task.Index >= 0 {
+		priority := time.Now().UTC().Add(time.Duration(after) * time.Millisecond).UnixMilli()
+		if priority < item.task.Priority || !earlierOnly && priority != item.task.Priority {
+			item.task.Priority = priority
+			heap.Fix(&ts.Q, item.task.Index)
+			wake = item.task.Index == 0
+		}
+	}
+	ts.mu.Unlock()
+	if wake && atomic.CompareAndSwapInt32(&ts.isSleeping, 1, 0) {
+		ts.taskAdded <- 1
+	}
+	return true
+}
+
+func (ts *HealthCheckScheduler) spawnWatcher(ctx context.Context) {
 	nextWatcherNum := atomic.AddUint32(&ts.curWatchers, 1)
-	if nextWatcherNum <= ts.maxWatchers {
+	if nextWatcherNum <= atomic.LoadUint32(&ts.maxWatchers) {
 		// Add routine per health issue, however do not exceed max-routine
 		go ts.watchRoutine(ctx)
+		return
 	}
+	atomic.AddUint32(&ts.curWatchers, ^uint32(0))
+}
 
+// unwatch forgets the item of the route which is not checked anymore
+func (ts *HealthCheckScheduler) unwatch(item *healthCheckItem) {
+	if !item.watched {
+		return
+	}
+	ts.mu.Lock()
+	delete(ts.watched, item.route)
+	ts.mu.Unlock()
 }
 
 func (ts *HealthCheckScheduler) watchRoutine(ctx context.Context) {
@@ -101,8 +328,50 @@ func (ts *HealthCheckScheduler) watchRoutine(ctx context.Context) {
 			// Context ended return
 			return
 		}
+		// Don't check inactive routes, just exit one of the watchers
+		if !item.route.active.Load() {
+			ts.unwatch(item)
+			atomic.AddUint32(&ts.curWatchers, ^uint32(0))
+			return
+		}
+		// Ejected route is not checked until its ejection ends, covers the item
+		// which was being checked while the route was ejected
+		if left := item.route.ejectedUntil.Load() - time.Now().UTC().UnixMilli(); left > 0 {
+			ts.add(item, left)
+			continue
+		}
+		settings := ts.settings.Load()
+		// Healthy watched route is probed for the failures while active checks are enabled
+		if item.route.healthy.Load() {
+			if settings.activeCheckInterval <= 0 {
+				ts.unwatch(item)
+				atomic.AddUint32(&ts.curWatchers, ^uint32(0))
+				return
+			}
+			item.success = 0
+			if err = item.exec(ctx); err != nil {
+				item.failures++
+				if item.failures >= settings.failureThreshold && item.route.healthy.CompareAndSwap(true, false) {
+					ts.logger.Warn().Msgf("HC@route %s marked unhealthy after %d failed checks", item.route.address, item.failures)
+					ts.healthChanged(item.route, false, fmt.Sprintf("%d failed checks, error: %v", item.failures, err))
+					item.failures = 0
+					ts.add(item, ts.backoff(0))
+					continue
+				}
+			} else {
+				item.failures = 0
+			}
+			// Route marked unhealthy by the traffic while being probed is rechecked for the recovery
+			if !item.route.healthy.Load() {
+				item.failures = 0
+				ts.add(item, ts.backoff(0))
+				continue
+			}
+			ts.add(item, ts.jitter(int64(settings.activeCheckInterval)))
+			continue
+		}
 		// Execute the plan for recovery
-		err = item.exec()
+		err = item.exec(ctx)
 		if err != nil {
 			item.failures++
 			item.success = 0
@@ -110,19 +379,23 @@ func (ts *HealthCheckScheduler) watchRoutine(ctx context.Context) {
 			item.success++
 			item.failures = 0
 		}
-		// Don't check inactive routes, just exit one of the watchers
-		if !item.route.active.Load() {
-			return
-		}
-		// Check if recovery matching strategy then exit routine
-		if item.success >= ts.releaseChecks {
+		// Check if recovery matching strategy then return route to the traffic
+		if item.success >= settings.releaseChecks {
 			item.route.healthy.Store(true)
+			ts.healthChanged(item.route, true, "")
+			item.success = 0
+			// Watched route continues to be probed, otherwise exit routine
+			if item.watched && settings.activeCheckInterval > 0 {
+				ts.add(item, ts.jitter(int64(settings.activeCheckInterval)))
+				continue
+			}
+			ts.unwatch(item)
 			atomic.AddUint32(&ts.curWatchers, ^uint32(0))
 			return
 		}
-		// If not ready, reschedule
-		// TODO: Add fading mechanics to the consecutive checks due to if we find host healthy, we want to return it back asap
-		ts.add(item, int64(ts.checkInterval))
+		// If not ready, reschedule backing off while failures continue, route which
+		// started to pass the checks is rechecked soon to return it back asap
+		ts.add(item, ts.backoff(item.failures))
 	}
 }
 
@@ -131,10 +404,11 @@ func (ts *HealthCheckScheduler) add(task *healthCheckItem, after int64) {
 	item := &taskItem{
 		Id:       id,
 		Value:    task,
-		Priority: time.Now().UTC().Add(time.Duration(after) * time.Millisecond).Unix(),
+		Priority: time.Now().UTC().Add(time.Duration(after) * time.Millisecond).UnixMilli(),
 	}
 	ts.logger.Debug().Msgf("HC@Offer expiration offered as %d time: %d", after, item.Priority)
 	ts.mu.Lock()
+	task.task = item
 	heap.Push(&ts.Q, item)
 	ts.mu.Unlock()
 
@@ -151,7 +425,7 @@ func (ts *HealthCheckScheduler) add(task *healthCheckItem, after int64) {
 func (ts *HealthCheckScheduler) poll(ctx context.Context, pollerId int) (*healthCheckItem, error) {
 	iteratedOnTask := int64(0)
 	for {
-		isNow := time.Now().UTC().Unix()
+		isNow := time.Now().UTC().UnixMilli()
 		ts.mu.Lock()
 		i := ts.Q.Peek()
 		iteratedOnTask++
@@ -184,7 +458,10 @@ func (ts *HealthCheckScheduler) poll(ctx context.Context, pollerId int) (*health
 				ts.logger.Debug().Msgf("HC@Poller <%d> poll dequeue id <%d> at <%d> system <%d> loadIter <%d>", pollerId, task.Id, task.Priority, isNow, iteratedOnTask)
 				return task.Value.(*healthCheckItem), nil
 			} else {
-				// If Task should await for the next moment
+				// If Task should await for the next moment, sleep condition allows
+				// to wake up if earlier task will be offered meanwhile
+				priority := task.Priority
+				atomic.StoreInt32(&ts.isSleeping, 1)
 				ts.mu.Unlock()
 				select {
 				// Wait for general condition unlock
@@ -192,7 +469,7 @@ func (ts *HealthCheckScheduler) poll(ctx context.Context, pollerId int) (*health
 					ts.logger.Debug().Msgf("HC@Poller <%d> Called out on task added", pollerId)
 					continue
 				// Delay next checkup
-				case <-time.After(time.Duration(task.Priority-isNow) * time.Millisecond * 1000):
+				case <-time.After(time.Duration(priority-isNow) * time.Millisecond):
 					ts.logger.Debug().Msgf("HC@Poller <%d> Called out on time duration block end", pollerId)
 					continue
 				case <-ctx.Done():
@@ -0,0 +1,243 @@
+package xlb
+
+import (
+	"context"
+	"github.com/rs/zerolog"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// awaitHealth waits for the route to reach the health state
+func awaitHealth(rte *Route, healthy bool, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if rte.Healthy() == healthy {
+			return true
+		}
+		<-time.After(time.Millisecond * 50)
+	}
+	return rte.Healthy() == healthy
+}
+
+// TestHealthCheckActiveWatch
+// Will test that watched route is marked unhealthy after consecutive failed
+// probes without any traffic and recovered once upstream is back
+func TestHealthCheckActiveWatch(t *testing.T) {
+	ctx, cancelAll := context.WithCancel(context.Background())
+	defer cancelAll()
+
+	address, stop := startEchoServer(t)
+	rte := newRoute(ServicePoolRoute{ServicePath: address, ServiceActive: true})
+
+	scheduler := NewHealthCheckScheduler(HealthSchedulerOptions{
+		Logger:                zerolog.Nop(),
+		ReleaseChecks:         1,
+		CheckIntervalMs:       500,
+		ActiveCheckIntervalMs: 500,
+		FailureThreshold:      2,
+	})
+	scheduler.Watch(ctx, rte, time.Millisecond*200)
+	// Duplicate watch is ignored
+	scheduler.Watch(ctx, rte, time.Millisecond*200)
+
+	<-time.After(time.Millisecond * 1500)
+	if !rte.Healthy() {
+		t.Fatalf("reachable route should stay healthy")
+	}
+
+	stop()
+	if !awaitHealth(rte, false, time.Second*6) {
+		t.Fatalf("unreachable route should be marked unhealthy by active checks")
+	}
+
+	// Bring upstream back on the same address
+	listen, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatalf("cannot restart upstream, error: %+v", err)
+	}
+	defer listen.Close()
+	if !awaitHealth(rte, true, time.Second*6) {
+		t.Fatalf("route should recover after upstream is back")
+	}
+
+	// Inactive route is not watched anymore
+	rte.active.Store(false)
+	<-time.After(time.Millisecond * 2500)
+	scheduler.mu.Lock()
+	_, watched := scheduler.watched[rte]
+	scheduler.mu.Unlock()
+	if watched {
+		t.Errorf("inactive route should not be watched")
+	}
+}
+
+// TestHealthCheckBackoff
+// Will test that recovery check delay grows exponentially up to the cap
+// and jitter keeps the delay within the configured fraction
+func TestHealthCheckBackoff(t *testing.T) {
+	scheduler := NewHealthCheckScheduler(HealthSchedulerOptions{
+		CheckIntervalMs:   5000,
+		BackoffInitialMs:  250,
+		BackoffMultiplier: 3,
+		BackoffJitter:     -1,
+	})
+	expected := []int64{250, 750, 2250, 5000, 5000}
+	for failures, delay := range expected {
+		if got := scheduler.backoff(failures); got != delay {
+			t.Errorf("delay after %d failures should be %d, got: %d", failures, delay, got)
+		}
+	}
+
+	// Defaults start with the short recheck backing off up to the check interval
+	scheduler = NewHealthCheckScheduler(HealthSchedulerOptions{CheckIntervalMs: 3000})
+	spread := map[int64]bool{}
+	for i := 0; i < 100; i++ {
+		first := scheduler.backoff(0)
+		if first > 1000 || first < 800 {
+			t.Fatalf("first recheck delay should be within jitter of 1000ms, got: %d", first)
+		}
+		spread[first] = true
+		if capped := scheduler.backoff(10); capped > 3000 || capped < 2400 {
+			t.Fatalf("capped delay should be within jitter of 3000ms, got: %d", capped)
+		}
+	}
+	if len(spread) < 2 {
+		t.Errorf("jitter should spread the delays")
+	}
+}
+
+// TestHealthCheckFastRecovery
+// Will test that unhealthy route is rechecked sooner than the check interval
+func TestHealthCheckFastRecovery(t *testing.T) {
+	ctx, cancelAll := context.WithCancel(context.Background())
+	defer cancelAll()
+
+	address, stop := startEchoServer(t)
+	defer stop()
+	rte := newRoute(ServicePoolRoute{ServicePath: address, ServiceActive: true})
+
+	scheduler := NewHealthCheckScheduler(HealthSchedulerOptions{
+		Logger:           zerolog.Nop(),
+		CheckIntervalMs:  10000,
+		BackoffInitialMs: 100,
+	})
+	scheduler.AddUnhealthy(ctx, rte, time.Millisecond*200)
+	if rte.Healthy() {
+		t.Fatalf("route should be marked unhealthy")
+	}
+	if !awaitHealth(rte, true, time.Second) {
+		t.Fatalf("reachable route should be recovered by the first short recheck")
+	}
+}
+
+// TestHealthCheckEjectWatched
+// Will test that the watched route ejected is kept out of traffic for the ejection
+// time even if its active checks are due sooner, then it is recovered
+func TestHealthCheckEjectWatched(t *testing.T) {
+	ctx, cancelAll := context.WithCancel(context.Background())
+	defer cancelAll()
+
+	address, stop := startEchoServer(t)
+	defer stop()
+	rte := newRoute(ServicePoolRoute{ServicePath: address, ServiceActive: true})
+
+	scheduler := NewHealthCheckScheduler(HealthSchedulerOptions{
+		Logger:                zerolog.Nop(),
+		ReleaseChecks:         1,
+		CheckIntervalMs:       200,
+		ActiveCheckIntervalMs: 200,
+		BackoffJitter:         -1,
+	})
+	scheduler.Watch(ctx, rte, time.Millisecond*200)
+	<-time.After(time.Millisecond * 500)
+
+	if !scheduler.Eject(ctx, rte, time.Millisecond*200, time.Millisecond*1500) {
+		t.Fatalf("healthy route should be ejected")
+	}
+	if scheduler.Eject(ctx, rte, time.Millisecond*200, time.Millisecond*1500) {
+		t.Errorf("ejected route should not be ejected again")
+	}
+	ejected := time.Now()
+	for time.Since(ejected) < time.Millisecond*1300 {
+		if rte.Healthy() {
+			t.Fatalf("ejected route should stay out of traffic for the ejection time, recovered after %s", time.Since(ejected))
+		}
+		<-time.After(time.Millisecond * 50)
+	}
+	if !awaitHealth(rte, true, time.Second*2) {
+		t.Fatalf("ejected route should recover once the ejection time passed")
+	}
+
+	// Route is watched again after the recovery
+	scheduler.mu.Lock()
+	_, watched := scheduler.watched[rte]
+	scheduler.mu.Unlock()
+	if !watched {
+		t.Errorf("recovered route should stay watched")
+	}
+}
+
+// TestHealthCheckWatchersResized
+// Will test that routes added to the pool get their own watchers rather than
+// sharing the watchers of the routes the forwarder was created with
+func TestHealthCheckWatchersResized(t *testing.T) {
+	pool := ServicePool{
+		SvcIdentity:              "pool",
+		SvcRoutes:                []ServicePoolRoute{{ServicePath: "127.0.0.1:1", ServiceActive: true}},
+		SvcHealthCheckIntervalMs: 500,
+		SvcHealthProbe:           ProbeFunc(func(ctx context.Context, address string) error { return nil }),
+	}
+	fwd := NewForwarder(pool, zerolog.Nop())
+	defer fwd.Close()
+
+	pool.SvcRoutes = []ServicePoolRoute{
+		{ServicePath: "127.0.0.1:1", ServiceActive: true},
+		{ServicePath: "127.0.0.1:2", ServiceActive: true},
+		{ServicePath: "127.0.0.1:3", ServiceActive: true},
+	}
+	fwd.UpdateServicePool(pool)
+	if watchers := atomic.LoadUint32(&fwd.health.curWatchers); watchers != 3 {
+		t.Errorf("every route should be watched by its own watcher, watchers: %d", watchers)
+	}
+}
+
+// TestHealthCheckUnhealthyWhileProbed
+// Will test that watched route marked unhealthy while being probed is rechecked
+// for the recovery with the backoff rather than after the active check interval
+func TestHealthCheckUnhealthyWhileProbed(t *testing.T) {
+	ctx, cancelAll := context.WithCancel(context.Background())
+	defer cancelAll()
+
+	probing := make(chan struct{})
+	release := make(chan struct{})
+	var probes atomic.Int32
+	rte := newRoute(ServicePoolRoute{ServicePath: "127.0.0.1:1", ServiceActive: true})
+	scheduler := NewHealthCheckScheduler(HealthSchedulerOptions{
+		Logger:                zerolog.Nop(),
+		ReleaseChecks:         1,
+		CheckIntervalMs:       200,
+		ActiveCheckIntervalMs: 1500,
+		BackoffJitter:         -1,
+		Probe: ProbeFunc(func(ctx context.Context, address string) error {
+			if probes.Add(1) == 1 {
+				close(probing)
+				<-release
+			}
+			return nil
+		}),
+	})
+	scheduler.Watch(ctx, rte, time.Second)
+
+	select {
+	case <-probing:
+	case <-time.After(time.Second * 3):
+		t.Fatalf("watched route should be probed")
+	}
+	scheduler.AddUnhealthy(ctx, rte, time.Second)
+	close(release)
+	if !awaitHealth(rte, true, time.Millisecond*800) {
+		t.Fatalf("route marked unhealthy while probed should be rechecked with the backoff")
+	}
+}
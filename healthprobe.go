@@ -0,0 +1,248 @@
+package xlb
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/net/http2"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Limit of the upstream response read by the probes
+const maxProbeResponseSize = 64 * 1024
+
+// HealthProbe checks if the upstream at address is able to serve the traffic,
+// any error marks the probe failed. Probe is executed with ctx bound by the
+// route timeout of the pool and can be called concurrently for different routes
+type HealthProbe interface {
+	Probe(ctx context.Context, address string) error
+}
+
+// ProbeFunc adapts the custom function to the HealthProbe
+type ProbeFunc func(ctx context.Context, address string) error
+
+func (f ProbeFunc) Probe(ctx context.Context, address string) error { return f(ctx, address) }
+
+// TCPProbe checks that the upstream accepts TCP connections, default probe of the pool
+type TCPProbe struct{}
+
+func (TCPProbe) Probe(ctx context.Context, address string) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// HTTPProbe checks that the upstream responds to HTTP GET with expected status and body
+type HTTPProbe struct {
+	// Path of the request, "/" default
+	Path string
+	// Host header of the request, upstream address default
+	Host string
+	// Upstream is called over HTTPS with this configuration if provided
+	TLSConfig *tls.Config
+	// Expected response status, any 2xx status accepted if 0
+	ExpectStatus int
+	// Response body should contain this string if provided
+	ExpectBody string
+}
+
+func (p HTTPProbe) Probe(ctx context.Context, address string) error {
+	scheme := "http"
+	if p.TLSConfig != nil {
+		scheme = "https"
+	}
+	path := p.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, scheme+"://"+address+path, nil)
+	if err != nil {
+		return fmt.Errorf("cannot create probe request, error: %w", err)
+	}
+	if p.Host != "" {
+		req.Host = p.Host
+	}
+	transport := &http.Transport{TLSClientConfig: p.TLSConfig, DisableKeepAlives: true}
+	defer transport.CloseIdleConnections()
+
+	res, err := transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if p.ExpectStatus != 0 && res.StatusCode != p.ExpectStatus ||
+		p.ExpectStatus == 0 && (res.StatusCode < 200 || res.StatusCode > 299) {
+		return fmt.Errorf("unexpected probe response status %d", res.StatusCode)
+	}
+	if p.ExpectBody != "" {
+		body, err := io.ReadAll(io.LimitReader(res.Body, maxProbeResponseSize))
+		if err != nil {
+			return fmt.Errorf("cannot read probe response, error: %w", err)
+		}
+		if !bytes.Contains(body, []byte(p.ExpectBody)) {
+			return fmt.Errorf("probe response does not contain %q", p.ExpectBody)
+		}
+	}
+	return nil
+}
+
+// TLSProbe checks that the upstream completes the TLS handshake presenting the
+// certificate verified by the configuration, system roots and the upstream host
+// name are used for verification if Config does not provide them
+type TLSProbe struct {
+	Config *tls.Config
+}
+
+func (p TLSProbe) Probe(ctx context.Context, address string) error {
+	dialer := tls.Dialer{Config: upstreamTLSConfig(p.Config, address)}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Serving status of the grpc.health.v1.HealthCheckResponse
+const grpcHealthServing = 1
+
+// GRPCProbe checks the upstream with the grpc.health.v1.Health/Check call
+// and expects the SERVING status
+type GRPCProbe struct {
+	// Name of the service to check, empty checks the server overall
+	Service string
+	// Upstream is called over TLS with this configuration if provided, plaintext otherwise
+	TLSConfig *tls.Config
+}
+
+func (p GRPCProbe) Probe(ctx context.Context, address string) error {
+	scheme := "http"
+	transport := &http2.Transport{}
+	if p.TLSConfig != nil {
+		scheme = "https"
+		transport.TLSClientConfig = upstreamTLSConfig(p.TLSConfig, address)
+	} else {
+		// Plaintext HTTP/2 with prior knowledge
+		transport.AllowHTTP = true
+		transport.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+	defer transport.CloseIdleConnections()
+
+	// HealthCheckRequest{service = 1} prefixed with uncompressed message frame header
+	msg := make([]byte, 0, len(p.Service)+binary.MaxVarintLen64+1)
+	if p.Service != "" {
+		msg = append(msg, 0x0a)
+		msg = binary.AppendUvarint(msg, uint64(len(p.Service)))
+		msg = append(msg, p.Service...)
+	}
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	frame = append(frame, msg...)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, scheme+"://"+address+"/grpc.health.v1.Health/Check", bytes.NewReader(frame))
+	if err != nil {
+		return fmt.Errorf("cannot create probe request, error: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	res, err := transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected probe response status %d", res.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxProbeResponseSize))
+	if err != nil {
+		return fmt.Errorf("cannot read probe response, error: %w", err)
+	}
+	// Status is sent in trailers, or in headers for the trailers-only responses
+	grpcStatus := res.Trailer.Get("Grpc-Status")
+	grpcMessage := res.Trailer.Get("Grpc-Message")
+	if grpcStatus == "" {
+		grpcStatus = res.Header.Get("Grpc-Status")
+		grpcMessage = res.Header.Get("Grpc-Message")
+	}
+	if grpcStatus != "0" {
+		return fmt.Errorf("probe call failed with grpc status %s %s", grpcStatus, grpcMessage)
+	}
+	status, err := parseGRPCHealthResponse(body)
+	if err != nil {
+		return err
+	}
+	if status != grpcHealthServing {
+		return fmt.Errorf("upstream reported not serving status %d", status)
+	}
+	return nil
+}
+
+// parseGRPCHealthResponse extracts the status of the framed HealthCheckResponse
+func parseGRPCHealthResponse(body []byte) (uint64, error) {
+	if len(body) < 5 {
+		return 0, fmt.Errorf("probe response is missing the message")
+	}
+	if body[0] != 0 {
+		return 0, fmt.Errorf("compressed probe response is not supported")
+	}
+	size := binary.BigEndian.Uint32(body[1:5])
+	if uint64(len(body)-5) < uint64(size) {
+		return 0, fmt.Errorf("probe response message is truncated")
+	}
+	msg := body[5 : 5+size]
+	status := uint64(0)
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return 0, fmt.Errorf("malformed probe response message")
+		}
+		msg = msg[n:]
+		switch tag & 0x7 {
+		case 0:
+			value, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return 0, fmt.Errorf("malformed probe response message")
+			}
+			msg = msg[n:]
+			if tag>>3 == 1 {
+				status = value
+			}
+		case 2:
+			length, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < length {
+				return 0, fmt.Errorf("malformed probe response message")
+			}
+			msg = msg[n+int(length):]
+		default:
+			return 0, fmt.Errorf("unexpected wire type %d in probe response message", tag&0x7)
+		}
+	}
+	return status, nil
+}
+
+// upstreamTLSConfig provides the copy of configuration verifying the upstream host name if not set
+func upstreamTLSConfig(config *tls.Config, address string) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config = config.Clone()
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		config.ServerName = host
+	}
+	return config
+}
@@ -0,0 +1,183 @@
+package xlb
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/rs/zerolog"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startGRPCHealthServer creates plaintext HTTP/2 upstream answering grpc.health.v1.Health/Check
+// with the status provided for the requested service
+func startGRPCHealthServer(t *testing.T, statuses map[string]byte) *httptest.Server {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/grpc.health.v1.Health/Check" || r.Header.Get("Content-Type") != "application/grpc" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		service := ""
+		if len(body) > 7 {
+			service = string(body[7:])
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		status, ok := statuses[service]
+		if !ok {
+			// Trailers-only response
+			w.Header().Set("Grpc-Status", "5")
+			w.Header().Set("Grpc-Message", "unknown service")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		// HealthCheckResponse{status = 1} in the uncompressed frame
+		_, _ = w.Write([]byte{0, 0, 0, 0, 2, 0x08, status})
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	})
+	server := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// TestHealthProbes
+// Will test built-in probes against the upstreams in expected and unexpected states
+func TestHealthProbes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			_, _ = fmt.Fprint(w, `{"status":"ok"}`)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer httpServer.Close()
+	httpAddress := strings.TrimPrefix(httpServer.URL, "http://")
+
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer tlsServer.Close()
+	tlsAddress := strings.TrimPrefix(tlsServer.URL, "https://")
+	roots := x509.NewCertPool()
+	roots.AddCert(tlsServer.Certificate())
+
+	grpcServer := startGRPCHealthServer(t, map[string]byte{"": 1, "api": 1, "db": 2})
+	grpcAddress := strings.TrimPrefix(grpcServer.URL, "http://")
+
+	closedAddress := func() string {
+		server := httptest.NewServer(http.NotFoundHandler())
+		server.Close()
+		return strings.TrimPrefix(server.URL, "http://")
+	}()
+
+	cases := []struct {
+		name    string
+		probe   HealthProbe
+		address string
+		healthy bool
+	}{
+		{"tcp", TCPProbe{}, httpAddress, true},
+		{"tcp closed", TCPProbe{}, closedAddress, false},
+		{"http status", HTTPProbe{Path: "/health"}, httpAddress, true},
+		{"http unavailable", HTTPProbe{Path: "/"}, httpAddress, false},
+		{"http expected unavailable", HTTPProbe{Path: "/", ExpectStatus: http.StatusServiceUnavailable}, httpAddress, true},
+		{"http body", HTTPProbe{Path: "health", ExpectBody: `"ok"`}, httpAddress, true},
+		{"http body mismatch", HTTPProbe{Path: "/health", ExpectBody: `"degraded"`}, httpAddress, false},
+		{"https", HTTPProbe{TLSConfig: &tls.Config{RootCAs: roots}}, tlsAddress, true},
+		{"tls verified", TLSProbe{Config: &tls.Config{RootCAs: roots}}, tlsAddress, true},
+		{"tls unknown authority", TLSProbe{}, tlsAddress, false},
+		{"tls server name mismatch", TLSProbe{Config: &tls.Config{RootCAs: roots, ServerName: "other.local"}}, tlsAddress, false},
+		{"grpc server", GRPCProbe{}, grpcAddress, true},
+		{"grpc service serving", GRPCProbe{Service: "api"}, grpcAddress, true},
+		{"grpc service not serving", GRPCProbe{Service: "db"}, grpcAddress, false},
+		{"grpc service unknown", GRPCProbe{Service: "cache"}, grpcAddress, false},
+		{"grpc not http2", GRPCProbe{}, httpAddress, false},
+		{"custom", ProbeFunc(func(ctx context.Context, address string) error { return nil }), closedAddress, true},
+		{"custom failed", ProbeFunc(func(ctx context.Context, address string) error { return fmt.Errorf("failed") }), httpAddress, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.probe.Probe(ctx, c.address)
+			if c.healthy && err != nil {
+				t.Errorf("probe should pass, error: %+v", err)
+			}
+			if !c.healthy && err == nil {
+				t.Errorf("probe should fail")
+			}
+		})
+	}
+}
+
+// TestParseGRPCHealthResponse
+// Will test decoding of the framed health check response
+func TestParseGRPCHealthResponse(t *testing.T) {
+	// Unknown fields are skipped
+	body := []byte{0, 0, 0, 0, 6, 0x12, 0x02, 'o', 'k', 0x08, 0x01}
+	status, err := parseGRPCHealthResponse(body)
+	if err != nil || status != grpcHealthServing {
+		t.Errorf("expected serving status, got: %d error: %+v", status, err)
+	}
+	// Empty message carries the default UNKNOWN status
+	if status, err = parseGRPCHealthResponse([]byte{0, 0, 0, 0, 0}); err != nil || status != 0 {
+		t.Errorf("expected unknown status, got: %d error: %+v", status, err)
+	}
+	for _, malformed := range [][]byte{{0, 0}, {1, 0, 0, 0, 0}, {0, 0, 0, 0, 4, 0x08}, {0, 0, 0, 0, 1, 0x08}} {
+		if _, err = parseGRPCHealthResponse(malformed); err == nil {
+			t.Errorf("malformed response %v should not be parsed", malformed)
+		}
+	}
+}
+
+// TestHealthCheckProbeWatch
+// Will test that upstream accepting connections but failing the HTTP probe is
+// marked unhealthy by the active checks and recovered once it responds again
+func TestHealthCheckProbeWatch(t *testing.T) {
+	ctx, cancelAll := context.WithCancel(context.Background())
+	defer cancelAll()
+
+	var unavailable atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unavailable.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	rte := newRoute(ServicePoolRoute{ServicePath: strings.TrimPrefix(server.URL, "http://"), ServiceActive: true})
+
+	scheduler := NewHealthCheckScheduler(HealthSchedulerOptions{
+		Logger:                zerolog.Nop(),
+		ReleaseChecks:         1,
+		CheckIntervalMs:       500,
+		ActiveCheckIntervalMs: 500,
+		FailureThreshold:      1,
+		Probe:                 HTTPProbe{},
+	})
+	scheduler.Watch(ctx, rte, time.Millisecond*500)
+
+	unavailable.Store(true)
+	if !awaitHealth(rte, false, time.Second*4) {
+		t.Fatalf("route failing HTTP probe should be marked unhealthy")
+	}
+	unavailable.Store(false)
+	if !awaitHealth(rte, true, time.Second*4) {
+		t.Fatalf("route should recover once HTTP probe passes")
+	}
+
+	// Probe replaced at runtime is used for the following checks
+	scheduler.SetProbe(ProbeFunc(func(ctx context.Context, address string) error {
+		return fmt.Errorf("custom probe failed")
+	}))
+	if !awaitHealth(rte, false, time.Second*4) {
+		t.Fatalf("route should be marked unhealthy by replaced probe")
+	}
+}
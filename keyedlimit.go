@@ -0,0 +1,136 @@
+package xlb
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultKeyedRateLimitMaxKeys = 10000
+
+// KeyedRateLimit limits the rate of every client of the pool separately from the
+// other clients, in addition to the rate quota of the whole pool
+type KeyedRateLimit struct {
+	// Calls allowed per Period for every key, 0 disables the limit
+	Times int
+	// Unit of time for rate (1s default)
+	Period time.Duration
+	// Rate limiting algorithm, one of RateLimiter* constants (token-bucket default),
+	// sliding window log takes the memory of the rate for every key
+	Algorithm string
+	// Client certificate property the client limit is keyed by, one of HashKey* constants
+	// (cert-serial default), ignored by the source IP limit
+	Key string
+	// Keys limited at once, least recently seen keys are forgotten above it (10000 default)
+	MaxKeys int
+}
+
+// Enabled reports if calls are limited
+func (k KeyedRateLimit) Enabled() bool { return k.Times > 0 }
+
+func (k KeyedRateLimit) maxKeys() int {
+	if k.MaxKeys <= 0 {
+		return defaultKeyedRateLimitMaxKeys
+	}
+	return k.MaxKeys
+}
+
+func (k KeyedRateLimit) validate() error {
+	if k.Times < 0 || k.Period < 0 || k.MaxKeys < 0 {
+		return fmt.Errorf("keyed rate limit settings cannot be negative")
+	}
+	if err := validateRateLimit(k.Algorithm, max(k.Times, 1), k.Period); err != nil {
+		return err
+	}
+	return validateHashKey(k.Key)
+}
+
+type keyedLimiterEntry struct {
+	key     string
+	limiter RateLimiter
+	seen    time.Time
+}
+
+// keyedRateLimiter keeps the limiter for every recently seen key, keys idle for two
+// periods are forgotten as their fresh limiter would make the same decision, the
+// least recently seen keys are forgotten when there are more than max keys
+type keyedRateLimiter struct {
+	mutex  sync.Mutex
+	limit  KeyedRateLimit
+	period time.Duration
+	keys   map[string]*list.Element
+	lru    *list.List
+	clock  Clock
+}
+
+func newKeyedRateLimiter(limit KeyedRateLimit, clock Clock) *keyedRateLimiter {
+	if !limit.Enabled() {
+		return nil
+	}
+	if clock == nil {
+		clock = systemClock{}
+	}
+	return &keyedRateLimiter{
+		limit:  limit,
+		period: ratePeriodOrDefault(limit.Period),
+		keys:   map[string]*list.Element{},
+		lru:    list.New(),
+		clock:  clock,
+	}
+}
+
+// Allow get the bool decision if the call of the key within rate limit or not,
+// keys are hashed to keep the memory taken by every key bounded
+func (k *keyedRateLimiter) Allow(key string) bool {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	now := k.clock.Now()
+	key = strconv.FormatUint(hashString(key), 36)
+
+	// Forget idle keys
+	for k.lru.Len() > 0 {
+		oldest := k.lru.Back()
+		if now.Sub(oldest.Value.(*keyedLimiterEntry).seen) < k.period*2 {
+			break
+		}
+		k.lru.Remove(oldest)
+		delete(k.keys, oldest.Value.(*keyedLimiterEntry).key)
+	}
+
+	if element, ok := k.keys[key]; ok {
+		entry := element.Value.(*keyedLimiterEntry)
+		entry.seen = now
+		k.lru.MoveToFront(element)
+		return entry.limiter.Allow()
+	}
+	limiter, err := NewRateLimiter(k.limit.Algorithm, k.limit.Times, k.period, k.clock)
+	if err != nil {
+		// Limit is validated with the pool
+		return true
+	}
+	k.keys[key] = k.lru.PushFront(&keyedLimiterEntry{key: key, limiter: limiter, seen: now})
+	if k.lru.Len() > k.limit.maxKeys() {
+		oldest := k.lru.Back()
+		k.lru.Remove(oldest)
+		delete(k.keys, oldest.Value.(*keyedLimiterEntry).key)
+	}
+	return limiter.Allow()
+}
+
+// Len provides the count of the keys limited at the moment
+func (k *keyedRateLimiter) Len() int {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.lru.Len()
+}
+
+// clientKey provides the key of the client session for the client rate limit
+func clientKey(in io.ReadWriteCloser, limit KeyedRateLimit) string {
+	if limit.Key == "" {
+		return sessionKey(in, HashKeyCertSerial)
+	}
+	return sessionKey(in, limit.Key)
+}
@@ -0,0 +1,54 @@
+package xlb
+
+import (
+	"testing"
+	"time"
+)
+
+// TestKeyedRateLimiter
+// Will test that every key is limited separately and memory taken by keys is bounded
+func TestKeyedRateLimiter(t *testing.T) {
+	clock := newFakeClock()
+	limiter := newKeyedRateLimiter(KeyedRateLimit{Times: 2, Period: time.Second, MaxKeys: 3}, clock)
+
+	if got := countAllowed(limiter, "noisy", 5); got != 2 {
+		t.Errorf("noisy key should be limited to 2 calls, got: %d", got)
+	}
+	if got := countAllowed(limiter, "quiet", 5); got != 2 {
+		t.Errorf("quiet key should not be affected by noisy key, got: %d", got)
+	}
+
+	// Least recently seen keys are forgotten above max keys
+	countAllowed(limiter, "second", 1)
+	countAllowed(limiter, "third", 1)
+	if limiter.Len() != 3 {
+		t.Errorf("keys should be bounded by max keys, got: %d", limiter.Len())
+	}
+	if got := countAllowed(limiter, "noisy", 5); got != 2 {
+		t.Errorf("forgotten key should start over, got: %d", got)
+	}
+
+	// Idle keys are forgotten
+	clock.Advance(time.Second * 2)
+	countAllowed(limiter, "fresh", 1)
+	if limiter.Len() != 1 {
+		t.Errorf("idle keys should be forgotten, got: %d keys", limiter.Len())
+	}
+
+	if newKeyedRateLimiter(KeyedRateLimit{}, clock) != nil {
+		t.Errorf("limiter should not be created for disabled limit")
+	}
+	if err := (KeyedRateLimit{Times: 1, Key: "issuer"}).validate(); err == nil {
+		t.Errorf("unknown key should not be valid")
+	}
+}
+
+func countAllowed(limiter *keyedRateLimiter, key string, calls int) int {
+	count := 0
+	for i := 0; i < calls; i++ {
+		if limiter.Allow(key) {
+			count++
+		}
+	}
+	return count
+}
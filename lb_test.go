@@ -2,8 +2,10 @@ package xlb
 
 import (
 	"context"
+	"errors"
 	"github.com/xdire/xlb/httputil"
 	"github.com/xdire/xlb/tlsutil"
+	"net"
 	"os"
 	"strconv"
 	"strings"
@@ -466,12 +468,12 @@ func TestLoadBalancerHealthCheckFlow(t *testing.T) {
 
 			// Each 20th request kill
 			if i%25 == 0 {
-				if state, exists := balancer.forwarderMap["test"]; exists {
+				if state, exists := balancer.forwarder("test"); exists {
 					var out []struct {
 						name    string
 						healthy bool
 					}
-					for _, rte := range *state.routes {
+					for _, rte := range state.currentRoutes() {
 						out = append(out, struct {
 							name    string
 							healthy bool
@@ -588,6 +590,87 @@ run:
 	<-time.After(time.Second * 5)
 }
 
+// TestLoadBalancerShutdownAttaching
+// Will test that session attached after shutdown started is rejected rather than
+// forwarded past the drain, and the session in flight is reported killed
+func TestLoadBalancerShutdownAttaching(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err := tlsutil.CreateLocalTLSData("test")
+	defer func() {
+		_, err := tlsutil.WipeLocalTLSData("./")
+		if err != nil {
+			t.Error("cannot clean pre-arranged test files")
+		}
+	}()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := os.ReadFile("server.crt")
+	key, _ := os.ReadFile("server.key")
+	ca, _ := os.ReadFile("ca.crt")
+
+	address, stop := startEchoServer(t)
+	defer stop()
+	lb, err := NewLoadBalancer(ctx, []ServicePool{{
+		SvcIdentity: "test",
+		SvcPort:     9194,
+		SvcRoutes:   []ServicePoolRoute{{ServicePath: address, ServiceActive: true}},
+		Certificate: string(cert),
+		CertKey:     string(key),
+		CACert:      string(ca),
+	}}, Options{})
+	if err != nil {
+		t.Fatalf("cannot configure load balancer, error: %+v", err)
+	}
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- lb.Listen()
+	}()
+	<-time.After(time.Millisecond * 500)
+	fwd, ok := lb.forwarder("test")
+	if !ok {
+		t.Fatalf("pool should be served")
+	}
+
+	lingering, _ := attachSession(t, fwd)
+	defer lingering.Close()
+	shutdown := make(chan DrainReport, 1)
+	go func() {
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), time.Second)
+		defer cancelShutdown()
+		report, _ := lb.Shutdown(shutdownCtx)
+		shutdown <- report
+	}()
+	<-time.After(time.Millisecond * 200)
+
+	// Session which completed the handshake while the sessions are drained
+	client, server := net.Pipe()
+	defer client.Close()
+	attaching := make(chan error, 1)
+	go func() {
+		attaching <- fwd.Attach(context.Background(), server)
+	}()
+	select {
+	case err = <-attaching:
+		if err == nil {
+			t.Errorf("session attached after shutdown started should be rejected")
+		}
+	case <-time.After(time.Millisecond * 500):
+		t.Fatalf("session attached after shutdown started should not be forwarded")
+	}
+	if report := <-shutdown; report != (DrainReport{Killed: 1}) {
+		t.Errorf("unexpected shutdown report %+v", report)
+	}
+	if err = <-listenErr; err != nil {
+		t.Errorf("listen returned error: %+v", err)
+	}
+	if _, err = fwd.track(nil, client, client, ""); !errors.Is(err, ErrForwarderClosed) {
+		t.Errorf("closed forwarder should not track the sessions, error: %v", err)
+	}
+}
+
 // TestRunningLoadBalancerWithRateLimit
 // Will test rate limiting capabilities of LoadBalancer quota manager within a timeframe
 func TestRunningLoadBalancerWithRateLimit(t *testing.T) {
@@ -762,3 +845,352 @@ func TestRunningLoadBalancerWithRateLimit(t *testing.T) {
 	// Let everything unwind gracefully
 	<-time.After(time.Second * 5)
 }
+
+// TestLoadBalancerSharedPortIdentityDispatch
+// Will test that pools sharing the same port are selected by the identity
+// of the client certificate and traffic is not leaking to other pools
+func TestLoadBalancerSharedPortIdentityDispatch(t *testing.T) {
+	ctx, cancelAll := context.WithCancel(context.Background())
+	defer cancelAll()
+
+	t.Log("test prepare, create TLS files")
+	// Prepare TLS data for the test
+	err := tlsutil.CreateLocalTLSData("test")
+	defer func() {
+		t.Log("test unwind, delete TLS files")
+		out, err := tlsutil.WipeLocalTLSData("./")
+		if err != nil {
+			t.Error("cannot clean pre-arranged test files")
+		}
+		t.Logf("files deleted: %+v", out)
+	}()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Log("test prepare, create responding servers")
+	stopServer1, err := httputil.CreateTestServer(9101, "api", "Server 1 responded")
+	if err != nil {
+		t.Errorf("Failed to start test server 1: %v", err)
+	}
+	defer stopServer1()
+	stopServer2, err := httputil.CreateTestServer(9102, "api", "Server 2 responded")
+	if err != nil {
+		t.Errorf("Failed to start test server 2: %v", err)
+	}
+	defer stopServer2()
+	stopServer3, err := httputil.CreateTestServer(9103, "api", "Server 3 responded")
+	if err != nil {
+		t.Errorf("Failed to start test server 3: %v", err)
+	}
+	defer stopServer3()
+
+	t.Log("test prepare, create loadbalancer instance")
+	cert, err := os.ReadFile("server.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := os.ReadFile("server.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := os.ReadFile("ca.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both pools are listening at the same port, only "test" identity is issued for the client
+	balancer, err := NewLoadBalancer(ctx, []ServicePool{{
+		SvcIdentity:          "test",
+		SvcPort:              9104,
+		SvcRateQuotaTimes:    1000,
+		SvcRateQuotaDuration: time.Second * 1,
+		SvcRoutes: []ServicePoolRoute{
+			{ServicePath: "localhost:9101", ServiceActive: true},
+			{ServicePath: "localhost:9102", ServiceActive: true},
+		},
+		Certificate: string(cert),
+		CertKey:     string(key),
+		CACert:      string(ca),
+	}, {
+		SvcIdentity:          "other",
+		SvcPort:              9104,
+		SvcRateQuotaTimes:    1000,
+		SvcRateQuotaDuration: time.Second * 1,
+		SvcRoutes: []ServicePoolRoute{
+			{ServicePath: "localhost:9103", ServiceActive: true},
+		},
+		Certificate: string(cert),
+		CertKey:     string(key),
+		CACert:      string(ca),
+	}}, Options{})
+	if err != nil {
+		t.Fatal("cannot configure load balancer")
+	}
+
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- balancer.Listen()
+	}()
+	<-time.After(time.Second * 1)
+
+	// Send requests concurrently for the strategy to spread them across the routes
+	responses := make(chan string, 20)
+	for i := 0; i < 20; i++ {
+		go func() {
+			res, err := httputil.SendTestRequest("https://localhost:9104/api")
+			if err != nil {
+				t.Errorf("cannot reach remotes, error: %+v", err)
+			}
+			responses <- res
+		}()
+	}
+
+	responded := [3]int{0, 0, 0}
+	for i := 0; i < 20; i++ {
+		res := <-responses
+		if strings.Contains(res, "1") {
+			responded[0]++
+		} else if strings.Contains(res, "2") {
+			responded[1]++
+		} else if strings.Contains(res, "3") {
+			responded[2]++
+		}
+	}
+
+	if responded[0] == 0 || responded[1] == 0 {
+		t.Errorf("one of the servers of the matched pool was not selected by the strategy")
+	}
+	if responded[2] != 0 {
+		t.Errorf("traffic was dispatched to the pool with different identity")
+	}
+	t.Logf("Servers responded 1<%d times> 2<%d times> 3<%d times>", responded[0], responded[1], responded[2])
+
+	cancelAll()
+	if err = <-listenErr; err != nil {
+		t.Errorf("listen returned error: %+v", err)
+	}
+}
+
+// TestLoadBalancerAddRemoveServicePool
+// Will test how pools can be added and removed while balancer is listening,
+// spawning listeners for the new ports and closing ports without pools left
+func TestLoadBalancerAddRemoveServicePool(t *testing.T) {
+	ctx, cancelAll := context.WithCancel(context.Background())
+	defer cancelAll()
+
+	t.Log("test prepare, create TLS files")
+	// Prepare TLS data for the test
+	err := tlsutil.CreateLocalTLSData("test")
+	defer func() {
+		t.Log("test unwind, delete TLS files")
+		out, err := tlsutil.WipeLocalTLSData("./")
+		if err != nil {
+			t.Error("cannot clean pre-arranged test files")
+		}
+		t.Logf("files deleted: %+v", out)
+	}()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Log("test prepare, create responding servers")
+	stopServer1, err := httputil.CreateTestServer(9121, "api", "Server 1 responded")
+	if err != nil {
+		t.Errorf("Failed to start test server 1: %v", err)
+	}
+	defer stopServer1()
+
+	t.Log("test prepare, create loadbalancer instance")
+	cert, err := os.ReadFile("server.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := os.ReadFile("server.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := os.ReadFile("ca.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newPool := func(identity string, port int) ServicePool {
+		return ServicePool{
+			SvcIdentity: identity,
+			SvcPort:     port,
+			SvcRoutes:   []ServicePoolRoute{{ServicePath: "localhost:9121", ServiceActive: true}},
+			Certificate: string(cert),
+			CertKey:     string(key),
+			CACert:      string(ca),
+		}
+	}
+
+	// Client certificate is issued for "test" identity only, so base pool is not reachable
+	balancer, err := NewLoadBalancer(ctx, []ServicePool{newPool("base", 9120)}, Options{})
+	if err != nil {
+		t.Fatal("cannot configure load balancer")
+	}
+
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- balancer.Listen()
+	}()
+	<-time.After(time.Second * 1)
+
+	if _, err = httputil.SendTestRequest("https://localhost:9120/api"); err == nil {
+		t.Errorf("base pool should not accept other identity")
+	}
+
+	// Add pool on the new port
+	if err = balancer.AddServicePool(newPool("test", 9122)); err != nil {
+		t.Fatalf("cannot add service pool, error: %+v", err)
+	}
+	if _, err = httputil.SendTestRequest("https://localhost:9122/api"); err != nil {
+		t.Errorf("added pool should be reachable, error: %+v", err)
+	}
+
+	// Remove pool and observe port is closed
+	if err = balancer.RemoveServicePool("test"); err != nil {
+		t.Fatalf("cannot remove service pool, error: %+v", err)
+	}
+	if _, err = httputil.SendTestRequest("https://localhost:9122/api"); err == nil {
+		t.Errorf("removed pool port should be closed")
+	}
+	if err = balancer.RemoveServicePool("test"); err == nil {
+		t.Errorf("removing not existing pool should fail")
+	}
+
+	// Add pool on the port already served for the other pool
+	if err = balancer.AddServicePool(newPool("test", 9120)); err != nil {
+		t.Fatalf("cannot add service pool, error: %+v", err)
+	}
+	if _, err = httputil.SendTestRequest("https://localhost:9120/api"); err != nil {
+		t.Errorf("added pool should be reachable on the shared port, error: %+v", err)
+	}
+
+	// Move pool to the new port with the update
+	if err = balancer.UpdatePool(newPool("test", 9123)); err != nil {
+		t.Fatalf("cannot move service pool, error: %+v", err)
+	}
+	if _, err = httputil.SendTestRequest("https://localhost:9123/api"); err != nil {
+		t.Errorf("moved pool should be reachable on the new port, error: %+v", err)
+	}
+	if _, err = httputil.SendTestRequest("https://localhost:9120/api"); err == nil {
+		t.Errorf("moved pool should not be reachable on the old port")
+	}
+
+	cancelAll()
+	if err = <-listenErr; err != nil {
+		t.Errorf("listen returned error: %+v", err)
+	}
+}
+
+// TestLoadBalancerGracefulShutdown
+// Will test that shutdown stops accepting connections while sessions
+// in flight are allowed to complete, and balancer can listen again after
+func TestLoadBalancerGracefulShutdown(t *testing.T) {
+	ctx, cancelAll := context.WithCancel(context.Background())
+	defer cancelAll()
+
+	t.Log("test prepare, create TLS files")
+	// Prepare TLS data for the test
+	err := tlsutil.CreateLocalTLSData("test")
+	defer func() {
+		t.Log("test unwind, delete TLS files")
+		out, err := tlsutil.WipeLocalTLSData("./")
+		if err != nil {
+			t.Error("cannot clean pre-arranged test files")
+		}
+		t.Logf("files deleted: %+v", out)
+	}()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Log("test prepare, create responding servers")
+	stopServer1, err := httputil.CreateTestServer(9125, "api", "Server 1 responded")
+	if err != nil {
+		t.Errorf("Failed to start test server 1: %v", err)
+	}
+	defer stopServer1()
+
+	t.Log("test prepare, create loadbalancer instance")
+	cert, err := os.ReadFile("server.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := os.ReadFile("server.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := os.ReadFile("ca.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	balancer, err := NewLoadBalancer(ctx, []ServicePool{{
+		SvcIdentity: "test",
+		SvcPort:     9126,
+		SvcRoutes:   []ServicePoolRoute{{ServicePath: "localhost:9125", ServiceActive: true}},
+		Certificate: string(cert),
+		CertKey:     string(key),
+		CACert:      string(ca),
+	}}, Options{})
+	if err != nil {
+		t.Fatal("cannot configure load balancer")
+	}
+
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- balancer.Listen()
+	}()
+	<-time.After(time.Second * 1)
+
+	// Test server responds in 200ms, shutdown while requests are in flight
+	responses := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		go func() {
+			_, err := httputil.SendTestRequest("https://localhost:9126/api")
+			responses <- err
+		}()
+	}
+	<-time.After(time.Millisecond * 100)
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancelShutdown()
+	report, err := balancer.Shutdown(shutdownCtx)
+	if err != nil {
+		t.Errorf("shutdown returned error: %+v", err)
+	}
+	if report.Drained != 5 || report.Killed != 0 {
+		t.Errorf("expected all sessions drained, got: %+v", report)
+	}
+	for i := 0; i < 5; i++ {
+		if err = <-responses; err != nil {
+			t.Errorf("session in flight was cut, error: %+v", err)
+		}
+	}
+
+	if err = <-listenErr; err != nil {
+		t.Errorf("listen returned error: %+v", err)
+	}
+	if _, err = httputil.SendTestRequest("https://localhost:9126/api"); err == nil {
+		t.Errorf("balancer should not accept connections after shutdown")
+	}
+
+	// Balancer is expected to listen again after the shutdown
+	go func() {
+		listenErr <- balancer.Listen()
+	}()
+	<-time.After(time.Second * 1)
+	if _, err = httputil.SendTestRequest("https://localhost:9126/api"); err != nil {
+		t.Errorf("balancer should accept connections once listening again, error: %+v", err)
+	}
+	if _, err = balancer.Shutdown(shutdownCtx); err != nil {
+		t.Errorf("shutdown returned error: %+v", err)
+	}
+	if err = <-listenErr; err != nil {
+		t.Errorf("listen returned error: %+v", err)
+	}
+}
@@ -0,0 +1,577 @@
+package xlb
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/xdire/xlb/tlsutil"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// poolBinding holds the runtime state of the single ServicePool served by the listener
+type poolBinding struct {
+	pool      ServicePool
+	pki       *tlsutil.TLSBundle
+	clientCAs *x509.CertPool
+	limiter   RateLimiter
+	clients   *keyedRateLimiter
+	ips       *keyedRateLimiter
+	block     BlockPolicy
+	access    *accessList
+	forwarder *Forwarder
+}
+
+// newPoolBinding validates pool credentials and prepares everything to route the pool traffic
+func newPoolBinding(pool ServicePool, lb *LoadBalancer) (*poolBinding, error) {
+	pki, caCertPool, err := loadPoolCredentials(pool)
+	if err != nil {
+		return nil, err
+	}
+
+	limiter, err := newPoolRateLimiter(pool)
+	if err != nil {
+		return nil, err
+	}
+
+	access, err := newAccessList(pool.AllowCIDRs(), pool.DenyCIDRs())
+	if err != nil {
+		return nil, err
+	}
+
+	return &poolBinding{
+		pool:      pool,
+		pki:       pki,
+		clientCAs: caCertPool,
+		limiter:   limiter,
+		clients:   newKeyedRateLimiter(pool.ClientRateLimit(), nil),
+		ips:       newKeyedRateLimiter(pool.IPRateLimit(), nil),
+		block:     pool.BlockPolicy().inherit(lb.blockPolicy),
+		access:    access,
+		forwarder: NewForwarder(pool, lb.logger).withEvents(lb.events).withMetrics(lb.metrics),
+	}, nil
+}
+
+// poolRateQuota provides the rate quota of the pool or a default of defaultRequestPerSecondRate rps
+func poolRateQuota(pool ServicePool) (int, time.Duration) {
+	times, perTimeUnit := pool.RateQuota()
+	if times <= 0 {
+		times = defaultRequestPerSecondRate
+	}
+	return times, ratePeriodOrDefault(perTimeUnit)
+}
+
+func newPoolRateLimiter(pool ServicePool) (RateLimiter, error) {
+	times, perTimeUnit := poolRateQuota(pool)
+	limiter, err := NewRateLimiter(pool.RateLimiterName(), times, perTimeUnit, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rate quota for service pool %s, error: %w", pool.Identity(), err)
+	}
+	return limiter, nil
+}
+
+// updateRateLimiter applies the rate quota of the updated pool to the running limiter keeping
+// its state, limiter is recreated if the algorithm changed or it cannot be reconfigured
+func updateRateLimiter(limiter RateLimiter, current, pool ServicePool) (RateLimiter, error) {
+	if current.RateLimiterName() != pool.RateLimiterName() {
+		return newPoolRateLimiter(pool)
+	}
+	times, perTimeUnit := poolRateQuota(pool)
+	if currentTimes, currentPerTimeUnit := poolRateQuota(current); currentTimes == times && currentPerTimeUnit == perTimeUnit {
+		return limiter, nil
+	}
+	if reconfigurable, ok := limiter.(ReconfigurableRateLimiter); ok {
+		reconfigurable.SetRate(times, perTimeUnit)
+		return limiter, nil
+	}
+	return newPoolRateLimiter(pool)
+}
+
+// withinClientLimits applies the rate limits of the client certificate and the source IP
+func (b *poolBinding) withinClientLimits(conn *tls.Conn) bool {
+	if b.ips != nil && !b.ips.Allow(sessionKey(conn, HashKeyRemoteIP)) {
+		return false
+	}
+	if b.clients != nil && !b.clients.Allow(clientKey(conn, b.pool.ClientRateLimit())) {
+		return false
+	}
+	return true
+}
+
+// loadPoolCredentials parses the server PKI and the client CA of the pool
+func loadPoolCredentials(pool ServicePool) (*tlsutil.TLSBundle, *x509.CertPool, error) {
+	pki, err := tlsutil.FromPKI(pool.GetCertificate(), pool.GetPrivateKey())
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid service pool pki data")
+	}
+
+	caCertPool := x509.NewCertPool()
+	if !caCertPool.AppendCertsFromPEM([]byte(pool.GetCACertificate())) {
+		return nil, nil, fmt.Errorf("invalid service pool ca data")
+	}
+	return pki, caCertPool, nil
+}
+
+// verify checks that the peer certificate chain was issued by the CA of this pool,
+// as the listener trusts the merged set of CAs for all the pools sharing the port
+func (b *poolBinding) verify(certs []*x509.Certificate) error {
+	intermediates := x509.NewCertPool()
+	for _, crt := range certs[1:] {
+		intermediates.AddCert(crt)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         b.clientCAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err
+}
+
+// serverNameRoute groups the pools reachable by the same ClientHello server name
+// with the configuration presenting their certificates and trusting their CAs
+type serverNameRoute struct {
+	config   *tls.Config
+	pools    map[string]*poolBinding
+	policies []BlockPolicy
+	access   []*accessList
+}
+
+// newServerNameRoute merges certificates and client CAs of the pools into the single configuration
+func newServerNameRoute(pools map[string]*poolBinding) *serverNameRoute {
+	caCertPool := x509.NewCertPool()
+	certificates := make([]tls.Certificate, 0, len(pools))
+	policies := make([]BlockPolicy, 0, len(pools))
+	access := make([]*accessList, 0, len(pools))
+	for _, binding := range pools {
+		caCertPool.AppendCertsFromPEM([]byte(binding.pool.GetCACertificate()))
+		certificates = append(certificates, binding.pki.Certificate)
+		policies = append(policies, binding.block)
+		access = append(access, binding.access)
+	}
+	return &serverNameRoute{
+		config: &tls.Config{
+			Certificates:     certificates,
+			ClientAuth:       tls.RequireAndVerifyClientCert,
+			ClientCAs:        caCertPool,
+			MinVersion:       tls.VersionTLS13,
+			MaxVersion:       tls.VersionTLS13,
+			CurvePreferences: []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
+		},
+		pools:    pools,
+		policies: policies,
+		access:   access,
+	}
+}
+
+// resolve finds the pool for the peer certificate chain, identity matched by
+// the CN takes precedence over identity matched by the SAN
+func (r *serverNameRoute) resolve(certs []*x509.Certificate) (*poolBinding, string) {
+	curCrt := certs[0]
+	if binding, ok := r.pools[curCrt.Subject.CommonName]; ok {
+		if err := binding.verify(certs); err == nil {
+			return binding, curCrt.Subject.CommonName
+		}
+	}
+	for _, name := range certificateAltNames(curCrt) {
+		if binding, ok := r.pools[name]; ok {
+			if err := binding.verify(certs); err == nil {
+				return binding, name
+			}
+		}
+	}
+	return nil, curCrt.Subject.CommonName
+}
+
+// listenerRoutes is the immutable routing table of the listener, pools declaring
+// server names are reachable only by those names, the rest of the pools serve as
+// fallback for any other server name or for the ClientHello without SNI
+type listenerRoutes struct {
+	byName   map[string]*serverNameRoute
+	fallback *serverNameRoute
+	// Block policies and access lists of all the pools of the listener
+	policies []BlockPolicy
+	access   []*accessList
+}
+
+// lookup finds the route for the server name trying exact and then wildcard match
+func (lr *listenerRoutes) lookup(serverName string) *serverNameRoute {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if len(name) > 0 {
+		if r, ok := lr.byName[name]; ok {
+			return r
+		}
+		if i := strings.IndexByte(name, '.'); i > 0 {
+			if r, ok := lr.byName["*"+name[i:]]; ok {
+				return r
+			}
+		}
+	}
+	return lr.fallback
+}
+
+// portListener accepts the traffic on a single port for all the pools bound to it,
+// the candidate pools are selected by the ClientHello server name and the pool for
+// the session is selected after the handshake by the identity presented in the peer
+// certificate (CN first, then SAN) and verified against that pool's CA
+type portListener struct {
+	lb       *LoadBalancer
+	port     int
+	mutex    sync.RWMutex
+	pools    map[string]*poolBinding
+	routes   atomic.Pointer[listenerRoutes]
+	listener net.Listener
+}
+
+// newPortListener creates listener for the port with all the pools which should be served on it
+func newPortListener(lb *LoadBalancer, port int, pools []ServicePool) (*portListener, error) {
+	pl := &portListener{
+		lb:    lb,
+		port:  port,
+		pools: make(map[string]*poolBinding, len(pools)),
+	}
+	for _, pool := range pools {
+		binding, err := newPoolBinding(pool, lb)
+		if err != nil {
+			return nil, err
+		}
+		pl.pools[pool.Identity()] = binding
+	}
+	pl.rebuildRoutes()
+	return pl, nil
+}
+
+// rebuildRoutes groups all the pools bound to the listener by their server names
+// and replaces the routing table, must be called while holding the write lock or
+// before the listener started
+func (pl *portListener) rebuildRoutes() {
+	named := make(map[string]map[string]*poolBinding)
+	fallback := make(map[string]*poolBinding)
+	policies := make([]BlockPolicy, 0, len(pl.pools))
+	access := make([]*accessList, 0, len(pl.pools))
+	for identity, binding := range pl.pools {
+		policies = append(policies, binding.block)
+		access = append(access, binding.access)
+		names := binding.pool.ServerNames()
+		if len(names) == 0 {
+			fallback[identity] = binding
+			continue
+		}
+		for _, name := range names {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			if _, ok := named[name]; !ok {
+				named[name] = make(map[string]*poolBinding)
+			}
+			named[name][identity] = binding
+		}
+	}
+
+	routes := &listenerRoutes{byName: make(map[string]*serverNameRoute, len(named)), policies: policies, access: access}
+	for name, pools := range named {
+		routes.byName[name] = newServerNameRoute(pools)
+	}
+	if len(fallback) > 0 {
+		routes.fallback = newServerNameRoute(fallback)
+	}
+	pl.routes.Store(routes)
+}
+
+// addPool starts serving the pool on this listener
+func (pl *portListener) addPool(binding *poolBinding) {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+	pl.pools[binding.pool.Identity()] = binding
+	pl.rebuildRoutes()
+}
+
+// updatePool replaces credentials, rate quota and routing parameters of the pool served
+// on this listener, keeping the rate limiter and the forwarder state of the running pool
+func (pl *portListener) updatePool(pool ServicePool) error {
+	pki, caCertPool, err := loadPoolCredentials(pool)
+	if err != nil {
+		return err
+	}
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+	current, exists := pl.pools[pool.Identity()]
+	if !exists {
+		return fmt.Errorf("pool %s is not served at port %d", pool.Identity(), pl.port)
+	}
+	limiter, err := updateRateLimiter(current.limiter, current.pool, pool)
+	if err != nil {
+		return err
+	}
+	access, err := newAccessList(pool.AllowCIDRs(), pool.DenyCIDRs())
+	if err != nil {
+		return err
+	}
+	// Limits of every client are kept unless changed
+	clients, ips := current.clients, current.ips
+	if current.pool.ClientRateLimit() != pool.ClientRateLimit() {
+		clients = newKeyedRateLimiter(pool.ClientRateLimit(), nil)
+	}
+	if current.pool.IPRateLimit() != pool.IPRateLimit() {
+		ips = newKeyedRateLimiter(pool.IPRateLimit(), nil)
+	}
+	pl.pools[pool.Identity()] = &poolBinding{
+		pool:      pool,
+		pki:       pki,
+		clientCAs: caCertPool,
+		limiter:   limiter,
+		clients:   clients,
+		ips:       ips,
+		block:     pool.BlockPolicy().inherit(pl.lb.blockPolicy),
+		access:    access,
+		forwarder: current.forwarder,
+	}
+	pl.rebuildRoutes()
+	current.forwarder.UpdateServicePool(pool)
+	return nil
+}
+
+// removePool stops serving the pool on this listener, returns the removed pool
+// binding and how many pools are left to serve
+func (pl *portListener) removePool(identity string) (*poolBinding, int) {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+	binding, exists := pl.pools[identity]
+	if exists {
+		delete(pl.pools, identity)
+		pl.rebuildRoutes()
+	}
+	return binding, len(pl.pools)
+}
+
+// tlsConfig provides listener configuration resolving the pools on every ClientHello
+// by the requested server name
+func (pl *portListener) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		MaxVersion: tls.VersionTLS13,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			r := pl.routes.Load().lookup(hello.ServerName)
+			if r == nil {
+				return nil, fmt.Errorf("no service pool for server name %q", hello.ServerName)
+			}
+			// Address can be denied or blocked by the pools of the server name only
+			if hello.Conn != nil {
+				host := addressHost(hello.Conn.RemoteAddr())
+				if deniedByAll(r.access, host) || pl.lb.addressBlocked(host, r.policies) {
+					return nil, fmt.Errorf("%w for server name %q", errAddressBlocked, hello.ServerName)
+				}
+			}
+			return r.config, nil
+		},
+	}
+}
+
+// open binds the port, connections will not be accepted until listener is served
+func (pl *portListener) open() error {
+	listen, err := tls.Listen("tcp", fmt.Sprintf("localhost:%d", pl.port), pl.tlsConfig())
+	if err != nil {
+		return fmt.Errorf("failed to listen on port %d, error: %w", pl.port, err)
+	}
+	pl.listener = listen
+	pl.lb.logger.Info().Msgf("listening at port %d", pl.port)
+	return nil
+}
+
+// close stops accepting connections on the port, sessions already dispatched are not affected
+func (pl *portListener) close() {
+	pl.lb.logger.Info().Msgf("closing listener at port %d", pl.port)
+	err := pl.listener.Close()
+	if err != nil {
+		pl.lb.logger.Err(err).Msgf("error closing listener at port %d", pl.port)
+	}
+}
+
+// serve maintains incoming connections until the listener is closed, sessions are attached
+// within the provided context, unexpected accept failures are reported to errChan
+func (pl *portListener) serve(ctx context.Context, errChan chan error) {
+	lb := pl.lb
+	for {
+		conn, err := pl.listener.Accept()
+		if err != nil {
+			if strings.Contains(err.Error(), "closed network") {
+				// Graceful
+				lb.logger.Debug().Msgf("listener closed, closed network for port: %d", pl.port)
+				return
+			}
+			// Other kind of error
+			lb.logger.Err(err).Msgf("failed to accept connection, error")
+			select {
+			case errChan <- fmt.Errorf("failed to listen on port %d, error: %w", pl.port, err):
+			default:
+			}
+			return
+		}
+		// Handshake runs aside not to hold the port behind the client stalling it
+		go pl.handle(ctx, conn)
+	}
+}
+
+// handle completes the handshake for accepted connection and forwards it with the pool forwarder,
+// handle returns once the session ends
+func (pl *portListener) handle(ctx context.Context, conn net.Conn) {
+	lb := pl.lb
+
+	// Check if IP address connecting is denied by all the pools or if it is in our cache
+	// and violated the policies of all the pools
+	routes := pl.routes.Load()
+	host := addressHost(conn.RemoteAddr())
+	if deniedByAll(routes.access, host) {
+		lb.logger.Trace().Msgf("address denied for port: %d", pl.port)
+		lb.metrics.connectionBlocked(pl.port, "")
+		conn.Close()
+		return
+	}
+	if lb.addressBlocked(host, routes.policies) {
+		lb.logger.Trace().Msgf("address blocked for port: %d", pl.port)
+		lb.metrics.connectionBlocked(pl.port, "")
+		conn.Close()
+		return
+	}
+
+	lb.logger.Debug().Msgf("accepting request for port %d", pl.port)
+
+	// Convert to TLS and proceed with the handshake, client is given the handshake timeout
+	tlsConn := conn.(*tls.Conn)
+	handshakeCtx, handshakeCancel := context.WithTimeout(ctx, lb.handshakeTimeout)
+	err := tlsConn.HandshakeContext(handshakeCtx)
+	handshakeCancel()
+	if err != nil {
+		blocked := errors.Is(err, errAddressBlocked)
+		if blocked {
+			lb.logger.Trace().Msgf("address blocked for port: %d, %v", pl.port, err)
+			lb.metrics.connectionBlocked(pl.port, "")
+		} else {
+			lb.logger.Err(err).Msg("cannot complete handshake")
+			lb.events.Emit(Event{Type: EventHandshakeFailed, Port: pl.port, Address: host, Reason: err.Error()})
+			lb.metrics.handshakeFailed(pl.port, handshakeError)
+		}
+		err = tlsConn.Close()
+		if err != nil {
+			lb.logger.Err(err).Msg("cannot close connection after failed handshake")
+		}
+		// Add address to IP LRU list and increment count of engagements
+		if !blocked {
+			pl.addressFailed(host, routes.policies, "handshake failed")
+		}
+		return
+	}
+
+	// Verify certificate identity and find corresponding pool to dispatch
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		lb.logger.Error().Msg("failed to extract certificate")
+		lb.events.Emit(Event{Type: EventHandshakeFailed, Port: pl.port, Address: host, Reason: "no peer certificate"})
+		lb.metrics.handshakeFailed(pl.port, handshakeNoCertificate)
+		err = tlsConn.Close()
+		if err != nil {
+			lb.logger.Err(err).Msg("cannot close connection after certificate failure")
+		}
+		pl.addressFailed(host, routes.policies, "no peer certificate")
+		return
+	}
+
+	var binding *poolBinding
+	identity := certs[0].Subject.CommonName
+	if r := routes.lookup(tlsConn.ConnectionState().ServerName); r != nil {
+		binding, identity = r.resolve(certs)
+	}
+	if binding == nil {
+		lb.logger.Warn().Msgf("certificate failed identity matching %s", identity)
+		lb.events.Emit(Event{Type: EventIdentityMismatch, Port: pl.port, Address: host, Identity: identity})
+		lb.metrics.handshakeFailed(pl.port, handshakeIdentityFailed)
+		err = tlsConn.Close()
+		if err != nil {
+			lb.logger.Err(err).Msg("cannot close connection after identity mismatch")
+		}
+		// Identity mismatch is the unauthorized attempt as the failed handshake
+		pl.addressFailed(host, routes.policies, "identity mismatch")
+		return
+	}
+
+	if binding.access.denies(host) {
+		lb.logger.Trace().Msgf("address denied for pool: %s", identity)
+		lb.metrics.connectionBlocked(pl.port, binding.pool.Identity())
+		lb.metrics.connectionRejected(binding.pool.Identity(), rejectDenied)
+		err = tlsConn.Close()
+		if err != nil {
+			lb.logger.Err(err).Msg("cannot close connection of denied address")
+		}
+		return
+	}
+
+	// As pool using the mTLS for the identity verification it seems to be logical
+	// to apply the Rate quotas right after the verified credentials, limits of the
+	// single client are applied first for the client not to take the pool quota
+	if !binding.withinClientLimits(tlsConn) {
+		lb.logger.Trace().Msgf("client rate limit exceeded for pool: %s", identity)
+		lb.events.Emit(Event{Type: EventRateLimited, Pool: binding.pool.Identity(), Port: pl.port, Address: host,
+			Identity: identity, Reason: "client rate limit"})
+		lb.metrics.connectionRejected(binding.pool.Identity(), rejectClientRateLimit)
+		lb.metrics.rateLimitRejected(binding.pool.Identity(), "client")
+		err = tlsConn.Close()
+		if err != nil {
+			lb.logger.Err(err).Msg("cannot close connection on client rate limit")
+		}
+		return
+	}
+	if !binding.limiter.Allow() {
+		lb.logger.Trace().Msgf("rate quota exceeded for pool: %s", identity)
+		lb.events.Emit(Event{Type: EventRateLimited, Pool: binding.pool.Identity(), Port: pl.port, Address: host,
+			Identity: identity, Reason: "pool rate quota"})
+		lb.metrics.connectionRejected(binding.pool.Identity(), rejectRateLimit)
+		lb.metrics.rateLimitRejected(binding.pool.Identity(), "pool")
+		err = tlsConn.Close()
+		if err != nil {
+			lb.logger.Err(err).Msg("cannot close connection on rate quota limit")
+		}
+		return
+	}
+
+	// Forward the connection
+	err = binding.forwarder.Attach(ctx, tlsConn)
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			lb.logger.Err(err).Msg("conn closing gracefully on context")
+			return
+		}
+		if errors.Is(err, ErrForwarderClosed) {
+			lb.logger.Trace().Msgf("pool %s closed while session was attached", identity)
+			return
+		}
+		if errors.Is(err, ErrConnectionLimit) {
+			lb.logger.Trace().Msgf("connection limit exceeded for pool: %s, %v", identity, err)
+			lb.events.Emit(Event{Type: EventConnectionLimited, Pool: binding.pool.Identity(), Port: pl.port,
+				Address: host, Identity: identity, Reason: err.Error()})
+			return
+		}
+		lb.logger.Err(err).Msg("cannot attach to backend")
+	}
+}
+
+// addressFailed counts the failure of the host, the host blocked by the failure is reported
+// once with the block time, connections of the blocked host are only counted by the metrics
+func (pl *portListener) addressFailed(host string, policies []BlockPolicy, reason string) {
+	if blockTime := pl.lb.addressFailed(host, policies); blockTime > 0 {
+		pl.lb.logger.Warn().Msgf("address %s blocked for %s on port: %d", host, blockTime, pl.port)
+		pl.lb.events.Emit(Event{Type: EventIPBlocked, Port: pl.port, Address: host, Reason: reason, Duration: blockTime})
+	}
+}
+
+// certificateAltNames collects SAN entries of the certificate which can be used as pool identity
+func certificateAltNames(crt *x509.Certificate) []string {
+	names := make([]string, 0, len(crt.DNSNames)+len(crt.URIs)+len(crt.EmailAddresses))
+	names = append(names, crt.DNSNames...)
+	for _, uri := range crt.URIs {
+		names = append(names, uri.String())
+	}
+	names = append(names, crt.EmailAddresses...)
+	return names
+}
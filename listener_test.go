@@ -0,0 +1,504 @@
+package xlb
+
+import (
+	"context"
+	"errors"
+	"github.com/xdire/xlb/httputil"
+	"github.com/xdire/xlb/tlsutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestPortListenerServerNameRoutes
+// Will test how pools sharing the port are grouped by the server names
+// and how the ClientHello server name selects the candidate pools
+func TestPortListenerServerNameRoutes(t *testing.T) {
+	ctx, cancelAll := context.WithCancel(context.Background())
+	defer cancelAll()
+
+	err := tlsutil.CreateLocalTLSData("test")
+	defer func() {
+		_, err := tlsutil.WipeLocalTLSData("./")
+		if err != nil {
+			t.Error("cannot clean pre-arranged test files")
+		}
+	}()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := os.ReadFile("server.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := os.ReadFile("server.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := os.ReadFile("ca.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newPool := func(identity string, names ...string) ServicePool {
+		return ServicePool{
+			SvcIdentity:    identity,
+			SvcPort:        9110,
+			SvcRoutes:      []ServicePoolRoute{{ServicePath: "localhost:9111", ServiceActive: true}},
+			Certificate:    string(cert),
+			CertKey:        string(key),
+			CACert:         string(ca),
+			SvcServerNames: names,
+		}
+	}
+	pools := []ServicePool{
+		newPool("test", "localhost", "api.local"),
+		newPool("shared", "api.local"),
+		newPool("wild", "*.example.com"),
+		newPool("default"),
+	}
+	balancer, err := NewLoadBalancer(ctx, pools, Options{})
+	if err != nil {
+		t.Fatal("cannot configure load balancer")
+	}
+	pl, err := newPortListener(balancer, 9110, pools)
+	if err != nil {
+		t.Fatalf("cannot create listener, error: %+v", err)
+	}
+
+	cases := []struct {
+		serverName string
+		identities []string
+	}{
+		{"localhost", []string{"test"}},
+		{"LOCALHOST.", []string{"test"}},
+		{"api.local", []string{"test", "shared"}},
+		{"svc.example.com", []string{"wild"}},
+		{"deep.svc.example.com", []string{"default"}},
+		{"unknown.local", []string{"default"}},
+		{"", []string{"default"}},
+	}
+	for _, c := range cases {
+		r := pl.routes.Load().lookup(c.serverName)
+		if r == nil {
+			t.Errorf("no route for server name %q", c.serverName)
+			continue
+		}
+		if len(r.pools) != len(c.identities) {
+			t.Errorf("server name %q resolved to %d pools, expected %d", c.serverName, len(r.pools), len(c.identities))
+		}
+		for _, identity := range c.identities {
+			if _, ok := r.pools[identity]; !ok {
+				t.Errorf("server name %q should resolve pool %s", c.serverName, identity)
+			}
+		}
+		if len(r.config.Certificates) != len(c.identities) {
+			t.Errorf("server name %q should present certificates of resolved pools only", c.serverName)
+		}
+	}
+}
+
+// TestLoadBalancerServerNameRouting
+// Will test that the pool declaring server names is reachable only by those names
+func TestLoadBalancerServerNameRouting(t *testing.T) {
+	ctx, cancelAll := context.WithCancel(context.Background())
+	defer cancelAll()
+
+	err := tlsutil.CreateLocalTLSData("test")
+	defer func() {
+		_, err := tlsutil.WipeLocalTLSData("./")
+		if err != nil {
+			t.Error("cannot clean pre-arranged test files")
+		}
+	}()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stopServer1, err := httputil.CreateTestServer(9112, "api", "Server 1 responded")
+	if err != nil {
+		t.Errorf("Failed to start test server 1: %v", err)
+	}
+	defer stopServer1()
+
+	cert, err := os.ReadFile("server.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := os.ReadFile("server.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := os.ReadFile("ca.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pool matching the requested server name and the pool reachable by the other name only
+	balancer, err := NewLoadBalancer(ctx, []ServicePool{{
+		SvcIdentity:    "test",
+		SvcPort:        9113,
+		SvcRoutes:      []ServicePoolRoute{{ServicePath: "localhost:9112", ServiceActive: true}},
+		Certificate:    string(cert),
+		CertKey:        string(key),
+		CACert:         string(ca),
+		SvcServerNames: []string{"localhost"},
+	}, {
+		SvcIdentity:    "hidden",
+		SvcPort:        9114,
+		SvcRoutes:      []ServicePoolRoute{{ServicePath: "localhost:9112", ServiceActive: true}},
+		Certificate:    string(cert),
+		CertKey:        string(key),
+		CACert:         string(ca),
+		SvcServerNames: []string{"hidden.local"},
+	}}, Options{})
+	if err != nil {
+		t.Fatal("cannot configure load balancer")
+	}
+
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- balancer.Listen()
+	}()
+	<-time.After(time.Second * 1)
+
+	res, err := httputil.SendTestRequest("https://localhost:9113/api")
+	if err != nil {
+		t.Errorf("cannot reach remotes by matching server name, error: %+v", err)
+	}
+	t.Logf("response for matching server name: %s", res)
+
+	_, err = httputil.SendTestRequest("https://localhost:9114/api")
+	if err == nil {
+		t.Errorf("pool should not be reachable by not declared server name")
+	}
+
+	cancelAll()
+	if err = <-listenErr; err != nil {
+		t.Errorf("listen returned error: %+v", err)
+	}
+}
+
+// TestPortListenerRateQuotaUpdate
+// Will test that pool update applies the rate quota to the running limiter
+// keeping its state and replaces the limiter if algorithm changed
+func TestPortListenerRateQuotaUpdate(t *testing.T) {
+	ctx, cancelAll := context.WithCancel(context.Background())
+	defer cancelAll()
+
+	err := tlsutil.CreateLocalTLSData("test")
+	defer func() {
+		_, err := tlsutil.WipeLocalTLSData("./")
+		if err != nil {
+			t.Error("cannot clean pre-arranged test files")
+		}
+	}()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := os.ReadFile("server.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := os.ReadFile("server.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := os.ReadFile("ca.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := ServicePool{
+		SvcIdentity:          "test",
+		SvcPort:              9115,
+		SvcRateQuotaTimes:    2,
+		SvcRateQuotaDuration: time.Minute,
+		SvcRateLimiter:       RateLimiterSlidingWindowLog,
+		SvcRoutes:            []ServicePoolRoute{{ServicePath: "localhost:9116", ServiceActive: true}},
+		Certificate:          string(cert),
+		CertKey:              string(key),
+		CACert:               string(ca),
+	}
+	balancer, err := NewLoadBalancer(ctx, []ServicePool{pool}, Options{})
+	if err != nil {
+		t.Fatal("cannot configure load balancer")
+	}
+	pl, err := newPortListener(balancer, 9115, []ServicePool{pool})
+	if err != nil {
+		t.Fatalf("cannot create listener, error: %+v", err)
+	}
+	limiter := pl.pools["test"].limiter
+	if got := allowed(limiter, 5); got != 2 {
+		t.Fatalf("quota of 2 should be allowed, got: %d", got)
+	}
+
+	pool.SvcRateQuotaTimes = 5
+	if err = pl.updatePool(pool); err != nil {
+		t.Fatalf("cannot update pool, error: %+v", err)
+	}
+	if pl.pools["test"].limiter != limiter {
+		t.Fatalf("limiter should be kept for the same algorithm")
+	}
+	if got := allowed(pl.pools["test"].limiter, 5); got != 3 {
+		t.Errorf("raised quota should count the calls already allowed, got: %d", got)
+	}
+
+	pool.SvcRateLimiter = RateLimiterGCRA
+	if err = pl.updatePool(pool); err != nil {
+		t.Fatalf("cannot update pool, error: %+v", err)
+	}
+	if pl.pools["test"].limiter == limiter {
+		t.Fatalf("limiter should be replaced for the changed algorithm")
+	}
+	if got := allowed(pl.pools["test"].limiter, 10); got != 5 {
+		t.Errorf("new limiter should allow the quota, got: %d", got)
+	}
+}
+
+// TestLoadBalancerClientRateLimit
+// Will test that the client exceeding its own rate limit is rejected
+func TestLoadBalancerClientRateLimit(t *testing.T) {
+	ctx, cancelAll := context.WithCancel(context.Background())
+	defer cancelAll()
+
+	err := tlsutil.CreateLocalTLSData("test")
+	defer func() {
+		_, err := tlsutil.WipeLocalTLSData("./")
+		if err != nil {
+			t.Error("cannot clean pre-arranged test files")
+		}
+	}()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stopServer1, err := httputil.CreateTestServer(9117, "api", "Server 1 responded")
+	if err != nil {
+		t.Errorf("Failed to start test server 1: %v", err)
+	}
+	defer stopServer1()
+
+	cert, err := os.ReadFile("server.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := os.ReadFile("server.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := os.ReadFile("ca.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	balancer, err := NewLoadBalancer(ctx, []ServicePool{{
+		SvcIdentity:        "test",
+		SvcPort:            9118,
+		SvcRoutes:          []ServicePoolRoute{{ServicePath: "localhost:9117", ServiceActive: true}},
+		Certificate:        string(cert),
+		CertKey:            string(key),
+		CACert:             string(ca),
+		SvcClientRateLimit: KeyedRateLimit{Times: 2, Period: time.Minute, Key: HashKeyCertSubject},
+	}}, Options{})
+	if err != nil {
+		t.Fatal("cannot configure load balancer")
+	}
+
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- balancer.Listen()
+	}()
+	<-time.After(time.Second * 1)
+
+	succeeded := 0
+	for i := 0; i < 4; i++ {
+		if _, err = httputil.SendTestRequest("https://localhost:9118/api"); err == nil {
+			succeeded++
+		}
+	}
+	if succeeded != 2 {
+		t.Errorf("client should be limited to 2 requests, succeeded: %d", succeeded)
+	}
+
+	cancelAll()
+	if err = <-listenErr; err != nil {
+		t.Errorf("listen returned error: %+v", err)
+	}
+}
+
+// TestLoadBalancerBlocksHost
+// Will test that failures of the host are counted regardless of the source port
+// and the host denied by the pool cannot reach it
+func TestLoadBalancerBlocksHost(t *testing.T) {
+	ctx, cancelAll := context.WithCancel(context.Background())
+	defer cancelAll()
+
+	err := tlsutil.CreateLocalTLSData("test")
+	defer func() {
+		_, err := tlsutil.WipeLocalTLSData("./")
+		if err != nil {
+			t.Error("cannot clean pre-arranged test files")
+		}
+	}()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stopServer1, err := httputil.CreateTestServer(9119, "api", "Server 1 responded")
+	if err != nil {
+		t.Errorf("Failed to start test server 1: %v", err)
+	}
+	defer stopServer1()
+
+	cert, err := os.ReadFile("server.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := os.ReadFile("server.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := os.ReadFile("ca.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newPool := func(identity string, port int) ServicePool {
+		return ServicePool{
+			SvcIdentity:    identity,
+			SvcPort:        port,
+			SvcRoutes:      []ServicePoolRoute{{ServicePath: "localhost:9119", ServiceActive: true}},
+			Certificate:    string(cert),
+			CertKey:        string(key),
+			CACert:         string(ca),
+			SvcBlockPolicy: BlockPolicy{Threshold: 1},
+		}
+	}
+	// Client certificate does not match the identity of the mismatched pool
+	mismatched := newPool("other", 9120)
+	denied := newPool("test", 9121)
+	denied.SvcDenyCIDRs = []string{"127.0.0.0/8", "::1"}
+
+	balancer, err := NewLoadBalancer(ctx, []ServicePool{mismatched, denied}, Options{})
+	if err != nil {
+		t.Fatal("cannot configure load balancer")
+	}
+
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- balancer.Listen()
+	}()
+	<-time.After(time.Second * 1)
+
+	for i := 0; i < 3; i++ {
+		if _, err = httputil.SendTestRequest("https://localhost:9120/api"); err == nil {
+			t.Errorf("request with mismatched identity should fail")
+		}
+	}
+	if balancer.ipLRU.Len() != 1 {
+		t.Errorf("failures should be counted for the host, got entries: %d", balancer.ipLRU.Len())
+	}
+	if entry, ok := balancer.ipLRU.Get("127.0.0.1"); !ok || entry.Count != 2 {
+		t.Errorf("host should be blocked after 2 failures, got: %+v", entry)
+	}
+
+	if _, err = httputil.SendTestRequest("https://localhost:9121/api"); err == nil {
+		t.Errorf("request of the denied host should fail")
+	}
+
+	cancelAll()
+	if err = <-listenErr; err != nil {
+		t.Errorf("listen returned error: %+v", err)
+	}
+}
+
+// TestLoadBalancerHandshakeTimeout
+// Will test that the client stalling the handshake does not hold the other clients
+// of the port and that its connection is closed once the handshake timeout passes
+func TestLoadBalancerHandshakeTimeout(t *testing.T) {
+	ctx, cancelAll := context.WithCancel(context.Background())
+	defer cancelAll()
+
+	err := tlsutil.CreateLocalTLSData("test")
+	defer func() {
+		_, err := tlsutil.WipeLocalTLSData("./")
+		if err != nil {
+			t.Error("cannot clean pre-arranged test files")
+		}
+	}()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stopServer1, err := httputil.CreateTestServer(9190, "api", "Server 1 responded")
+	if err != nil {
+		t.Errorf("Failed to start test server 1: %v", err)
+	}
+	defer stopServer1()
+
+	cert, err := os.ReadFile("server.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := os.ReadFile("server.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := os.ReadFile("ca.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	balancer, err := NewLoadBalancer(ctx, []ServicePool{{
+		SvcIdentity: "test",
+		SvcPort:     9191,
+		SvcRoutes:   []ServicePoolRoute{{ServicePath: "localhost:9190", ServiceActive: true}},
+		Certificate: string(cert),
+		CertKey:     string(key),
+		CACert:      string(ca),
+	}}, Options{HandshakeTimeout: time.Second * 2})
+	if err != nil {
+		t.Fatal("cannot configure load balancer")
+	}
+
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- balancer.Listen()
+	}()
+	<-time.After(time.Second * 1)
+
+	// Client connecting and never sending the ClientHello
+	stalled, err := net.Dial("tcp", "localhost:9191")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	<-time.After(time.Millisecond * 100)
+
+	started := time.Now()
+	if _, err = httputil.SendTestRequest("https://localhost:9191/api"); err != nil {
+		t.Errorf("client should not wait for the stalled handshake, error: %+v", err)
+	}
+	if took := time.Since(started); took > time.Second {
+		t.Errorf("client should not wait for the stalled handshake, took: %s", took)
+	}
+
+	// Stalled connection is closed by the balancer after the timeout
+	if err = stalled.SetReadDeadline(time.Now().Add(time.Second * 5)); err != nil {
+		t.Fatal(err)
+	}
+	_, err = stalled.Read(make([]byte, 1))
+	var netErr net.Error
+	if err == nil || errors.As(err, &netErr) && netErr.Timeout() {
+		t.Errorf("stalled connection should be closed after the handshake timeout, error: %v", err)
+	}
+
+	cancelAll()
+	if err = <-listenErr; err != nil {
+		t.Errorf("listen returned error: %+v", err)
+	}
+}
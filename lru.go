@@ -7,9 +7,11 @@ import (
 )
 
 type CacheEntry struct {
-	IP        string
-	ExpiresAt time.Time
-	Count     int
+	IP        string    `json:"ip"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Count     int       `json:"count"`
+	// Time of the last count increment
+	UpdatedAt time.Time `json:"updated_at"`
 }
 
 // LRUCache simple LRU cache to store, search and easily evict data
@@ -49,15 +51,18 @@ func (c *LRUCache) Put(key string, t time.Time, count int) {
 
 // method to provide outside locking for more than one transaction in cache
 func (c *LRUCache) put(key string, t time.Time, count int) {
-	if entry, ok := c.cache[key]; ok {
+	c.putEntry(&CacheEntry{IP: key, ExpiresAt: t, Count: count, UpdatedAt: time.Now()})
+}
+
+func (c *LRUCache) putEntry(value *CacheEntry) {
+	if entry, ok := c.cache[value.IP]; ok {
 		c.list.MoveToFront(entry)
-		entry.Value = &CacheEntry{key, t, count}
+		entry.Value = value
 		return
 	}
 
-	value := &CacheEntry{key, t, count}
 	newEntry := c.list.PushFront(value)
-	c.cache[key] = newEntry
+	c.cache[value.IP] = newEntry
 
 	if c.list.Len() > c.capacity {
 		lastEntry := c.list.Back()
@@ -68,18 +73,79 @@ func (c *LRUCache) put(key string, t time.Time, count int) {
 
 // IncrementCount increments counts for some record in the cache
 func (c *LRUCache) IncrementCount(ip string, blockDuration time.Duration) {
+	c.IncrementCountFor(ip, func(count int) time.Duration {
+		return blockDuration * time.Duration(count)
+	})
+}
+
+// IncrementCountFor increments counts for some record in the cache, record expires
+// after the retention for the incremented count, returns the copy of the record.
+// Entries are replaced on increment, entries provided by Get before are not changed
+func (c *LRUCache) IncrementCountFor(ip string, retention func(count int) time.Duration) CacheEntry {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
+	count := 1
 	if entry, ok := c.cache[ip]; ok {
-		entry.Value.(*CacheEntry).Count++
-		entry.Value.(*CacheEntry).ExpiresAt = time.Now().Add(blockDuration * time.Duration(entry.Value.(*CacheEntry).Count))
-		c.list.MoveToFront(entry)
-	} else {
-		c.put(ip, time.Now().Add(blockDuration), 1)
+		count = entry.Value.(*CacheEntry).Count + 1
+	}
+	now := time.Now()
+	value := &CacheEntry{IP: ip, ExpiresAt: now.Add(retention(count)), Count: count, UpdatedAt: now}
+	c.putEntry(value)
+	return *value
+}
+
+// Merge adds the record kept elsewhere to the cache, record which exists keeps
+// the greater count and the latest times of both records. Record which is not
+// changed by the merge keeps its place in the cache
+func (c *LRUCache) Merge(entry CacheEntry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if current, ok := c.cache[entry.IP]; ok {
+		existing := current.Value.(*CacheEntry)
+		entry = mergeEntries(*existing, entry)
+		if entry == *existing {
+			return
+		}
+	}
+	c.putEntry(&entry)
+}
+
+// mergeEntries combines two records of the same key keeping the greater count and the latest times
+func mergeEntries(a, b CacheEntry) CacheEntry {
+	a.Count = max(a.Count, b.Count)
+	if b.ExpiresAt.After(a.ExpiresAt) {
+		a.ExpiresAt = b.ExpiresAt
+	}
+	if b.UpdatedAt.After(a.UpdatedAt) {
+		a.UpdatedAt = b.UpdatedAt
+	}
+	return a
+}
+
+// Entries provides the copy of all the records from the most to the least recently used
+func (c *LRUCache) Entries() []CacheEntry {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	entries := make([]CacheEntry, 0, c.list.Len())
+	for e := c.list.Front(); e != nil; e = e.Next() {
+		entries = append(entries, *e.Value.(*CacheEntry))
 	}
+	return entries
 }
 
+// Len provides the count of records in the cache
+func (c *LRUCache) Len() int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.list.Len()
+}
+
+// Capacity provides the count of records the cache keeps before eviction
+func (c *LRUCache) Capacity() int { return c.capacity }
+
 // Invalidate particular element in the cache
 func (c *LRUCache) Invalidate(key string) {
 	c.mutex.Lock()
@@ -70,4 +70,36 @@ func TestLRUCache(t *testing.T) {
 			t.Errorf("Entry for 192.168.0.1 should have been invalidated")
 		}
 	})
+
+	// Merge
+	t.Run("Merge", func(t *testing.T) {
+		cache := NewLRUCache(2)
+		cache.Put("127.0.0.1", time.Now().Add(time.Minute), 3)
+		cache.Put("192.168.0.1", time.Now().Add(time.Minute), 1)
+		synced := cache.Entries()
+
+		// Entries synced back without changes keep their recency
+		for i := len(synced) - 1; i >= 0; i-- {
+			cache.Merge(synced[i])
+		}
+		cache.Merge(synced[1])
+		if entries := cache.Entries(); entries[0].IP != "192.168.0.1" {
+			t.Errorf("Unchanged entry should not be promoted, got order: %+v", entries)
+		}
+
+		// Lower count elsewhere does not change the entry
+		changed := synced[1]
+		changed.Count = 2
+		cache.Merge(changed)
+		if entries := cache.Entries(); entries[0].IP != "192.168.0.1" || entries[1].Count != 3 {
+			t.Errorf("Entry should keep the greater count and its recency, got: %+v", entries)
+		}
+
+		// Entry escalated elsewhere is promoted
+		changed.Count = 4
+		cache.Merge(changed)
+		if entries := cache.Entries(); entries[0].IP != "127.0.0.1" || entries[0].Count != 4 {
+			t.Errorf("Changed entry should be promoted with the greater count, got: %+v", entries)
+		}
+	})
 }
@@ -0,0 +1,439 @@
+package xlb
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	metricsContentType     = "text/plain; version=0.0.4; charset=utf-8"
+	metricsPath            = "/metrics"
+	metricsShutdownTimeout = time.Second * 5
+)
+
+// Buckets of the latency histograms in seconds
+var latencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Connection rejection reasons of the xlb_connections_rejected_total
+const (
+	rejectDenied          = "denied"
+	rejectRateLimit       = "rate-limit"
+	rejectClientRateLimit = "client-rate-limit"
+	rejectConnectionLimit = "connection-limit"
+)
+
+// Handshake failure reasons of the xlb_handshake_failures_total
+const (
+	handshakeError          = "handshake"
+	handshakeNoCertificate  = "no-certificate"
+	handshakeIdentityFailed = "identity-mismatch"
+)
+
+// Metrics counts what the balancer is doing, counters are exposed with the gauges of
+// the routes and the blocklist in Prometheus text format. Nil metrics count nothing
+type Metrics struct {
+	accepted          counterVec
+	rejected          counterVec
+	blocked           counterVec
+	handshakeFailures counterVec
+	rateLimited       counterVec
+	bytesIn           counterVec
+	bytesOut          counterVec
+	healthCheck       histogramVec
+	dial              histogramVec
+}
+
+// NewMetrics creates the metrics with all the counters at zero
+func NewMetrics() *Metrics {
+	return &Metrics{
+		healthCheck: histogramVec{buckets: latencyBuckets},
+		dial:        histogramVec{buckets: latencyBuckets},
+	}
+}
+
+func (m *Metrics) connectionAccepted(pool string) {
+	if m != nil {
+		m.accepted.add(labels("pool", pool), 1)
+	}
+}
+
+func (m *Metrics) connectionRejected(pool, reason string) {
+	if m != nil {
+		m.rejected.add(labels("pool", pool, "reason", reason), 1)
+	}
+}
+
+// connectionBlocked counts the connection of the blocked address, pool is empty
+// if the address was blocked before the pool was known
+func (m *Metrics) connectionBlocked(port int, pool string) {
+	if m != nil {
+		m.blocked.add(labels("port", strconv.Itoa(port), "pool", pool), 1)
+	}
+}
+
+func (m *Metrics) handshakeFailed(port int, reason string) {
+	if m != nil {
+		m.handshakeFailures.add(labels("port", strconv.Itoa(port), "reason", reason), 1)
+	}
+}
+
+// rateLimitRejected counts the connection rejected by the rate limit of the pool or the client
+func (m *Metrics) rateLimitRejected(pool, limiter string) {
+	if m != nil {
+		m.rateLimited.add(labels("pool", pool, "limiter", limiter), 1)
+	}
+}
+
+// transferCounters provides the counters of the bytes forwarded by the pool from the
+// clients and to the clients, counters are nil for nil metrics
+func (m *Metrics) transferCounters(pool string) (in, out *atomic.Uint64) {
+	if m == nil {
+		return nil, nil
+	}
+	return m.bytesIn.counter(labels("pool", pool)), m.bytesOut.counter(labels("pool", pool))
+}
+
+func (m *Metrics) healthChecked(pool, route string, took time.Duration) {
+	if m != nil {
+		m.healthCheck.observe(labels("pool", pool, "route", route), took.Seconds())
+	}
+}
+
+func (m *Metrics) dialed(pool, route string, took time.Duration) {
+	if m != nil {
+		m.dial.observe(labels("pool", pool, "route", route), took.Seconds())
+	}
+}
+
+// removePool drops the series of the pool and its routes
+func (m *Metrics) removePool(pool string) {
+	if m != nil {
+		match := func(labels string) bool { return hasLabel(labels, "pool", pool) }
+		for _, c := range []*counterVec{&m.accepted, &m.rejected, &m.blocked, &m.rateLimited, &m.bytesIn, &m.bytesOut} {
+			c.remove(match)
+		}
+		m.healthCheck.remove(match)
+		m.dial.remove(match)
+	}
+}
+
+// removeRoute drops the series of the route of the pool
+func (m *Metrics) removeRoute(pool, route string) {
+	if m != nil {
+		match := func(labels string) bool { return hasLabel(labels, "pool", pool) && hasLabel(labels, "route", route) }
+		m.healthCheck.remove(match)
+		m.dial.remove(match)
+	}
+}
+
+// countingWriter adds the bytes to the counter as they are written for the counter
+// to grow while the session runs rather than once it ends, nil counter counts nothing
+type countingWriter struct {
+	io.Writer
+	counter *atomic.Uint64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.Writer.Write(p)
+	if n > 0 && c.counter != nil {
+		c.counter.Add(uint64(n))
+	}
+	return n, err
+}
+
+// counterVec keeps the counters by their rendered labels
+type counterVec struct {
+	mutex  sync.RWMutex
+	values map[string]*atomic.Uint64
+}
+
+func (c *counterVec) add(labels string, n uint64) {
+	c.counter(labels).Add(n)
+}
+
+// counter provides the counter of the labels creating it if missing
+func (c *counterVec) counter(labels string) *atomic.Uint64 {
+	c.mutex.RLock()
+	value, ok := c.values[labels]
+	c.mutex.RUnlock()
+	if !ok {
+		c.mutex.Lock()
+		if c.values == nil {
+			c.values = map[string]*atomic.Uint64{}
+		}
+		if value, ok = c.values[labels]; !ok {
+			value = &atomic.Uint64{}
+			c.values[labels] = value
+		}
+		c.mutex.Unlock()
+	}
+	return value
+}
+
+// remove drops the counters which labels match
+func (c *counterVec) remove(match func(labels string) bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for key := range c.values {
+		if match(key) {
+			delete(c.values, key)
+		}
+	}
+}
+
+func (c *counterVec) write(w *bufio.Writer, name, help string) {
+	writeHeader(w, name, help, "counter")
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	for _, key := range sortedKeys(c.values) {
+		writeSample(w, name, key, float64(c.values[key].Load()))
+	}
+}
+
+type histogram struct {
+	mutex  sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// histogramVec keeps the histograms by their rendered labels
+type histogramVec struct {
+	buckets []float64
+	mutex   sync.RWMutex
+	values  map[string]*histogram
+}
+
+func (h *histogramVec) observe(labels string, value float64) {
+	h.mutex.RLock()
+	hist, ok := h.values[labels]
+	h.mutex.RUnlock()
+	if !ok {
+		h.mutex.Lock()
+		if h.values == nil {
+			h.values = map[string]*histogram{}
+		}
+		if hist, ok = h.values[labels]; !ok {
+			hist = &histogram{counts: make([]uint64, len(h.buckets))}
+			h.values[labels] = hist
+		}
+		h.mutex.Unlock()
+	}
+	hist.mutex.Lock()
+	defer hist.mutex.Unlock()
+	for i, bound := range h.buckets {
+		if value <= bound {
+			hist.counts[i]++
+		}
+	}
+	hist.sum += value
+	hist.count++
+}
+
+// remove drops the histograms which labels match
+func (h *histogramVec) remove(match func(labels string) bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for key := range h.values {
+		if match(key) {
+			delete(h.values, key)
+		}
+	}
+}
+
+func (h *histogramVec) write(w *bufio.Writer, name, help string) {
+	writeHeader(w, name, help, "histogram")
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	for _, key := range sortedKeys(h.values) {
+		hist := h.values[key]
+		hist.mutex.Lock()
+		for i, bound := range h.buckets {
+			writeSample(w, name+"_bucket", joinLabels(key, labels("le", formatFloat(bound))), float64(hist.counts[i]))
+		}
+		writeSample(w, name+"_bucket", joinLabels(key, labels("le", "+Inf")), float64(hist.count))
+		writeSample(w, name+"_sum", key, hist.sum)
+		writeSample(w, name+"_count", key, float64(hist.count))
+		hist.mutex.Unlock()
+	}
+}
+
+// labels renders the label pairs provided as name, value, name, value...
+func labels(pairs ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i])
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(pairs[i+1]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+// hasLabel reports if the rendered labels hold the label, quotes are escaped in the values
+// so the rendered label cannot be matched inside the other value
+func hasLabel(rendered, name, value string) bool {
+	label := labels(name, value)
+	return rendered == label || strings.HasPrefix(rendered, label+",") ||
+		strings.HasSuffix(rendered, ","+label) || strings.Contains(rendered, ","+label+",")
+}
+
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func writeHeader(w *bufio.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeSample(w *bufio.Writer, name, labels string, value float64) {
+	if labels == "" {
+		fmt.Fprintf(w, "%s %s\n", name, formatFloat(value))
+		return
+	}
+	fmt.Fprintf(w, "%s{%s} %s\n", name, labels, formatFloat(value))
+}
+
+// MetricsHandler provides the handler writing the metrics of the balancer in Prometheus
+// text format, handler can be mounted on any server in addition to Options.MetricsAddress
+func (lb *LoadBalancer) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", metricsContentType)
+		buf := bufio.NewWriter(w)
+		lb.writeMetrics(buf)
+		_ = buf.Flush()
+	})
+}
+
+func (lb *LoadBalancer) writeMetrics(w *bufio.Writer) {
+	m := lb.metrics
+	m.accepted.write(w, "xlb_connections_accepted_total", "Connections admitted to the pool.")
+	m.rejected.write(w, "xlb_connections_rejected_total", "Connections of the pool rejected by the access list or the limits.")
+	m.blocked.write(w, "xlb_connections_blocked_total", "Connections of the blocked addresses, pool is empty if blocked before the pool was known.")
+	m.handshakeFailures.write(w, "xlb_handshake_failures_total", "Connections failed the handshake or the identity matching.")
+	m.rateLimited.write(w, "xlb_rate_limit_rejections_total", "Connections rejected by the rate limit of the pool or the client.")
+	m.bytesIn.write(w, "xlb_bytes_in_total", "Bytes forwarded from the clients to the routes.")
+	m.bytesOut.write(w, "xlb_bytes_out_total", "Bytes forwarded from the routes to the clients.")
+	m.healthCheck.write(w, "xlb_health_check_duration_seconds", "Latency of the health checks of the routes.")
+	m.dial.write(w, "xlb_dial_duration_seconds", "Latency of dialing the routes.")
+
+	// Gauges are collected from the forwarders of the pools being served
+	type routeState struct {
+		labels      string
+		connections uint32
+		healthy     bool
+	}
+	lb.mutex.Lock()
+	states := make([]routeState, 0)
+	for identity, fwd := range lb.forwarderMap {
+		for _, rte := range fwd.currentRoutes() {
+			states = append(states, routeState{
+				labels:      labels("pool", identity, "route", rte.Address()),
+				connections: rte.Connections(),
+				healthy:     rte.Healthy(),
+			})
+		}
+	}
+	lb.mutex.Unlock()
+	sort.Slice(states, func(i, j int) bool { return states[i].labels < states[j].labels })
+
+	writeHeader(w, "xlb_route_active_connections", "Sessions open at the route.", "gauge")
+	for _, s := range states {
+		writeSample(w, "xlb_route_active_connections", s.labels, float64(s.connections))
+	}
+	writeHeader(w, "xlb_route_healthy", "Health of the route, 1 if healthy.", "gauge")
+	for _, s := range states {
+		healthy := 0.0
+		if s.healthy {
+			healthy = 1
+		}
+		writeSample(w, "xlb_route_healthy", s.labels, healthy)
+	}
+	writeHeader(w, "xlb_blocklist_entries", "Addresses tracked by the blocklist.", "gauge")
+	writeSample(w, "xlb_blocklist_entries", "", float64(lb.ipLRU.Len()))
+	writeHeader(w, "xlb_blocklist_capacity", "Addresses the blocklist can track.", "gauge")
+	writeSample(w, "xlb_blocklist_capacity", "", float64(lb.ipLRU.Capacity()))
+}
+
+// serveHTTP serves the handler on the listener until ctx ends, server is given the
+// shutdown timeout for the requests in flight
+func serveHTTP(ctx context.Context, listener net.Listener, handler http.Handler) error {
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: metricsShutdownTimeout}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), metricsShutdownTimeout)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+	err := server.Serve(listener)
+	<-stopped
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// openMetrics binds the metrics listener if the metrics address is configured
+func (lb *LoadBalancer) openMetrics() (net.Listener, error) {
+	if lb.metricsAddress == "" {
+		return nil, nil
+	}
+	listener, err := net.Listen("tcp", lb.metricsAddress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for metrics on %s, error: %w", lb.metricsAddress, err)
+	}
+	return listener, nil
+}
+
+// serveMetrics serves the metrics on the listener until ctx ends
+func (lb *LoadBalancer) serveMetrics(ctx context.Context, listener net.Listener) {
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, lb.MetricsHandler())
+	lb.serving.Add(1)
+	go func() {
+		defer lb.serving.Done()
+		if err := serveHTTP(ctx, listener, mux); err != nil {
+			lb.logger.Err(err).Msg("metrics server failed")
+		}
+	}()
+}
@@ -0,0 +1,191 @@
+package xlb
+
+import (
+	"context"
+	"github.com/rs/zerolog"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMetricsExposition
+// Will test that counters, histograms and gauges are written in Prometheus text format
+func TestMetricsExposition(t *testing.T) {
+	metrics := NewMetrics()
+	fwd := NewForwarder(ServicePool{
+		SvcIdentity: "pool",
+		SvcRoutes:   []ServicePoolRoute{{ServicePath: "127.0.0.1:1", ServiceActive: true}},
+	}, zerolog.Nop()).withMetrics(metrics)
+	defer fwd.Close()
+	lb := &LoadBalancer{
+		metrics:      metrics,
+		ipLRU:        NewLRUCache(10),
+		forwarderMap: map[string]*Forwarder{"pool": fwd},
+	}
+
+	metrics.connectionAccepted("pool")
+	metrics.connectionAccepted("pool")
+	metrics.connectionRejected("pool", rejectRateLimit)
+	metrics.connectionBlocked(9000, "")
+	metrics.handshakeFailed(9000, handshakeIdentityFailed)
+	bytesIn, bytesOut := metrics.transferCounters("pool")
+	bytesIn.Add(100)
+	bytesOut.Add(250)
+	metrics.dialed("pool", "127.0.0.1:1", time.Millisecond*3)
+	lb.ipLRU.Put("10.0.0.1", time.Now().Add(time.Minute), 1)
+
+	recorder := httptest.NewRecorder()
+	lb.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, metricsPath, nil))
+	if recorder.Header().Get("Content-Type") != metricsContentType {
+		t.Errorf("unexpected content type %s", recorder.Header().Get("Content-Type"))
+	}
+	body := recorder.Body.String()
+	expected := []string{
+		"# TYPE xlb_connections_accepted_total counter",
+		`xlb_connections_accepted_total{pool="pool"} 2`,
+		`xlb_connections_rejected_total{pool="pool",reason="rate-limit"} 1`,
+		`xlb_connections_blocked_total{port="9000",pool=""} 1`,
+		`xlb_handshake_failures_total{port="9000",reason="identity-mismatch"} 1`,
+		`xlb_bytes_in_total{pool="pool"} 100`,
+		`xlb_bytes_out_total{pool="pool"} 250`,
+		"# TYPE xlb_dial_duration_seconds histogram",
+		`xlb_dial_duration_seconds_bucket{pool="pool",route="127.0.0.1:1",le="0.0025"} 0`,
+		`xlb_dial_duration_seconds_bucket{pool="pool",route="127.0.0.1:1",le="0.005"} 1`,
+		`xlb_dial_duration_seconds_bucket{pool="pool",route="127.0.0.1:1",le="+Inf"} 1`,
+		`xlb_dial_duration_seconds_count{pool="pool",route="127.0.0.1:1"} 1`,
+		`xlb_route_active_connections{pool="pool",route="127.0.0.1:1"} 0`,
+		`xlb_route_healthy{pool="pool",route="127.0.0.1:1"} 1`,
+		"xlb_blocklist_entries 1",
+		"xlb_blocklist_capacity 10",
+	}
+	for _, line := range expected {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics should contain %q", line)
+		}
+	}
+}
+
+// TestMetricsServer
+// Will test that metrics are served at the metrics address until the context ends
+func TestMetricsServer(t *testing.T) {
+	lb := &LoadBalancer{
+		metrics:        NewMetrics(),
+		metricsAddress: "127.0.0.1:0",
+		ipLRU:          NewLRUCache(10),
+		forwarderMap:   map[string]*Forwarder{},
+		logger:         zerolog.Nop(),
+	}
+	listener, err := lb.openMetrics()
+	if err != nil {
+		t.Fatalf("cannot open metrics listener, error: %+v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	lb.serveMetrics(ctx, listener)
+
+	resp, err := http.Get("http://" + listener.Addr().String() + metricsPath)
+	if err != nil {
+		t.Fatalf("cannot get metrics, error: %+v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "xlb_blocklist_capacity 10") {
+		t.Errorf("unexpected metrics response %d: %s", resp.StatusCode, body)
+	}
+
+	cancel()
+	lb.serving.Wait()
+	if _, err = http.Get("http://" + listener.Addr().String() + metricsPath); err == nil {
+		t.Errorf("metrics should not be served after the context ended")
+	}
+}
+
+// TestMetricsRemoved
+// Will test that series of the routes and the pools removed are dropped
+func TestMetricsRemoved(t *testing.T) {
+	metrics := NewMetrics()
+	fwd := NewForwarder(ServicePool{
+		SvcIdentity: "pool",
+		SvcRoutes: []ServicePoolRoute{
+			{ServicePath: "127.0.0.1:1", ServiceActive: true},
+			{ServicePath: "127.0.0.1:2", ServiceActive: true},
+		},
+	}, zerolog.Nop()).withMetrics(metrics)
+	defer fwd.Close()
+	lb := &LoadBalancer{
+		metrics:      metrics,
+		ipLRU:        NewLRUCache(10),
+		forwarderMap: map[string]*Forwarder{},
+		poolMap:      map[string]ServicePool{"pool": {SvcIdentity: "pool", SvcPort: 9000}},
+	}
+	write := func() string {
+		recorder := httptest.NewRecorder()
+		lb.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, metricsPath, nil))
+		return recorder.Body.String()
+	}
+
+	for _, pool := range []string{"pool", "pool-2"} {
+		metrics.connectionAccepted(pool)
+		metrics.connectionBlocked(9000, pool)
+		metrics.dialed(pool, "127.0.0.1:1", time.Millisecond)
+		metrics.dialed(pool, "127.0.0.1:2", time.Millisecond)
+	}
+	fwd.UpdateServicePool(ServicePool{
+		SvcIdentity: "pool",
+		SvcRoutes:   []ServicePoolRoute{{ServicePath: "127.0.0.1:1", ServiceActive: true}},
+	})
+	body := write()
+	if strings.Contains(body, `xlb_dial_duration_seconds_count{pool="pool",route="127.0.0.1:2"}`) {
+		t.Errorf("series of the removed route should be dropped")
+	}
+	if !strings.Contains(body, `xlb_dial_duration_seconds_count{pool="pool",route="127.0.0.1:1"} 1`) ||
+		!strings.Contains(body, `xlb_dial_duration_seconds_count{pool="pool-2",route="127.0.0.1:2"} 1`) {
+		t.Errorf("series of the routes left should be kept")
+	}
+
+	if err := lb.RemoveServicePool("pool"); err != nil {
+		t.Fatalf("cannot remove pool, error: %+v", err)
+	}
+	body = write()
+	if strings.Contains(body, `pool="pool"`) {
+		t.Errorf("series of the removed pool should be dropped")
+	}
+	for _, line := range []string{
+		`xlb_connections_accepted_total{pool="pool-2"} 1`,
+		`xlb_connections_blocked_total{port="9000",pool="pool-2"} 1`,
+		`xlb_dial_duration_seconds_count{pool="pool-2",route="127.0.0.1:1"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics should contain %q", line)
+		}
+	}
+}
+
+// TestMetricsTransferredLive
+// Will test that bytes forwarded are counted while the session runs
+func TestMetricsTransferredLive(t *testing.T) {
+	address, stop := startEchoServer(t)
+	defer stop()
+	metrics := NewMetrics()
+	fwd := NewForwarder(ServicePool{
+		SvcIdentity: "pool",
+		SvcRoutes:   []ServicePoolRoute{{ServicePath: address, ServiceActive: true}},
+	}, zerolog.Nop()).withMetrics(metrics)
+	defer fwd.Close()
+
+	// Session makes the round trip of 4 bytes
+	client, result := attachSession(t, fwd)
+	bytesIn, bytesOut := metrics.transferCounters("pool")
+	// Write to the client returns right after the client read it
+	deadline := time.Now().Add(time.Second)
+	for bytesOut.Load() != 4 && time.Now().Before(deadline) {
+		<-time.After(time.Millisecond * 10)
+	}
+	if bytesIn.Load() != 4 || bytesOut.Load() != 4 {
+		t.Errorf("bytes should be counted while session runs, in: %d out: %d", bytesIn.Load(), bytesOut.Load())
+	}
+	client.Close()
+	<-result
+}
@@ -0,0 +1,128 @@
+package xlb
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultEjectionTime       = time.Second * 30
+	defaultMaxEjectionPercent = 10
+)
+
+// OutlierDetection configures passive ejection of the routes failing the live sessions.
+// Session fails if upstream resets or breaks the transport, or if upstream ends the
+// session sooner than MinSessionDuration. Route reaching ConsecutiveFailures is ejected
+// to the health check scheduler and returned to the traffic by the health checks once
+// EjectionTime passed
+type OutlierDetection struct {
+	// Consecutive failed sessions to eject the route, 0 disables the detection
+	ConsecutiveFailures int
+	// Sessions ended by upstream sooner than this are failed, 0 counts transport errors only
+	MinSessionDuration time.Duration
+	// How long ejected route is kept out of traffic (30s default)
+	EjectionTime time.Duration
+	// Share of the active pool routes which can be unhealthy at once, ejection
+	// is skipped above it, at least one route can be ejected (10% default)
+	MaxEjectionPercent int
+}
+
+// Enabled reports if routes are ejected on failures
+func (o OutlierDetection) Enabled() bool { return o.ConsecutiveFailures > 0 }
+
+func (o OutlierDetection) ejectionTime() time.Duration {
+	if o.EjectionTime <= 0 {
+		return defaultEjectionTime
+	}
+	return o.EjectionTime
+}
+
+func (o OutlierDetection) maxEjectionPercent() int {
+	if o.MaxEjectionPercent <= 0 {
+		return defaultMaxEjectionPercent
+	}
+	return o.MaxEjectionPercent
+}
+
+func (o OutlierDetection) validate() error {
+	if o.ConsecutiveFailures < 0 || o.MinSessionDuration < 0 || o.EjectionTime < 0 {
+		return errors.New("outlier detection settings cannot be negative")
+	}
+	if o.MaxEjectionPercent < 0 || o.MaxEjectionPercent > 100 {
+		return errors.New("outlier detection max ejection percent should be within 0-100")
+	}
+	return nil
+}
+
+// upstreamConn records if the transport to the upstream failed during the session
+type upstreamConn struct {
+	net.Conn
+	failed atomic.Bool
+}
+
+func (c *upstreamConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if transportFailure(err) {
+		c.failed.Store(true)
+	}
+	return n, err
+}
+
+func (c *upstreamConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if transportFailure(err) {
+		c.failed.Store(true)
+	}
+	return n, err
+}
+
+// transportFailure reports errors which are not the normal end of the session
+func transportFailure(err error) bool {
+	return err != nil && !(errors.Is(err, io.EOF) || strings.Contains(err.Error(), closedNetworkConnection))
+}
+
+// sessionFailed counts the failure of the route session and ejects the route
+// reaching the consecutive failures if the ejection cap of the pool allows it
+func (f *Forwarder) sessionFailed(rte *Route) {
+	od := f.currentOutlierDetection()
+	if !od.Enabled() {
+		return
+	}
+	if int(rte.failures.Add(1)) < od.ConsecutiveFailures {
+		return
+	}
+	f.ejectMu.Lock()
+	defer f.ejectMu.Unlock()
+	if !rte.Active() || !rte.Healthy() {
+		return
+	}
+	routes := f.currentRoutes()
+	active, unhealthy := 0, 0
+	for _, route := range routes {
+		if route.Active() {
+			active++
+			if !route.Healthy() {
+				unhealthy++
+			}
+		}
+	}
+	if unhealthy >= max(1, active*od.maxEjectionPercent()/100) {
+		f.logger.Warn().Msgf("route %s failing sessions is not ejected, %d of %d routes are unhealthy already", rte.address, unhealthy, active)
+		return
+	}
+	rte.failures.Store(0)
+	if f.health.Eject(f.ctx, rte, f.dialTimeout, od.ejectionTime()) {
+		f.logger.Warn().Msgf("route %s ejected for %s after %d failed sessions", rte.address, od.ejectionTime(), od.ConsecutiveFailures)
+	}
+}
+
+// sessionSucceeded resets the consecutive failures of the route
+func (f *Forwarder) sessionSucceeded(rte *Route) {
+	if rte.failures.Load() != 0 {
+		rte.failures.Store(0)
+	}
+}
@@ -0,0 +1,132 @@
+package xlb
+
+import (
+	"context"
+	"github.com/rs/zerolog"
+	"net"
+	"testing"
+	"time"
+)
+
+// startClosingServer creates the upstream accepting connections and ending them
+// right away, reset makes upstream abort the established connection instead of closing it
+func startClosingServer(t *testing.T, reset bool) string {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot start closing server, error: %+v", err)
+	}
+	t.Cleanup(func() { _ = listen.Close() })
+	go func() {
+		for {
+			conn, err := listen.Accept()
+			if err != nil {
+				return
+			}
+			if reset {
+				_ = conn.(*net.TCPConn).SetLinger(0)
+				<-time.After(time.Millisecond * 50)
+			}
+			_ = conn.Close()
+		}
+	}()
+	return listen.Addr().String()
+}
+
+// attachShortSession attaches the session which is expected to be ended by the upstream
+func attachShortSession(t *testing.T, fwd *Forwarder) {
+	client, server := net.Pipe()
+	defer client.Close()
+	result := make(chan error, 1)
+	go func() {
+		result <- fwd.Attach(context.Background(), server)
+	}()
+	select {
+	case <-result:
+	case <-time.After(time.Second * 2):
+		t.Fatalf("session should be ended by upstream")
+	}
+}
+
+// TestOutlierDetectionShortSessions
+// Will test that routes ending sessions right away are ejected within the ejection
+// cap of the pool and returned to traffic after the ejection time
+func TestOutlierDetectionShortSessions(t *testing.T) {
+	fwd := NewForwarder(ServicePool{
+		SvcIdentity: "test",
+		SvcRoutes: []ServicePoolRoute{
+			{ServicePath: startClosingServer(t, false), ServiceActive: true},
+			{ServicePath: startClosingServer(t, false), ServiceActive: true},
+		},
+		SvcStrategy:                StrategyRoundRobin,
+		SvcHealthCheckRescheduleMs: 200,
+		SvcOutlierDetection: OutlierDetection{
+			ConsecutiveFailures: 2,
+			MinSessionDuration:  time.Second,
+			EjectionTime:        time.Millisecond * 500,
+			MaxEjectionPercent:  50,
+		},
+	}, zerolog.Nop())
+	defer fwd.Close()
+
+	for i := 0; i < 8; i++ {
+		attachShortSession(t, fwd)
+	}
+	ejected := 0
+	var ejectedRoute *Route
+	for _, rte := range fwd.currentRoutes() {
+		if !rte.Healthy() {
+			ejected++
+			ejectedRoute = rte
+		}
+	}
+	if ejected != 1 {
+		t.Fatalf("exactly one of two routes should be ejected with 50%% cap, got: %d", ejected)
+	}
+	// Upstream accepts connections so the health check returns it
+	if !awaitHealth(ejectedRoute, true, time.Second*3) {
+		t.Errorf("ejected route should be returned after the ejection time")
+	}
+}
+
+// TestOutlierDetectionTransportErrors
+// Will test that upstream resetting sessions is ejected while sessions
+// completed normally reset the consecutive failures
+func TestOutlierDetectionTransportErrors(t *testing.T) {
+	resetting := startClosingServer(t, true)
+	pool := ServicePool{
+		SvcIdentity: "test",
+		SvcRoutes:   []ServicePoolRoute{{ServicePath: resetting, ServiceActive: true}},
+		SvcOutlierDetection: OutlierDetection{
+			ConsecutiveFailures: 2,
+			EjectionTime:        time.Minute,
+		},
+	}
+	fwd := NewForwarder(pool, zerolog.Nop())
+	defer fwd.Close()
+	rte := fwd.currentRoutes()[0]
+
+	attachShortSession(t, fwd)
+	if rte.failures.Load() != 1 {
+		t.Fatalf("reset session should be counted as failed, got: %d", rte.failures.Load())
+	}
+	// Session of the healthy upstream resets consecutive failures
+	address, stop := startEchoServer(t)
+	defer stop()
+	pool.SvcRoutes = []ServicePoolRoute{{ServicePath: resetting, ServiceActive: false}, {ServicePath: address, ServiceActive: true}}
+	fwd.UpdateServicePool(pool)
+	client, result := attachSession(t, fwd)
+	client.Close()
+	<-result
+	if echo := fwd.currentRoutes()[1]; echo.failures.Load() != 0 {
+		t.Errorf("completed session should not be counted as failed")
+	}
+
+	pool.SvcRoutes = []ServicePoolRoute{{ServicePath: resetting, ServiceActive: true}}
+	fwd.UpdateServicePool(pool)
+	rte.failures.Store(0)
+	attachShortSession(t, fwd)
+	attachShortSession(t, fwd)
+	if rte.Healthy() {
+		t.Errorf("route resetting sessions should be ejected")
+	}
+}
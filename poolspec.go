@@ -0,0 +1,289 @@
+package xlb
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Health probe types of the ProbeSpec
+const (
+	ProbeTCP  = "tcp"
+	ProbeHTTP = "http"
+	ProbeGRPC = "grpc"
+	ProbeTLS  = "tls"
+)
+
+// Duration is the time.Duration written as the duration string like "1m30s"
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON accepts the duration string or the count of nanoseconds
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case float64:
+		*d = Duration(time.Duration(v))
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", v)
+		}
+		*d = Duration(parsed)
+	case nil:
+		*d = 0
+	default:
+		return fmt.Errorf("invalid duration %s", data)
+	}
+	return nil
+}
+
+// PoolSpec is the ServicePool written as the JSON document, certificates are PEM
+// strings. Settings not set take the defaults of the ServicePool
+type PoolSpec struct {
+	Identity      string      `json:"identity"`
+	Port          int         `json:"port"`
+	ServerNames   []string    `json:"server_names,omitempty"`
+	Certificate   string      `json:"certificate"`
+	PrivateKey    string      `json:"private_key"`
+	CACertificate string      `json:"ca_certificate"`
+	Routes        []RouteSpec `json:"routes"`
+
+	RateQuotaTimes  int                  `json:"rate_quota_times,omitempty"`
+	RateQuotaPeriod Duration             `json:"rate_quota_period,omitempty"`
+	RateLimiter     string               `json:"rate_limiter,omitempty"`
+	ClientRateLimit *KeyedRateLimitSpec  `json:"client_rate_limit,omitempty"`
+	IPRateLimit     *KeyedRateLimitSpec  `json:"ip_rate_limit,omitempty"`
+	ConnectionLimit *ConnectionLimitSpec `json:"connection_limit,omitempty"`
+	Bandwidth       *BandwidthSpec       `json:"bandwidth,omitempty"`
+	BlockPolicy     *BlockPolicySpec     `json:"block_policy,omitempty"`
+	AllowCIDRs      []string             `json:"allow_cidrs,omitempty"`
+	DenyCIDRs       []string             `json:"deny_cidrs,omitempty"`
+
+	Strategy     string   `json:"strategy,omitempty"`
+	HashKey      string   `json:"hash_key,omitempty"`
+	RouteTimeout Duration `json:"route_timeout,omitempty"`
+	DrainTimeout Duration `json:"drain_timeout,omitempty"`
+
+	HealthCheck      *HealthCheckSpec      `json:"health_check,omitempty"`
+	RetryPolicy      *RetryPolicySpec      `json:"retry_policy,omitempty"`
+	OutlierDetection *OutlierDetectionSpec `json:"outlier_detection,omitempty"`
+}
+
+// RouteSpec is the ServicePoolRoute of the PoolSpec, route is active unless disabled
+type RouteSpec struct {
+	Address        string `json:"address"`
+	Disabled       bool   `json:"disabled,omitempty"`
+	Weight         int    `json:"weight,omitempty"`
+	MaxConnections int    `json:"max_connections,omitempty"`
+}
+
+type KeyedRateLimitSpec struct {
+	Times     int      `json:"times"`
+	Period    Duration `json:"period,omitempty"`
+	Algorithm string   `json:"algorithm,omitempty"`
+	Key       string   `json:"key,omitempty"`
+	MaxKeys   int      `json:"max_keys,omitempty"`
+}
+
+type ConnectionLimitSpec struct {
+	MaxConnections       int      `json:"max_connections,omitempty"`
+	MaxClientConnections int      `json:"max_client_connections,omitempty"`
+	ClientKey            string   `json:"client_key,omitempty"`
+	Overflow             string   `json:"overflow,omitempty"`
+	QueueSize            int      `json:"queue_size,omitempty"`
+	QueueTimeout         Duration `json:"queue_timeout,omitempty"`
+}
+
+type BandwidthSpec struct {
+	Ingress       int    `json:"ingress,omitempty"`
+	Egress        int    `json:"egress,omitempty"`
+	ClientIngress int    `json:"client_ingress,omitempty"`
+	ClientEgress  int    `json:"client_egress,omitempty"`
+	ClientKey     string `json:"client_key,omitempty"`
+}
+
+type BlockPolicySpec struct {
+	Threshold       int      `json:"threshold,omitempty"`
+	BlockTime       Duration `json:"block_time,omitempty"`
+	Escalation      string   `json:"escalation,omitempty"`
+	MaxBlockTime    Duration `json:"max_block_time,omitempty"`
+	PrefixThreshold int      `json:"prefix_threshold,omitempty"`
+}
+
+// HealthCheckSpec configures the health checks and the probe of the routes
+type HealthCheckSpec struct {
+	Validations     int        `json:"validations,omitempty"`
+	RecheckInterval Duration   `json:"recheck_interval,omitempty"`
+	Interval        Duration   `json:"interval,omitempty"`
+	Failures        int        `json:"failures,omitempty"`
+	Probe           *ProbeSpec `json:"probe,omitempty"`
+}
+
+// ProbeSpec selects the probe by its type, one of Probe* constants (tcp default)
+type ProbeSpec struct {
+	Type         string `json:"type"`
+	Path         string `json:"path,omitempty"`
+	Host         string `json:"host,omitempty"`
+	ExpectStatus int    `json:"expect_status,omitempty"`
+	ExpectBody   string `json:"expect_body,omitempty"`
+	Service      string `json:"service,omitempty"`
+	// HTTP and gRPC upstreams are called over TLS if set, TLS probe always uses TLS
+	TLS bool `json:"tls,omitempty"`
+	// PEM roots verifying the upstream, system roots if empty
+	CACertificate string `json:"ca_certificate,omitempty"`
+}
+
+type RetryPolicySpec struct {
+	MaxAttempts      int      `json:"max_attempts,omitempty"`
+	Timeout          Duration `json:"timeout,omitempty"`
+	ConnectTimeout   Duration `json:"connect_timeout,omitempty"`
+	BudgetRatio      float64  `json:"budget_ratio,omitempty"`
+	BudgetMinRetries int      `json:"budget_min_retries,omitempty"`
+}
+
+type OutlierDetectionSpec struct {
+	ConsecutiveFailures int      `json:"consecutive_failures,omitempty"`
+	MinSessionDuration  Duration `json:"min_session_duration,omitempty"`
+	EjectionTime        Duration `json:"ejection_time,omitempty"`
+	MaxEjectionPercent  int      `json:"max_ejection_percent,omitempty"`
+}
+
+// ServicePool converts the spec to the pool, pool is not validated
+func (s PoolSpec) ServicePool() (ServicePool, error) {
+	pool := ServicePool{
+		SvcIdentity:          s.Identity,
+		SvcPort:              s.Port,
+		SvcServerNames:       s.ServerNames,
+		Certificate:          s.Certificate,
+		CertKey:              s.PrivateKey,
+		CACert:               s.CACertificate,
+		SvcRateQuotaTimes:    s.RateQuotaTimes,
+		SvcRateQuotaDuration: time.Duration(s.RateQuotaPeriod),
+		SvcRateLimiter:       s.RateLimiter,
+		SvcAllowCIDRs:        s.AllowCIDRs,
+		SvcDenyCIDRs:         s.DenyCIDRs,
+		SvcStrategy:          s.Strategy,
+		SvcHashKey:           s.HashKey,
+		SvcRouteTimeout:      time.Duration(s.RouteTimeout),
+		SvcDrainTimeout:      time.Duration(s.DrainTimeout),
+	}
+	for _, rte := range s.Routes {
+		pool.SvcRoutes = append(pool.SvcRoutes, ServicePoolRoute{
+			ServicePath:           rte.Address,
+			ServiceActive:         !rte.Disabled,
+			ServiceWeight:         rte.Weight,
+			ServiceMaxConnections: rte.MaxConnections,
+		})
+	}
+	if l := s.ClientRateLimit; l != nil {
+		pool.SvcClientRateLimit = KeyedRateLimit{
+			Times: l.Times, Period: time.Duration(l.Period), Algorithm: l.Algorithm, Key: l.Key, MaxKeys: l.MaxKeys,
+		}
+	}
+	if l := s.IPRateLimit; l != nil {
+		pool.SvcIPRateLimit = KeyedRateLimit{
+			Times: l.Times, Period: time.Duration(l.Period), Algorithm: l.Algorithm, Key: l.Key, MaxKeys: l.MaxKeys,
+		}
+	}
+	if l := s.ConnectionLimit; l != nil {
+		pool.SvcConnectionLimit = ConnectionLimit{
+			MaxConnections:       l.MaxConnections,
+			MaxClientConnections: l.MaxClientConnections,
+			ClientKey:            l.ClientKey,
+			Overflow:             l.Overflow,
+			QueueSize:            l.QueueSize,
+			QueueTimeout:         time.Duration(l.QueueTimeout),
+		}
+	}
+	if b := s.Bandwidth; b != nil {
+		pool.SvcBandwidth = Bandwidth{
+			Ingress:       b.Ingress,
+			Egress:        b.Egress,
+			ClientIngress: b.ClientIngress,
+			ClientEgress:  b.ClientEgress,
+			ClientKey:     b.ClientKey,
+		}
+	}
+	if b := s.BlockPolicy; b != nil {
+		pool.SvcBlockPolicy = BlockPolicy{
+			Threshold:       b.Threshold,
+			BlockTime:       time.Duration(b.BlockTime),
+			Escalation:      b.Escalation,
+			MaxBlockTime:    time.Duration(b.MaxBlockTime),
+			PrefixThreshold: b.PrefixThreshold,
+		}
+	}
+	if h := s.HealthCheck; h != nil {
+		pool.SvcHealthCheckValidations = h.Validations
+		pool.SvcHealthCheckRescheduleMs = int(time.Duration(h.RecheckInterval).Milliseconds())
+		pool.SvcHealthCheckIntervalMs = int(time.Duration(h.Interval).Milliseconds())
+		pool.SvcHealthCheckFailures = h.Failures
+		if h.Probe != nil {
+			probe, err := h.Probe.probe()
+			if err != nil {
+				return ServicePool{}, fmt.Errorf("invalid health probe of service pool %s, error: %w", s.Identity, err)
+			}
+			pool.SvcHealthProbe = probe
+		}
+	}
+	if r := s.RetryPolicy; r != nil {
+		pool.SvcRetryPolicy = RetryPolicy{
+			MaxAttempts:      r.MaxAttempts,
+			Timeout:          time.Duration(r.Timeout),
+			ConnectTimeout:   time.Duration(r.ConnectTimeout),
+			BudgetRatio:      r.BudgetRatio,
+			BudgetMinRetries: r.BudgetMinRetries,
+		}
+	}
+	if o := s.OutlierDetection; o != nil {
+		pool.SvcOutlierDetection = OutlierDetection{
+			ConsecutiveFailures: o.ConsecutiveFailures,
+			MinSessionDuration:  time.Duration(o.MinSessionDuration),
+			EjectionTime:        time.Duration(o.EjectionTime),
+			MaxEjectionPercent:  o.MaxEjectionPercent,
+		}
+	}
+	return pool, nil
+}
+
+// probe creates the health probe of the spec
+func (p ProbeSpec) probe() (HealthProbe, error) {
+	var tlsConfig *tls.Config
+	if p.TLS || p.CACertificate != "" || strings.ToLower(p.Type) == ProbeTLS {
+		tlsConfig = &tls.Config{}
+		if p.CACertificate != "" {
+			roots := x509.NewCertPool()
+			if !roots.AppendCertsFromPEM([]byte(p.CACertificate)) {
+				return nil, fmt.Errorf("invalid probe ca data")
+			}
+			tlsConfig.RootCAs = roots
+		}
+	}
+	switch strings.ToLower(p.Type) {
+	case "", ProbeTCP:
+		return TCPProbe{}, nil
+	case ProbeHTTP:
+		return HTTPProbe{
+			Path:         p.Path,
+			Host:         p.Host,
+			TLSConfig:    tlsConfig,
+			ExpectStatus: p.ExpectStatus,
+			ExpectBody:   p.ExpectBody,
+		}, nil
+	case ProbeGRPC:
+		return GRPCProbe{Service: p.Service, TLSConfig: tlsConfig}, nil
+	case ProbeTLS:
+		return TLSProbe{Config: tlsConfig}, nil
+	}
+	return nil, fmt.Errorf("unknown probe type %s", p.Type)
+}
@@ -0,0 +1,53 @@
+package xlb
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// TestPoolSpec
+// Will test that the JSON pool spec is converted to the pool with durations and probe
+func TestPoolSpec(t *testing.T) {
+	data := `{
+		"identity": "test",
+		"port": 9000,
+		"routes": [{"address": "localhost:9001", "weight": 3}, {"address": "localhost:9002", "disabled": true}],
+		"rate_quota_times": 10,
+		"rate_quota_period": "1m",
+		"connection_limit": {"max_connections": 5, "queue_timeout": 1000000000},
+		"health_check": {"interval": "2s", "probe": {"type": "http", "path": "/health", "expect_status": 204}}
+	}`
+	spec := PoolSpec{}
+	if err := json.Unmarshal([]byte(data), &spec); err != nil {
+		t.Fatalf("cannot decode spec, error: %+v", err)
+	}
+	pool, err := spec.ServicePool()
+	if err != nil {
+		t.Fatalf("cannot convert spec, error: %+v", err)
+	}
+	if times, period := pool.RateQuota(); times != 10 || period != time.Minute {
+		t.Errorf("unexpected rate quota %d per %s", times, period)
+	}
+	if pool.ConnectionLimit().QueueTimeout != time.Second {
+		t.Errorf("duration in nanoseconds should be accepted, got: %s", pool.ConnectionLimit().QueueTimeout)
+	}
+	if pool.HealthCheckIntervalMs() != 2000 {
+		t.Errorf("unexpected health check interval %d", pool.HealthCheckIntervalMs())
+	}
+	if probe, ok := pool.HealthProbe().(HTTPProbe); !ok || probe.Path != "/health" || probe.ExpectStatus != 204 {
+		t.Errorf("unexpected probe %+v", pool.HealthProbe())
+	}
+	routes := pool.Routes()
+	if len(routes) != 2 || !routes[0].Active() || routes[0].Weight() != 3 || routes[1].Active() {
+		t.Errorf("unexpected routes %+v", routes)
+	}
+
+	if err = json.Unmarshal([]byte(`{"route_timeout": "soon"}`), &spec); err == nil {
+		t.Errorf("invalid duration should not be decoded")
+	}
+	spec.HealthCheck = &HealthCheckSpec{Probe: &ProbeSpec{Type: "icmp"}}
+	if _, err = spec.ServicePool(); err == nil {
+		t.Errorf("unknown probe type should not be converted")
+	}
+}
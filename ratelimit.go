@@ -0,0 +1,326 @@
+package xlb
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Names of the rate limiting algorithms provided by the package
+const (
+	RateLimiterTokenBucket          = "token-bucket"
+	RateLimiterGCRA                 = "gcra"
+	RateLimiterSlidingWindowLog     = "sliding-window-log"
+	RateLimiterSlidingWindowCounter = "sliding-window-counter"
+)
+
+// RateLimiter decides if the call fits within the rate, implementations
+// are safe for the concurrent use
+type RateLimiter interface {
+	Allow() bool
+}
+
+// ReconfigurableRateLimiter can change the rate keeping the state of the calls already counted
+type ReconfigurableRateLimiter interface {
+	RateLimiter
+	SetRate(rate int, per time.Duration)
+}
+
+// Clock provides the current time to the rate limiters
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// NewRateLimiter creates the limiter of the algorithm allowing rate calls per period,
+// empty name resolves to the token bucket, period defaults to 1 second, nil clock
+// resolves to the system clock
+func NewRateLimiter(algorithm string, rate int, per time.Duration, clock Clock) (RateLimiter, error) {
+	if err := validateRateLimit(algorithm, rate, per); err != nil {
+		return nil, err
+	}
+	per = ratePeriodOrDefault(per)
+	if clock == nil {
+		clock = systemClock{}
+	}
+	switch algorithm {
+	case RateLimiterGCRA:
+		return &gcra{interval: per / time.Duration(rate), limit: per, clock: clock}, nil
+	case RateLimiterSlidingWindowLog:
+		return &slidingWindowLog{log: make([]time.Time, rate), period: per, clock: clock}, nil
+	case RateLimiterSlidingWindowCounter:
+		return &slidingWindowCounter{rate: rate, period: per, clock: clock}, nil
+	}
+	return newTokenBucket(rate, per, clock), nil
+}
+
+// validateRateLimit checks that the algorithm is known and can keep the rate
+func validateRateLimit(algorithm string, rate int, per time.Duration) error {
+	if rate <= 0 {
+		return fmt.Errorf("rate limit should be positive, got %d", rate)
+	}
+	switch algorithm {
+	case "", RateLimiterTokenBucket, RateLimiterSlidingWindowLog, RateLimiterSlidingWindowCounter:
+		return nil
+	case RateLimiterGCRA:
+		// Calls are spaced by the whole nanoseconds
+		if ratePeriodOrDefault(per)/time.Duration(rate) == 0 {
+			return fmt.Errorf("rate %d per %s is too high for %s rate limiter", rate, ratePeriodOrDefault(per), algorithm)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown rate limiter %s", algorithm)
+}
+
+func ratePeriodOrDefault(per time.Duration) time.Duration {
+	if per <= 0 {
+		return time.Second
+	}
+	return per
+}
+
+// TokenBucket rate limiting object, provides capability to count the rate of calls
+// with decision if call fits within certain limits or not. Bucket holds up to
+// tokens and is refilled continuously with tokens per time unit. Calls allowed within
+// any time unit are capped at tokens, so tokens refilled while the burst of the full
+// bucket is served do not let more than tokens through the time unit
+type TokenBucket struct {
+	mutex   sync.Mutex
+	tokens  float64
+	bucket  float64
+	refill  float64
+	updated time.Time
+	clock   Clock
+	// Calls allowed by the slots of the last time unit, slot being filled is at slot index
+	timeUnit  time.Duration
+	slots     [tokenBucketSlots + 1]int
+	slot      int
+	slotStart time.Time
+}
+
+// Slots the time unit is split to count the calls of the last time unit, the oldest slot
+// is counted whole, so calls can be delayed by up to the slot past the time unit
+const tokenBucketSlots = 10
+
+// NewTokenBucket create new token bucket with required params to operate
+func NewTokenBucket(tokens uint32, timeUnit time.Duration) *TokenBucket {
+	return newTokenBucket(int(tokens), ratePeriodOrDefault(timeUnit), systemClock{})
+}
+
+func newTokenBucket(tokens int, timeUnit time.Duration, clock Clock) *TokenBucket {
+	return &TokenBucket{
+		tokens:    float64(tokens),
+		bucket:    float64(tokens),
+		refill:    float64(tokens) / timeUnit.Seconds(),
+		updated:   clock.Now(),
+		clock:     clock,
+		timeUnit:  timeUnit,
+		slotStart: clock.Now(),
+	}
+}
+
+// Allow get the bool decision if this call within rate limit or not
+func (t *TokenBucket) Allow() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	curTime := t.clock.Now()
+	// Calculate as following:
+	// r.tokens/tu -> 10/time-unit -> 10/1 sec -> 10 in 1 second
+	// passed time -> 0.2sec * 10 in one sec = +2 units, fractions are kept for the next call
+	if passTime := curTime.Sub(t.updated); passTime > 0 {
+		t.bucket = min(t.bucket+passTime.Seconds()*t.refill, t.tokens)
+		t.updated = curTime
+	}
+	if t.bucket < 1 || float64(t.lastUnitCalls(curTime)) >= t.tokens {
+		return false
+	}
+	t.bucket--
+	t.slots[t.slot]++
+	return true
+}
+
+// lastUnitCalls moves the slots to the current time and counts the calls they hold
+func (t *TokenBucket) lastUnitCalls(curTime time.Time) int {
+	slotSize := max(t.timeUnit/tokenBucketSlots, 1)
+	if passed := int64(curTime.Sub(t.slotStart) / slotSize); passed > 0 {
+		for i := int64(0); i < min(passed, int64(len(t.slots))); i++ {
+			t.slot = (t.slot + 1) % len(t.slots)
+			t.slots[t.slot] = 0
+		}
+		t.slotStart = t.slotStart.Add(time.Duration(passed) * slotSize)
+	}
+	calls := 0
+	for _, n := range t.slots {
+		calls += n
+	}
+	return calls
+}
+
+// Take takes n tokens even if the bucket holds less, provides how long the caller should
+// wait for the tokens taken in advance to be refilled, calls are not allowed until then
+func (t *TokenBucket) Take(n int) time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	curTime := t.clock.Now()
+	if passTime := curTime.Sub(t.updated); passTime > 0 {
+		t.bucket = min(t.bucket+passTime.Seconds()*t.refill, t.tokens)
+		t.updated = curTime
+	}
+	t.bucket -= float64(n)
+	if t.bucket >= 0 {
+		return 0
+	}
+	return time.Duration(-t.bucket / t.refill * float64(time.Second))
+}
+
+// SetRate changes the bucket size and the refill rate, tokens refilled so far
+// are kept up to the new bucket size
+func (t *TokenBucket) SetRate(tokens int, timeUnit time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	curTime := t.clock.Now()
+	if passTime := curTime.Sub(t.updated); passTime > 0 {
+		t.bucket = min(t.bucket+passTime.Seconds()*t.refill, t.tokens)
+		t.updated = curTime
+	}
+	t.tokens = float64(tokens)
+	t.refill = float64(tokens) / timeUnit.Seconds()
+	t.timeUnit = timeUnit
+	t.bucket = min(t.bucket, t.tokens)
+}
+
+// WithinRateLimit get the bool decision if this call within rate limit or not
+func (t *TokenBucket) WithinRateLimit() bool {
+	return t.Allow()
+}
+
+// gcra is the generic cell rate algorithm, calls are allowed while the theoretical
+// arrival time of the next call is within the period from now, which allows the
+// burst of the full rate and spaces calls evenly after it
+type gcra struct {
+	mutex    sync.Mutex
+	tat      time.Time
+	interval time.Duration
+	limit    time.Duration
+	clock    Clock
+}
+
+func (g *gcra) Allow() bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	now := g.clock.Now()
+	tat := g.tat
+	if tat.Before(now) {
+		tat = now
+	}
+	next := tat.Add(g.interval)
+	if next.Sub(now) > g.limit {
+		return false
+	}
+	g.tat = next
+	return true
+}
+
+// SetRate changes the spacing and the burst of the calls, calls already
+// allowed keep delaying the next ones within the new burst
+func (g *gcra) SetRate(rate int, per time.Duration) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.interval = per / time.Duration(rate)
+	g.limit = per
+	if latest := g.clock.Now().Add(g.limit); g.tat.After(latest) {
+		g.tat = latest
+	}
+}
+
+// slidingWindowLog keeps the time of every allowed call within the period,
+// exact but takes the memory of the rate, prefer the other algorithms for
+// the large rates
+type slidingWindowLog struct {
+	mutex  sync.Mutex
+	log    []time.Time
+	head   int
+	count  int
+	period time.Duration
+	clock  Clock
+}
+
+func (s *slidingWindowLog) Allow() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := s.clock.Now()
+	// Forget the calls which left the window
+	for s.count > 0 && !s.log[s.head].After(now.Add(-s.period)) {
+		s.head = (s.head + 1) % len(s.log)
+		s.count--
+	}
+	if s.count == len(s.log) {
+		return false
+	}
+	s.log[(s.head+s.count)%len(s.log)] = now
+	s.count++
+	return true
+}
+
+// SetRate resizes the log keeping the latest calls fitting the new rate
+func (s *slidingWindowLog) SetRate(rate int, per time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	log := make([]time.Time, rate)
+	count := min(s.count, rate)
+	for i := 0; i < count; i++ {
+		log[i] = s.log[(s.head+s.count-count+i)%len(s.log)]
+	}
+	s.log = log
+	s.head = 0
+	s.count = count
+	s.period = per
+}
+
+// slidingWindowCounter approximates the sliding window by weighting the count
+// of the previous fixed window by its share still covered by the sliding window
+type slidingWindowCounter struct {
+	mutex    sync.Mutex
+	rate     int
+	period   time.Duration
+	window   time.Time
+	current  int
+	previous int
+	clock    Clock
+}
+
+func (s *slidingWindowCounter) Allow() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := s.clock.Now()
+	if s.window.IsZero() {
+		s.window = now
+	}
+	if elapsed := now.Sub(s.window); elapsed >= s.period {
+		// Previous window is the one just ended only if no full window passed since
+		if elapsed < s.period*2 {
+			s.previous = s.current
+		} else {
+			s.previous = 0
+		}
+		s.current = 0
+		s.window = s.window.Add(elapsed / s.period * s.period)
+	}
+	covered := 1 - float64(now.Sub(s.window))/float64(s.period)
+	if float64(s.previous)*covered+float64(s.current) >= float64(s.rate) {
+		return false
+	}
+	s.current++
+	return true
+}
+
+// SetRate changes the rate and the window keeping the counts of the current windows
+func (s *slidingWindowCounter) SetRate(rate int, per time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.rate = rate
+	s.period = per
+}
@@ -0,0 +1,212 @@
+package xlb
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock is the clock moved only by the test
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// allowed counts the calls allowed by the limiter out of calls
+func allowed(limiter RateLimiter, calls int) int {
+	count := 0
+	for i := 0; i < calls; i++ {
+		if limiter.Allow() {
+			count++
+		}
+	}
+	return count
+}
+
+// TestRateLimiters
+// Will test every algorithm allows the burst of the rate and the calls
+// following the burst as time passes
+func TestRateLimiters(t *testing.T) {
+	// Calls allowed after the burst of 10 per second when 100ms, 500ms and 1.6s passed
+	cases := []struct {
+		algorithm string
+		after     []int
+	}{
+		// Bucket refilled while serving the burst does not exceed the rate within the second
+		{RateLimiterTokenBucket, []int{0, 0, 10}},
+		{RateLimiterGCRA, []int{1, 4, 10}},
+		// Log allows calls only as the burst leaves the window
+		{RateLimiterSlidingWindowLog, []int{0, 0, 10}},
+		// Counter weights the burst of the previous window by its share left in the window
+		{RateLimiterSlidingWindowCounter, []int{0, 0, 6}},
+	}
+	for _, c := range cases {
+		t.Run(c.algorithm, func(t *testing.T) {
+			clock := newFakeClock()
+			limiter, err := NewRateLimiter(c.algorithm, 10, time.Second, clock)
+			if err != nil {
+				t.Fatalf("cannot create limiter, error: %+v", err)
+			}
+			if got := allowed(limiter, 20); got != 10 {
+				t.Fatalf("burst of 10 should be allowed, got: %d", got)
+			}
+			for i, passed := range []time.Duration{time.Millisecond * 100, time.Millisecond * 400, time.Millisecond * 1100} {
+				clock.Advance(passed)
+				if got := allowed(limiter, 20); got != c.after[i] {
+					t.Errorf("after %d step expected %d calls allowed, got: %d", i, c.after[i], got)
+				}
+			}
+		})
+	}
+
+	if _, err := NewRateLimiter("leaky", 10, time.Second, nil); err == nil {
+		t.Errorf("unknown algorithm should not be created")
+	}
+	if _, err := NewRateLimiter(RateLimiterGCRA, 0, time.Second, nil); err == nil {
+		t.Errorf("zero rate should not be created")
+	}
+	// Calls cannot be spaced by less than a nanosecond
+	if _, err := NewRateLimiter(RateLimiterGCRA, 2000, time.Microsecond, nil); err == nil {
+		t.Errorf("gcra rate finer than its resolution should not be created")
+	}
+	pool := ServicePool{SvcIdentity: "test", SvcRateLimiter: RateLimiterGCRA, SvcRateQuotaTimes: 2000, SvcRateQuotaDuration: time.Microsecond}
+	if err := validateServicePool(pool); err == nil {
+		t.Errorf("pool with gcra rate finer than its resolution should not be valid")
+	}
+	pool.SvcClientRateLimit = KeyedRateLimit{Times: 2000, Period: time.Microsecond, Algorithm: RateLimiterGCRA}
+	if err := pool.ClientRateLimit().validate(); err == nil {
+		t.Errorf("client limit with gcra rate finer than its resolution should not be valid")
+	}
+	limiter, err := NewRateLimiter("", 10, time.Second, nil)
+	if _, ok := limiter.(*TokenBucket); err != nil || !ok {
+		t.Errorf("token bucket should be the default limiter, got: %T", limiter)
+	}
+}
+
+// TestTokenBucketPrecision
+// Will test that fractions of the refilled tokens are not lost between calls
+func TestTokenBucketPrecision(t *testing.T) {
+	clock := newFakeClock()
+	bucket := newTokenBucket(10, time.Second, clock)
+	bucket.Take(10)
+	// Every step refills half of the token
+	for i := 0; i < 10; i++ {
+		clock.Advance(time.Millisecond * 50)
+		got := bucket.Allow()
+		if expected := i%2 == 1; got != expected {
+			t.Errorf("step %d expected allowed %v, got %v", i, expected, got)
+		}
+	}
+}
+
+// TestTokenBucketWindow
+// Will test that calls allowed within any time unit do not exceed the tokens while
+// the bucket is refilled during the bursts
+func TestTokenBucketWindow(t *testing.T) {
+	clock := newFakeClock()
+	bucket := newTokenBucket(10, time.Second, clock)
+	start := clock.Now()
+	allowedAt := make([]time.Duration, 0)
+	for step := 0; step < 500; step++ {
+		if bucket.Allow() {
+			allowedAt = append(allowedAt, clock.Now().Sub(start))
+		}
+		clock.Advance(time.Millisecond * 10)
+	}
+	for i := range allowedAt {
+		if i+10 < len(allowedAt) && allowedAt[i+10]-allowedAt[i] < time.Second {
+			t.Fatalf("more than 10 calls allowed within a second starting at %s", allowedAt[i])
+		}
+	}
+	if len(allowedAt) < 40 {
+		t.Errorf("rate should be kept under the steady load, allowed: %d in 5s", len(allowedAt))
+	}
+}
+
+// TestSlidingWindowCounterIdle
+// Will test that counter forgets the windows passed without calls
+func TestSlidingWindowCounterIdle(t *testing.T) {
+	clock := newFakeClock()
+	limiter, _ := NewRateLimiter(RateLimiterSlidingWindowCounter, 10, time.Second, clock)
+	allowed(limiter, 10)
+	clock.Advance(time.Millisecond * 2500)
+	if got := allowed(limiter, 20); got != 10 {
+		t.Errorf("full rate should be allowed after idle windows, got: %d", got)
+	}
+}
+
+// TestRateLimitersConcurrent
+// Will test that concurrent callers never exceed the rate
+func TestRateLimitersConcurrent(t *testing.T) {
+	for _, algorithm := range []string{RateLimiterTokenBucket, RateLimiterGCRA, RateLimiterSlidingWindowLog, RateLimiterSlidingWindowCounter} {
+		clock := newFakeClock()
+		limiter, _ := NewRateLimiter(algorithm, 100, time.Second, clock)
+		var count atomic.Int32
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				count.Add(int32(allowed(limiter, 20)))
+			}()
+		}
+		wg.Wait()
+		if count.Load() != 100 {
+			t.Errorf("%s should allow exactly the rate, got: %d", algorithm, count.Load())
+		}
+	}
+}
+
+// TestRateLimitersSetRate
+// Will test that reconfigured limiters keep the calls already counted
+func TestRateLimitersSetRate(t *testing.T) {
+	// Calls allowed right after raising the rate from 10 to 20 and after 100ms
+	cases := []struct {
+		algorithm string
+		after     []int
+	}{
+		{RateLimiterTokenBucket, []int{0, 2}},
+		{RateLimiterGCRA, []int{0, 2}},
+		{RateLimiterSlidingWindowLog, []int{10, 0}},
+		{RateLimiterSlidingWindowCounter, []int{10, 0}},
+	}
+	for _, c := range cases {
+		t.Run(c.algorithm, func(t *testing.T) {
+			clock := newFakeClock()
+			limiter, _ := NewRateLimiter(c.algorithm, 10, time.Second, clock)
+			allowed(limiter, 10)
+			limiter.(ReconfigurableRateLimiter).SetRate(20, time.Second)
+			if got := allowed(limiter, 30); got != c.after[0] {
+				t.Errorf("expected %d calls allowed after raise, got: %d", c.after[0], got)
+			}
+			clock.Advance(time.Millisecond * 100)
+			if got := allowed(limiter, 30); got != c.after[1] {
+				t.Errorf("expected %d calls allowed after 100ms, got: %d", c.after[1], got)
+			}
+
+			// Lowered rate is applied to the calls already counted
+			limiter.(ReconfigurableRateLimiter).SetRate(5, time.Second)
+			clock.Advance(time.Millisecond * 500)
+			if got := allowed(limiter, 30); got > 3 {
+				t.Errorf("lowered rate should not allow the calls already counted, got: %d", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,302 @@
+package xlb
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRedisKeyPrefix   = "xlb:blocklist:"
+	defaultRedisDialTimeout = time.Second * 5
+	redisScanCount          = 1000
+	redisMergeAttempts      = 5
+)
+
+// RedisBlocklistStore shares the blocklist between the balancers through the server
+// speaking the Redis protocol, every entry is kept under its own key expiring with the entry,
+// entries written by the balancers are merged with the stored ones
+type RedisBlocklistStore struct {
+	address     string
+	prefix      string
+	password    string
+	dialTimeout time.Duration
+}
+
+// NewRedisBlocklistStore creates the store of the server at address, keys are prefixed
+// with the prefix (xlb:blocklist: default), empty password skips the authentication
+func NewRedisBlocklistStore(address, prefix, password string) *RedisBlocklistStore {
+	if prefix == "" {
+		prefix = defaultRedisKeyPrefix
+	}
+	return &RedisBlocklistStore{
+		address:     address,
+		prefix:      prefix,
+		password:    password,
+		dialTimeout: defaultRedisDialTimeout,
+	}
+}
+
+func (r *RedisBlocklistStore) Load(ctx context.Context) ([]CacheEntry, error) {
+	conn, err := r.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	keys := make([]string, 0)
+	cursor := "0"
+	for {
+		reply, err := conn.do([]string{"SCAN", cursor, "MATCH", r.prefix + "*", "COUNT", strconv.Itoa(redisScanCount)})
+		if err != nil {
+			return nil, err
+		}
+		page, ok := reply.([]interface{})
+		if !ok || len(page) != 2 {
+			return nil, fmt.Errorf("unexpected scan reply %v", reply)
+		}
+		cursor, _ = page[0].(string)
+		found, _ := page[1].([]interface{})
+		for _, key := range found {
+			if k, ok := key.(string); ok {
+				keys = append(keys, k)
+			}
+		}
+		if cursor == "0" || cursor == "" {
+			break
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	reply, err := conn.do(append([]string{"MGET"}, keys...))
+	if err != nil {
+		return nil, err
+	}
+	values, ok := reply.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected mget reply %v", reply)
+	}
+	entries := make([]CacheEntry, 0, len(values))
+	for _, value := range values {
+		// Keys expired since the scan are skipped
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		entry := CacheEntry{}
+		if err = json.Unmarshal([]byte(data), &entry); err != nil {
+			return nil, fmt.Errorf("cannot parse blocklist entry, error: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Save merges the entries with the entries kept by the store, stored entry keeps the
+// greater count and the later expiry for the balancer not to undo the block escalated
+// by the other balancer. Keys are watched while merged and the merge is repeated if
+// the other balancer changed them meanwhile
+func (r *RedisBlocklistStore) Save(ctx context.Context, entries []CacheEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	conn, err := r.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	keys := make([]string, len(entries))
+	for i, entry := range entries {
+		keys[i] = r.prefix + entry.IP
+	}
+	for attempt := 0; attempt < redisMergeAttempts; attempt++ {
+		if _, err = conn.do(append([]string{"WATCH"}, keys...)); err != nil {
+			return err
+		}
+		reply, err := conn.do(append([]string{"MGET"}, keys...))
+		if err != nil {
+			return err
+		}
+		stored, ok := reply.([]interface{})
+		if !ok || len(stored) != len(entries) {
+			return fmt.Errorf("unexpected mget reply %v", reply)
+		}
+		commands := make([][]string, 0, len(entries)+2)
+		commands = append(commands, []string{"MULTI"})
+		for i, entry := range entries {
+			// Entries which cannot be parsed are replaced
+			existing := CacheEntry{}
+			if data, ok := stored[i].(string); ok && json.Unmarshal([]byte(data), &existing) == nil {
+				entry = mergeEntries(entry, existing)
+			}
+			command, ok, err := r.setCommand(entry)
+			if err != nil {
+				return err
+			}
+			if ok {
+				commands = append(commands, command)
+			}
+		}
+		commands = append(commands, []string{"EXEC"})
+		replies, err := conn.pipeline(commands)
+		if err != nil {
+			return err
+		}
+		// Transaction is aborted with the nil reply if any of the keys changed
+		if replies[len(replies)-1] != nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot save blocklist entries, entries keep changing by other balancers")
+}
+
+func (r *RedisBlocklistStore) Publish(ctx context.Context, entry CacheEntry) error {
+	return r.Save(ctx, []CacheEntry{entry})
+}
+
+// setCommand stores the entry until it expires, expired entries are not stored
+func (r *RedisBlocklistStore) setCommand(entry CacheEntry) ([]string, bool, error) {
+	ttl := time.Until(entry.ExpiresAt).Milliseconds()
+	if ttl <= 0 {
+		return nil, false, nil
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return nil, false, err
+	}
+	return []string{"SET", r.prefix + entry.IP, string(data), "PX", strconv.FormatInt(ttl, 10)}, true, nil
+}
+
+func (r *RedisBlocklistStore) dial(ctx context.Context) (*redisConn, error) {
+	dialer := net.Dialer{Timeout: r.dialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", r.address)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to blocklist store %s, error: %w", r.address, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	rc := &redisConn{Conn: conn, reader: bufio.NewReader(conn)}
+	if r.password != "" {
+		if _, err = rc.do([]string{"AUTH", r.password}); err != nil {
+			rc.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// redisConn speaks the Redis serialization protocol
+type redisConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *redisConn) do(command []string) (interface{}, error) {
+	if err := c.write(command); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+// pipeline sends all the commands before reading the replies
+func (c *redisConn) pipeline(commands [][]string) ([]interface{}, error) {
+	for _, command := range commands {
+		if err := c.write(command); err != nil {
+			return nil, err
+		}
+	}
+	replies := make([]interface{}, len(commands))
+	for i := range commands {
+		reply, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+func (c *redisConn) write(command []string) error {
+	_, err := c.Write(encodeRESP(command))
+	return err
+}
+
+func (c *redisConn) read() (interface{}, error) {
+	return decodeRESP(c.reader)
+}
+
+// encodeRESP encodes the command as the array of bulk strings
+func encodeRESP(command []string) []byte {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(command)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range command {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	return buf
+}
+
+// decodeRESP reads the single reply, bulk and simple strings are decoded as string,
+// integers as int64, arrays as []interface{}, nil replies as nil and errors as error
+func decodeRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, errors.New("empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("blocklist store error: %s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		data := make([]byte, size+2)
+		if _, err = io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, size)
+		for i := range items {
+			if items[i], err = decodeRESP(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
@@ -0,0 +1,111 @@
+package xlb
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRetryMaxAttempts      = 3
+	defaultRetryConnectTimeout   = time.Second * 5
+	defaultRetryBudgetRatio      = 0.2
+	defaultRetryBudgetMinRetries = 10
+)
+
+// RetryPolicy bounds how the forwarder fails over to the other routes when dialing the
+// route fails. Every session may retry up to MaxAttempts within Timeout, while retries of
+// all the pool sessions are limited by the budget: every session adds BudgetRatio to the
+// budget and every retry takes one, BudgetMinRetries is both the initial and the max budget,
+// so retries cannot multiply the load of the pool when most of the routes are failing
+type RetryPolicy struct {
+	// Dial attempts of the session including the first one (3 default)
+	MaxAttempts int
+	// Time for all the attempts of the session (RouteTimeout of the pool default)
+	Timeout time.Duration
+	// Timeout of the single dial attempt (5s or RouteTimeout if less default)
+	ConnectTimeout time.Duration
+	// Retries earned by every session, within 0-1 (0.2 default)
+	BudgetRatio float64
+	// Retries available without sessions earning them (10 default)
+	BudgetMinRetries int
+}
+
+func (r RetryPolicy) maxAttempts() int {
+	if r.MaxAttempts <= 0 {
+		return defaultRetryMaxAttempts
+	}
+	return r.MaxAttempts
+}
+
+func (r RetryPolicy) timeout(routeTimeout time.Duration) time.Duration {
+	if r.Timeout <= 0 {
+		return routeTimeout
+	}
+	return r.Timeout
+}
+
+func (r RetryPolicy) connectTimeout(routeTimeout time.Duration) time.Duration {
+	if r.ConnectTimeout <= 0 {
+		return min(defaultRetryConnectTimeout, routeTimeout)
+	}
+	return r.ConnectTimeout
+}
+
+func (r RetryPolicy) budgetRatio() float64 {
+	if r.BudgetRatio <= 0 {
+		return defaultRetryBudgetRatio
+	}
+	return r.BudgetRatio
+}
+
+func (r RetryPolicy) budgetMinRetries() int {
+	if r.BudgetMinRetries <= 0 {
+		return defaultRetryBudgetMinRetries
+	}
+	return r.BudgetMinRetries
+}
+
+func (r RetryPolicy) validate() error {
+	if r.MaxAttempts < 0 || r.Timeout < 0 || r.ConnectTimeout < 0 || r.BudgetMinRetries < 0 {
+		return errors.New("retry policy settings cannot be negative")
+	}
+	if r.BudgetRatio < 0 || r.BudgetRatio > 1 {
+		return errors.New("retry budget ratio should be within 0-1")
+	}
+	return nil
+}
+
+// retryBudget is the pool-wide balance of the retries earned by the sessions
+type retryBudget struct {
+	mutex   sync.Mutex
+	balance float64
+	started bool
+}
+
+// deposit adds the share of retry for the new session
+func (b *retryBudget) deposit(policy RetryPolicy) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.init(policy)
+	b.balance = min(b.balance+policy.budgetRatio(), float64(policy.budgetMinRetries()))
+}
+
+// withdraw takes one retry from the budget, false if budget is exhausted
+func (b *retryBudget) withdraw(policy RetryPolicy) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.init(policy)
+	if b.balance < 1 {
+		return false
+	}
+	b.balance--
+	return true
+}
+
+func (b *retryBudget) init(policy RetryPolicy) {
+	if !b.started {
+		b.balance = float64(policy.budgetMinRetries())
+		b.started = true
+	}
+}
@@ -0,0 +1,123 @@
+package xlb
+
+import (
+	"context"
+	"github.com/rs/zerolog"
+	"net"
+	"testing"
+)
+
+// closedAddresses provides the local addresses refusing connections
+func closedAddresses(t *testing.T, count int) []ServicePoolRoute {
+	routes := make([]ServicePoolRoute, 0, count)
+	for i := 0; i < count; i++ {
+		listen, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("cannot reserve address, error: %+v", err)
+		}
+		routes = append(routes, ServicePoolRoute{ServicePath: listen.Addr().String(), ServiceActive: true})
+		_ = listen.Close()
+	}
+	return routes
+}
+
+func unhealthyRoutes(fwd *Forwarder) int {
+	unhealthy := 0
+	for _, rte := range fwd.currentRoutes() {
+		if !rte.Healthy() {
+			unhealthy++
+		}
+	}
+	return unhealthy
+}
+
+// TestRetryBudget
+// Will test that retries are limited by the retries earned by the sessions
+func TestRetryBudget(t *testing.T) {
+	policy := RetryPolicy{BudgetRatio: 0.5, BudgetMinRetries: 2}
+	budget := retryBudget{}
+	budget.deposit(policy)
+	for i := 0; i < 2; i++ {
+		if !budget.withdraw(policy) {
+			t.Fatalf("initial retries should be available")
+		}
+	}
+	if budget.withdraw(policy) {
+		t.Fatalf("budget should be exhausted")
+	}
+	budget.deposit(policy)
+	if budget.withdraw(policy) {
+		t.Errorf("half of the retry should not be withdrawn")
+	}
+	budget.deposit(policy)
+	if !budget.withdraw(policy) {
+		t.Errorf("retry earned by two sessions should be available")
+	}
+	// Budget is capped by the min retries
+	for i := 0; i < 10; i++ {
+		budget.deposit(policy)
+	}
+	for i := 0; i < 2; i++ {
+		budget.withdraw(policy)
+	}
+	if budget.withdraw(policy) {
+		t.Errorf("budget should be capped by min retries")
+	}
+}
+
+// TestForwarderRetryPolicy
+// Will test that session fails over to the other routes within the max attempts
+// and the retry budget of the pool
+func TestForwarderRetryPolicy(t *testing.T) {
+	address, stop := startEchoServer(t)
+	defer stop()
+
+	// Session succeeds on the last attempt allowed
+	routes := append(closedAddresses(t, 2), ServicePoolRoute{ServicePath: address, ServiceActive: true})
+	fwd := NewForwarder(ServicePool{
+		SvcIdentity:    "test",
+		SvcRoutes:      routes,
+		SvcStrategy:    StrategyRoundRobin,
+		SvcRetryPolicy: RetryPolicy{MaxAttempts: 3},
+	}, zerolog.Nop())
+	client, result := attachSession(t, fwd)
+	client.Close()
+	if err := <-result; err != nil {
+		t.Errorf("session should fail over to reachable route, error: %+v", err)
+	}
+	fwd.Close()
+
+	// Attempts are bounded
+	fwd = NewForwarder(ServicePool{
+		SvcIdentity:    "test",
+		SvcRoutes:      closedAddresses(t, 5),
+		SvcRetryPolicy: RetryPolicy{MaxAttempts: 2},
+	}, zerolog.Nop())
+	if err := fwd.Attach(context.Background(), &net.TCPConn{}); err == nil {
+		t.Errorf("session should fail when routes are unreachable")
+	}
+	if unhealthy := unhealthyRoutes(fwd); unhealthy != 2 {
+		t.Errorf("session should try 2 routes, tried: %d", unhealthy)
+	}
+	fwd.Close()
+
+	// Retries of the pool are bounded by the budget
+	fwd = NewForwarder(ServicePool{
+		SvcIdentity:    "test",
+		SvcRoutes:      closedAddresses(t, 10),
+		SvcRetryPolicy: RetryPolicy{MaxAttempts: 10, BudgetMinRetries: 2, BudgetRatio: 0.1},
+	}, zerolog.Nop())
+	defer fwd.Close()
+	if err := fwd.Attach(context.Background(), &net.TCPConn{}); err == nil {
+		t.Errorf("session should fail when retry budget exhausted")
+	}
+	if unhealthy := unhealthyRoutes(fwd); unhealthy != 3 {
+		t.Errorf("session should try first route and 2 retries, tried: %d", unhealthy)
+	}
+	if err := fwd.Attach(context.Background(), &net.TCPConn{}); err == nil {
+		t.Errorf("session should fail when retry budget exhausted")
+	}
+	if unhealthy := unhealthyRoutes(fwd); unhealthy != 4 {
+		t.Errorf("next session should not retry, tried: %d", unhealthy)
+	}
+}
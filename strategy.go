@@ -0,0 +1,202 @@
+package xlb
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+// Names of the balancing strategies provided by the package
+const (
+	StrategyLeastConnections   = "least-connections"
+	StrategyRoundRobin         = "round-robin"
+	StrategyWeightedRoundRobin = "weighted-round-robin"
+	StrategyRandom             = "random"
+	StrategyPowerOfTwoChoices  = "power-of-two-choices"
+	StrategyConsistentHash     = "consistent-hash"
+)
+
+// Strategy selects the route for every new session of the Forwarder.
+// Next receives the current snapshot of the forwarder routes and should
+// select only the routes reporting Available, nil means no route can be
+// selected. Opened and Closed are called when session to the route selected
+// by Next was established and when it ended. Strategy is called concurrently
+type Strategy interface {
+	Next(routes []*Route) *Route
+	Opened(rte *Route)
+	Closed(rte *Route)
+}
+
+// NewStrategy creates the instance of the strategy provided by the package,
+// empty name resolves to the least connections strategy
+func NewStrategy(name string) (Strategy, error) {
+	switch name {
+	case "", StrategyLeastConnections:
+		return &leastConnection{}, nil
+	case StrategyRoundRobin:
+		return &roundRobin{}, nil
+	case StrategyWeightedRoundRobin:
+		return &weightedRoundRobin{current: map[*Route]int{}}, nil
+	case StrategyRandom:
+		return &random{}, nil
+	case StrategyPowerOfTwoChoices:
+		return &powerOfTwoChoices{}, nil
+	case StrategyConsistentHash:
+		return &consistentHash{}, nil
+	}
+	return nil, fmt.Errorf("unknown balancing strategy %s", name)
+}
+
+// connectionHooks provides no-op hooks for strategies relying on the
+// connections counted by the forwarder itself
+type connectionHooks struct{}
+
+func (connectionHooks) Opened(*Route) {}
+
+func (connectionHooks) Closed(*Route) {}
+
+type leastConnection struct {
+	connectionHooks
+}
+
+// Next will make selection of the next route using the algorithm of least
+// utilization (from the standpoint of this system) of the host connectivity,
+// utilization is the count of connections relative to the route weight
+func (lc *leastConnection) Next(routes []*Route) *Route {
+	var rte *Route
+	for _, route := range routes {
+		if route.Available() {
+			if rte == nil || lessLoaded(route, rte) {
+				rte = route
+			}
+		}
+	}
+	// @ManualTesting
+	// to observe the route to be dispatched in logs, uncomment following line
+	//if rte != nil {
+	//	fmt.Println(fmt.Sprintf("[FORWARDER][STRATEGY][TEST] route selected: %s %d %v", rte.address, rte.connections, rte.healthy.Load()))
+	//}
+	return rte
+}
+
+type roundRobin struct {
+	connectionHooks
+	next uint32
+}
+
+// Next will select the routes one after another skipping unavailable ones
+func (rr *roundRobin) Next(routes []*Route) *Route {
+	if len(routes) == 0 {
+		return nil
+	}
+	start := atomic.AddUint32(&rr.next, 1) - 1
+	for i := 0; i < len(routes); i++ {
+		route := routes[(int(start%uint32(len(routes)))+i)%len(routes)]
+		if route.Available() {
+			return route
+		}
+	}
+	return nil
+}
+
+type weightedRoundRobin struct {
+	connectionHooks
+	mutex   sync.Mutex
+	current map[*Route]int
+}
+
+// Next will select the routes proportionally to their weights, spreading
+// the selections of the same route evenly (smooth weighted round-robin)
+func (wrr *weightedRoundRobin) Next(routes []*Route) *Route {
+	wrr.mutex.Lock()
+	defer wrr.mutex.Unlock()
+
+	// Forget the state of the routes removed from the forwarder
+	if len(wrr.current) > len(routes) {
+		present := make(map[*Route]int, len(routes))
+		for _, route := range routes {
+			if w, ok := wrr.current[route]; ok {
+				present[route] = w
+			}
+		}
+		wrr.current = present
+	}
+
+	var rte *Route
+	total := 0
+	for _, route := range routes {
+		if !route.Available() {
+			continue
+		}
+		weight := route.Weight()
+		wrr.current[route] += weight
+		total += weight
+		if rte == nil || wrr.current[route] > wrr.current[rte] {
+			rte = route
+		}
+	}
+	if rte != nil {
+		wrr.current[rte] -= total
+	}
+	return rte
+}
+
+type random struct {
+	connectionHooks
+}
+
+// Next will select uniformly random route among the available ones
+func (r *random) Next(routes []*Route) *Route {
+	available := availableRoutes(routes)
+	if len(available) == 0 {
+		return nil
+	}
+	return available[rand.Intn(len(available))]
+}
+
+type powerOfTwoChoices struct {
+	connectionHooks
+}
+
+// Next will pick two random routes among the available ones and
+// select the one with fewer connections relative to its weight
+func (p *powerOfTwoChoices) Next(routes []*Route) *Route {
+	available := availableRoutes(routes)
+	switch len(available) {
+	case 0:
+		return nil
+	case 1:
+		return available[0]
+	}
+	i := rand.Intn(len(available))
+	j := rand.Intn(len(available) - 1)
+	if j >= i {
+		j++
+	}
+	if lessLoaded(available[j], available[i]) {
+		return available[j]
+	}
+	return available[i]
+}
+
+// lessLoaded compares connections/weight of the routes, equally loaded
+// routes are compared by weight for the heavier route to be preferred
+func lessLoaded(a, b *Route) bool {
+	aLoad := uint64(a.Connections()) * uint64(b.Weight())
+	bLoad := uint64(b.Connections()) * uint64(a.Weight())
+	if aLoad == bLoad {
+		return a.Weight() > b.Weight()
+	}
+	return aLoad < bLoad
+}
+
+func availableRoutes(routes []*Route) []*Route {
+	available := make([]*Route, 0, len(routes))
+	for _, route := range routes {
+		if route.Available() {
+			available = append(available, route)
+		}
+	}
+	return available
+}
@@ -0,0 +1,146 @@
+package xlb
+
+import (
+	"fmt"
+	"testing"
+)
+
+// newTestRoutes creates available routes with the provided weights
+func newTestRoutes(weights ...int) []*Route {
+	routes := make([]*Route, len(weights))
+	for i, w := range weights {
+		routes[i] = newRoute(ServicePoolRoute{
+			ServicePath:   fmt.Sprintf("localhost:%d", 9000+i),
+			ServiceActive: true,
+			ServiceWeight: w,
+		})
+	}
+	return routes
+}
+
+func TestStrategies(t *testing.T) {
+
+	t.Run("Unknown strategy", func(t *testing.T) {
+		if _, err := NewStrategy("unknown"); err == nil {
+			t.Errorf("unknown strategy should not be created")
+		}
+	})
+
+	t.Run("Skip unavailable routes", func(t *testing.T) {
+		for _, name := range []string{
+			StrategyLeastConnections,
+			StrategyRoundRobin,
+			StrategyWeightedRoundRobin,
+			StrategyRandom,
+			StrategyPowerOfTwoChoices,
+			StrategyConsistentHash,
+		} {
+			strategy, err := NewStrategy(name)
+			if err != nil {
+				t.Fatalf("cannot create strategy %s, error: %+v", name, err)
+			}
+			routes := newTestRoutes(1, 1, 1)
+			routes[0].active.Store(false)
+			routes[2].healthy.Store(false)
+			for i := 0; i < 10; i++ {
+				if rte := strategy.Next(routes); rte != routes[1] {
+					t.Errorf("strategy %s selected unavailable route", name)
+				}
+			}
+			routes[1].healthy.Store(false)
+			if rte := strategy.Next(routes); rte != nil {
+				t.Errorf("strategy %s should not select any route", name)
+			}
+			if rte := strategy.Next(nil); rte != nil {
+				t.Errorf("strategy %s should not select from empty routes", name)
+			}
+		}
+	})
+
+	t.Run("Least connections", func(t *testing.T) {
+		strategy, _ := NewStrategy(StrategyLeastConnections)
+		routes := newTestRoutes(1, 1, 1)
+		routes[0].connections = 3
+		routes[1].connections = 1
+		routes[2].connections = 2
+		if rte := strategy.Next(routes); rte != routes[1] {
+			t.Errorf("least loaded route should be selected")
+		}
+	})
+
+	t.Run("Weighted least connections", func(t *testing.T) {
+		strategy, _ := NewStrategy(StrategyLeastConnections)
+		routes := newTestRoutes(4, 1)
+		if rte := strategy.Next(routes); rte != routes[0] {
+			t.Errorf("heavier route should be preferred on equal load")
+		}
+		// 3 of 4 is less loaded than 1 of 1
+		routes[0].connections = 3
+		routes[1].connections = 1
+		if rte := strategy.Next(routes); rte != routes[0] {
+			t.Errorf("route with less connections per weight should be selected")
+		}
+		routes[0].connections = 5
+		if rte := strategy.Next(routes); rte != routes[1] {
+			t.Errorf("route with less connections per weight should be selected")
+		}
+	})
+
+	t.Run("Round robin", func(t *testing.T) {
+		strategy, _ := NewStrategy(StrategyRoundRobin)
+		routes := newTestRoutes(1, 1, 1)
+		for i := 0; i < 6; i++ {
+			if rte := strategy.Next(routes); rte != routes[i%3] {
+				t.Errorf("routes should be selected in order, iteration %d", i)
+			}
+		}
+	})
+
+	t.Run("Weighted round robin", func(t *testing.T) {
+		strategy, _ := NewStrategy(StrategyWeightedRoundRobin)
+		routes := newTestRoutes(5, 1, 1)
+		selected := map[*Route]int{}
+		sequence := make([]*Route, 0, 7)
+		for i := 0; i < 7; i++ {
+			rte := strategy.Next(routes)
+			selected[rte]++
+			sequence = append(sequence, rte)
+		}
+		if selected[routes[0]] != 5 || selected[routes[1]] != 1 || selected[routes[2]] != 1 {
+			t.Errorf("routes should be selected proportionally to weights, got: %d %d %d",
+				selected[routes[0]], selected[routes[1]], selected[routes[2]])
+		}
+		// Smooth selection does not select heavy route 5 times in a row
+		for i := 0; i+4 < len(sequence); i++ {
+			if sequence[i] == sequence[i+1] && sequence[i] == sequence[i+2] &&
+				sequence[i] == sequence[i+3] && sequence[i] == sequence[i+4] {
+				t.Errorf("weighted selection should be spread evenly")
+			}
+		}
+	})
+
+	t.Run("Random", func(t *testing.T) {
+		strategy, _ := NewStrategy(StrategyRandom)
+		routes := newTestRoutes(1, 1, 1)
+		selected := map[*Route]int{}
+		for i := 0; i < 300; i++ {
+			selected[strategy.Next(routes)]++
+		}
+		for i, rte := range routes {
+			if selected[rte] == 0 {
+				t.Errorf("route %d was never selected", i)
+			}
+		}
+	})
+
+	t.Run("Power of two choices", func(t *testing.T) {
+		strategy, _ := NewStrategy(StrategyPowerOfTwoChoices)
+		routes := newTestRoutes(1, 1)
+		routes[0].connections = 10
+		for i := 0; i < 10; i++ {
+			if rte := strategy.Next(routes); rte != routes[1] {
+				t.Errorf("less loaded route of two should be selected")
+			}
+		}
+	})
+}